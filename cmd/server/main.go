@@ -4,14 +4,17 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
 	"github.com/vivek-pk/goadblock/internal/api"
 	"github.com/vivek-pk/goadblock/internal/blocker"
 	"github.com/vivek-pk/goadblock/internal/config"
+	"github.com/vivek-pk/goadblock/internal/dhcp"
 	"github.com/vivek-pk/goadblock/internal/dns"
 )
 
@@ -24,37 +27,60 @@ func main() {
 	log.Printf("Configuration loaded - Using DNS port: %d, HTTP port: %d",
 		config.GetDnsPort(), config.GetHttpPort())
 
+	// Create context for graceful shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// Initialize ad blocker
 	adblocker := blocker.New()
 
-	// Load blocklists with debug info
+	// Load blocklist subscriptions; what was saved through the API wins over
+	// the config file, which wins over the built-in defaults
 	log.Println("Loading blocklists...")
-	blocklists := map[string]string{
-		"stevenblack": "https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts",
-		"adaway":      "https://adaway.org/hosts.txt",
+	subscriptions := blocker.NewSubscriptionManager(adblocker,
+		filepath.Join(config.GetDataDir(), "subscriptions.json"))
+	defaults, err := defaultSubscriptions()
+	if err != nil {
+		log.Fatalf("Invalid blocklist configuration: %v", err)
+	}
+	if err := subscriptions.Load(defaults); err != nil {
+		log.Fatalf("Failed to load blocklist subscriptions: %v", err)
 	}
 
-	err := adblocker.LoadMultipleLists(blocklists)
-	if err != nil {
-		log.Fatalf("Failed to load blocklists: %v", err)
+	// Serve the last good copies straight away; the box may boot before the
+	// WAN link is up
+	if err := adblocker.SetCacheDir(filepath.Join(config.GetDataDir(), "blocklists")); err != nil {
+		log.Printf("Blocklist cache disabled: %v", err)
+	} else if n := adblocker.LoadCachedLists(subscriptions.Sources()); n > 0 {
+		log.Printf("Loaded %d blocklists from cache", n)
 	}
 
-	// Print stats after loading
-	stats := adblocker.GetBlocklistStats()
-	log.Printf("Loaded %d blocklists", len(stats))
-	for name, stat := range stats {
-		log.Printf("Blocklist %s: %d domains", name, stat["domains"])
+	// Refresh in the background so DNS starts with the cached copies instead
+	// of waiting out download timeouts. A failing list must not take DNS down
+	// with it; it keeps being retried with the other degraded lists.
+	go func() {
+		if err := subscriptions.LoadAll(); err != nil {
+			log.Printf("Some blocklists failed to load: %v", err)
+		}
+		logBlocklistStats(adblocker)
+	}()
+
+	// A services.json in the data dir replaces the built-in catalogue
+	if err := adblocker.SetServicesFile(filepath.Join(config.GetDataDir(), "services.json")); err != nil {
+		log.Printf("Using the built-in service catalogue: %v", err)
 	}
 
-	// Add regex pattern for blocking
-	err = adblocker.AddBlockRegex(`^ad[0-9]+\.example\.com$`)
-	if err != nil {
-		log.Fatalf("Failed to add block regex: %v", err)
+	schedules := blocker.NewScheduleManager(adblocker, filepath.Join(config.GetDataDir(), "schedules.json"))
+	if err := schedules.Load(); err != nil {
+		log.Fatalf("Failed to load schedules: %v", err)
 	}
 
-	// Create context for graceful shutdown
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	go subscriptions.Run(ctx)
+	go adblocker.RetryDegradedLists(ctx, time.Minute)
+	go adblocker.RunExpiry(ctx, time.Second)
+	if err := adblocker.WatchLocalLists(ctx); err != nil {
+		log.Printf("Local blocklists will not be reloaded on change: %v", err)
+	}
 
 	// Setup signal handling
 	sigChan := make(chan os.Signal, 1)
@@ -69,17 +95,83 @@ func main() {
 	// Create DNS server with API notifier and config
 	dnsConfig := dns.ServerConfig{
 		UpstreamServers: []string{"8.8.8.8:53", "1.1.1.1:53"},
+		Forwarders:      forwardRules(),
+		LocalResolver:   config.GetLocalResolver(),
+		HostsFile:       config.GetHostsFile(),
+		LeaseFile:       config.GetLeaseFile(),
+		LeaseFormat:     config.GetLeaseFormat(),
+		LeaseDomain:     config.GetLeaseDomain(),
+		ServeLeases:     config.GetServeLeases(),
+		RebindProtect:   config.GetRebindProtection(),
+		RebindMode:      config.GetRebindMode(),
+		RebindAllowlist: config.GetRebindAllowlist(),
+		DNS64Prefix:     config.GetDNS64Prefix(),
+		DNS64Clients:    config.GetDNS64Clients(),
+		TLSAddr:         config.GetTLSListen(),
+		TLSCertFile:     config.GetTLSCertFile(),
+		TLSKeyFile:      config.GetTLSKeyFile(),
+		AllowedClients:  config.GetAllowedClients(),
+		DeniedClients:   config.GetDeniedClients(),
+		RateLimit:       rateLimit(),
+		RefuseAny:       config.GetRefuseAny(),
+		QtypePolicies:   qtypePolicies(),
 		BlockingMode:    "zero_ip",
 		BlockingIP:      "0.0.0.0",
 		CacheSize:       10000,
 	}
+	if err := dnsConfig.Validate(); err != nil {
+		log.Fatalf("Invalid DNS configuration: %v", err)
+	}
 	dnsServer := dns.NewServer(adblocker, apiServer, dnsConfig)
 
+	groups := dns.NewGroupManager(filepath.Join(config.GetDataDir(), "groups.json"))
+	if err := groups.Load(defaultGroups()); err != nil {
+		log.Fatalf("Failed to load client groups: %v", err)
+	}
+	dnsServer.SetGroups(groups)
+
+	records := dns.NewRecordManager(filepath.Join(config.GetDataDir(), "rewrites.json"))
+	if err := records.Load(defaultRewrites()); err != nil {
+		log.Fatalf("Failed to load local records: %v", err)
+	}
+	dnsServer.SetRecords(records)
+
+	if err := dnsServer.WatchLeases(ctx); err != nil {
+		log.Printf("DHCP leases will not be reloaded on change: %v", err)
+	}
+
+	// The built-in DHCP server is optional; its leases name clients just
+	// like a mounted lease file
+	dhcpSettings, err := config.GetDHCP()
+	if err != nil {
+		log.Fatalf("Invalid DHCP configuration: %v", err)
+	}
+	var dhcpServer *dhcp.Server
+	if dhcpSettings.Enabled {
+		dhcpConf, err := dhcpConfig(dhcpSettings)
+		if err != nil {
+			log.Fatalf("Invalid DHCP configuration: %v", err)
+		}
+		dhcpServer, err = dhcp.NewServer(dhcpConf, filepath.Join(config.GetDataDir(), "dhcp_leases.json"))
+		if err != nil {
+			log.Fatalf("Invalid DHCP configuration: %v", err)
+		}
+		if err := dhcpServer.Load(); err != nil {
+			log.Fatalf("Failed to load DHCP leases: %v", err)
+		}
+		dhcpServer.OnChange(func(leases []dhcp.Lease) {
+			dnsServer.SetDHCPLeases(dnsLeases(leases))
+		})
+	}
+
 	// Update API server's DNS server reference
 	apiServer.SetDNSServer(dnsServer)
+	apiServer.SetSubscriptions(subscriptions)
+	apiServer.SetSchedules(schedules)
+	apiServer.SetDHCP(dhcpServer)
 
 	// Start servers one by one
-	log.Printf("Starting DNS server on :%d", config.GetDnsPort())
+	log.Printf("Starting DNS server on :%d (UDP and TCP)", config.GetDnsPort())
 	dnsErrChan := make(chan error, 1)
 	go func() {
 		if err := dnsServer.Start(fmt.Sprintf(":%d", config.GetDnsPort())); err != nil {
@@ -97,6 +189,18 @@ func main() {
 		log.Fatalf("DNS server startup timed out")
 	}
 
+	dhcpErrChan := make(chan error, 1)
+	if dhcpServer != nil {
+		log.Printf("Starting DHCP server on %s", dhcpSettings.Listen)
+		go func() {
+			if err := dhcpServer.Start(dhcpSettings.Listen); err != nil {
+				dhcpErrChan <- err
+			}
+		}()
+	}
+
+	go apiServer.RefreshHostnames(ctx, 5*time.Minute)
+
 	// Now start the API server
 	log.Printf("Starting API server on :%d", config.GetHttpPort())
 	apiErrChan := make(chan error, 1)
@@ -129,11 +233,242 @@ func main() {
 			log.Printf("Error shutting down DNS server: %v", err)
 		}
 
+		if dhcpServer != nil {
+			log.Println("Shutting down DHCP server...")
+			if err := dhcpServer.Shutdown(ctx); err != nil {
+				log.Printf("Error shutting down DHCP server: %v", err)
+			}
+		}
+
 	case err := <-dnsErrChan:
 		log.Fatalf("DNS server error: %v", err)
 	case err := <-apiErrChan:
 		log.Fatalf("API server error: %v", err)
+	case err := <-dhcpErrChan:
+		log.Fatalf("DHCP server error: %v", err)
 	}
 
 	log.Println("Servers shutdown complete")
 }
+
+// defaultSubscriptions returns the blocklists from the config file, or the
+// built-in set when none are configured. A "local" list backed by a
+// directory of hosts files under the data dir is always included.
+func defaultSubscriptions() ([]blocker.Subscription, error) {
+	configured, err := config.GetBlocklists()
+	if err != nil {
+		return nil, err
+	}
+
+	subs := make([]blocker.Subscription, 0, len(configured)+1)
+	for _, c := range configured {
+		if c.Name == "local" {
+			return nil, fmt.Errorf("blocklist name %q is reserved", c.Name)
+		}
+		subs = append(subs, blocker.Subscription{
+			Name:    c.Name,
+			URL:     c.URL,
+			Format:  c.Format,
+			Refresh: c.Refresh,
+			Enabled: c.IsEnabled(),
+			Group:   c.Group,
+		})
+	}
+
+	if len(subs) == 0 {
+		subs = append(subs,
+			blocker.Subscription{
+				Name:    "stevenblack",
+				URL:     "https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts",
+				Format:  blocker.FormatHosts,
+				Enabled: true,
+				Group:   "ads",
+			},
+			blocker.Subscription{
+				Name:    "adaway",
+				URL:     "https://adaway.org/hosts.txt",
+				Format:  blocker.FormatHosts,
+				Enabled: true,
+				Group:   "ads",
+			},
+		)
+	}
+
+	// Hosts files dropped into this directory form the "local" list
+	localDir := filepath.Join(config.GetDataDir(), "lists.d")
+	if err := os.MkdirAll(localDir, 0o755); err != nil {
+		log.Printf("Local blocklist directory unavailable: %v", err)
+		return subs, nil
+	}
+	subs = append(subs, blocker.Subscription{
+		Name:    "local",
+		URL:     "file://" + localDir,
+		Format:  blocker.FormatHosts,
+		Enabled: true,
+		Group:   "custom",
+	})
+	return subs, nil
+}
+
+// logBlocklistStats prints the state of every blocklist after loading
+func logBlocklistStats(adblocker *blocker.Blocker) {
+	stats := adblocker.GetBlocklistStats()
+	log.Printf("Loaded %d blocklists", len(stats))
+	for name, stat := range stats {
+		if stat["degraded"] == 1 {
+			log.Printf("Blocklist %s: degraded, will retry", name)
+			continue
+		}
+		log.Printf("Blocklist %s: %d domains", name, stat["domains"])
+	}
+}
+
+// defaultGroups returns the client groups from the config file
+func defaultGroups() []dns.ClientGroup {
+	configured, err := config.GetGroups()
+	if err != nil {
+		log.Fatalf("Invalid client group configuration: %v", err)
+	}
+
+	groups := make([]dns.ClientGroup, 0, len(configured))
+	for _, c := range configured {
+		groups = append(groups, dns.ClientGroup{
+			Name:         c.Name,
+			Clients:      c.Clients,
+			MACs:         c.MACs,
+			Tokens:       c.Tokens,
+			Lists:        c.Lists,
+			Allowlist:    c.Allowlist,
+			Regexes:      c.Regexes,
+			Services:     c.Services,
+			SafeSearch:   c.SafeSearch,
+			BlockingMode: c.BlockingMode,
+			BlockingIP:   c.BlockingIP,
+		})
+	}
+	return groups
+}
+
+// defaultRewrites returns the local records from the config file
+func defaultRewrites() []dns.LocalRecord {
+	configured, err := config.GetRewrites()
+	if err != nil {
+		log.Fatalf("Invalid rewrite configuration: %v", err)
+	}
+
+	records := make([]dns.LocalRecord, 0, len(configured))
+	for _, c := range configured {
+		records = append(records, dns.LocalRecord{
+			Name:  c.Name,
+			Type:  c.Type,
+			Value: c.Value,
+			TTL:   c.TTL,
+		})
+	}
+	return records
+}
+
+// forwardRules returns the conditional forwarding rules from the config file
+func forwardRules() []dns.ForwardRule {
+	configured, err := config.GetForwarders()
+	if err != nil {
+		log.Fatalf("Invalid forwarder configuration: %v", err)
+	}
+
+	rules := make([]dns.ForwardRule, 0, len(configured))
+	for _, c := range configured {
+		rules = append(rules, dns.ForwardRule{
+			Suffix:       c.Suffix,
+			Upstreams:    c.Upstreams,
+			Strategy:     c.Strategy,
+			SkipBlocking: c.SkipBlocking,
+		})
+	}
+	return rules
+}
+
+// qtypePolicies returns the query type filtering policies from the config
+// file
+func qtypePolicies() []dns.QtypePolicy {
+	configured, err := config.GetQtypePolicies()
+	if err != nil {
+		log.Fatalf("Invalid qtype policy configuration: %v", err)
+	}
+
+	policies := make([]dns.QtypePolicy, 0, len(configured))
+	for _, c := range configured {
+		policies = append(policies, dns.QtypePolicy{
+			Name:   c.Name,
+			Types:  c.Types,
+			Groups: c.Groups,
+		})
+	}
+	return policies
+}
+
+// rateLimit returns the per-client rate limit from the config file
+func rateLimit() dns.RateLimit {
+	c := config.GetRateLimit()
+	return dns.RateLimit{
+		QPS:        c.QPS,
+		Burst:      c.Burst,
+		IPv4Prefix: c.IPv4Prefix,
+		IPv6Prefix: c.IPv6Prefix,
+		Action:     c.Action,
+		Exempt:     c.Exempt,
+	}
+}
+
+// dhcpConfig converts the DHCP section of the config file
+func dhcpConfig(c config.DHCPConfig) (dhcp.Config, error) {
+	conf := dhcp.Config{
+		ServerIP:   net.ParseIP(c.ServerIP),
+		RangeStart: net.ParseIP(c.RangeStart),
+		RangeEnd:   net.ParseIP(c.RangeEnd),
+		Domain:     c.Domain,
+	}
+	if c.SubnetMask != "" {
+		mask := net.ParseIP(c.SubnetMask).To4()
+		if mask == nil {
+			return conf, fmt.Errorf("invalid subnet mask %q", c.SubnetMask)
+		}
+		conf.SubnetMask = net.IPMask(mask)
+	}
+	if c.Router != "" {
+		if conf.Router = net.ParseIP(c.Router); conf.Router == nil {
+			return conf, fmt.Errorf("invalid router %q", c.Router)
+		}
+	}
+	for _, server := range c.DNS {
+		ip := net.ParseIP(server)
+		if ip == nil {
+			return conf, fmt.Errorf("invalid DNS server %q", server)
+		}
+		conf.DNS = append(conf.DNS, ip)
+	}
+	if c.LeaseTime != "" {
+		d, err := time.ParseDuration(c.LeaseTime)
+		if err != nil {
+			return conf, fmt.Errorf("invalid lease time: %w", err)
+		}
+		conf.LeaseTime = d
+	}
+	for _, r := range c.Reservations {
+		conf.Reservations = append(conf.Reservations, dhcp.Reservation{MAC: r.MAC, IP: r.IP, Hostname: r.Hostname})
+	}
+	return conf, nil
+}
+
+// dnsLeases converts DHCP server leases for client naming
+func dnsLeases(leases []dhcp.Lease) []dns.Lease {
+	converted := make([]dns.Lease, 0, len(leases))
+	for _, lease := range leases {
+		converted = append(converted, dns.Lease{
+			IP:       lease.IP,
+			MAC:      lease.MAC,
+			Hostname: lease.Hostname,
+			Expires:  lease.Expires,
+		})
+	}
+	return converted
+}
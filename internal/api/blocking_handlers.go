@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+type PauseRequest struct {
+	Duration string `json:"duration"`
+	Client   string `json:"client"`
+	Group    string `json:"group"`
+}
+
+// HandlePauseBlocking turns blocking off for a while, globally, for one
+// client or for a client group
+func (s *APIServer) handlePauseBlocking(w http.ResponseWriter, r *http.Request) {
+	var req PauseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 {
+		http.Error(w, "A positive duration such as \"30m\" is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Client != "" && net.ParseIP(req.Client) == nil {
+		http.Error(w, "Client must be an IP address", http.StatusBadRequest)
+		return
+	}
+	if req.Client != "" && req.Group != "" {
+		http.Error(w, "Pause a client or a group, not both", http.StatusBadRequest)
+		return
+	}
+
+	if req.Group != "" {
+		if _, ok := s.dnsServer.Groups().Get(req.Group); !ok {
+			http.Error(w, "Unknown client group", http.StatusBadRequest)
+			return
+		}
+		s.dnsServer.PauseGroup(d, req.Group)
+	} else {
+		s.dnsServer.PauseBlocking(d, req.Client)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.dnsServer.PauseStatus())
+}
+
+// HandleResumeBlocking ends a pause early
+func (s *APIServer) handleResumeBlocking(w http.ResponseWriter, r *http.Request) {
+	var req PauseRequest
+	// An empty body resumes global blocking
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Group != "" {
+		s.dnsServer.ResumeGroup(req.Group)
+	} else {
+		s.dnsServer.ResumeBlocking(req.Client)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.dnsServer.PauseStatus())
+}
+
+// HandleBlockingStatus reports active pauses
+func (s *APIServer) handleBlockingStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.dnsServer.PauseStatus())
+}
@@ -2,16 +2,62 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vivek-pk/goadblock/internal/blocker"
 )
 
+// Expiry is embedded in requests that can create temporary rules. Either a
+// duration from now ("1h30m") or an absolute time may be given.
+type Expiry struct {
+	Duration  string     `json:"duration,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Time resolves the request into an expiry time, zero for permanent rules
+func (e Expiry) Time() (time.Time, error) {
+	switch {
+	case e.Duration != "" && e.ExpiresAt != nil:
+		return time.Time{}, errors.New("duration and expiresAt are mutually exclusive")
+	case e.Duration != "":
+		d, err := time.ParseDuration(e.Duration)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid duration: %w", err)
+		}
+		if d <= 0 {
+			return time.Time{}, errors.New("duration must be positive")
+		}
+		return time.Now().Add(d), nil
+	case e.ExpiresAt != nil:
+		if !e.ExpiresAt.After(time.Now()) {
+			return time.Time{}, errors.New("expiresAt must be in the future")
+		}
+		return *e.ExpiresAt, nil
+	}
+	return time.Time{}, nil
+}
+
 type DomainRequest struct {
 	Domain string `json:"domain"`
 	List   string `json:"list"`
+	Expiry
+}
+
+type BlocklistPatchRequest struct {
+	Enabled *bool `json:"enabled"`
 }
 
 type RegexRequest struct {
+	ID      string `json:"id"`
 	Pattern string `json:"pattern"`
+	Comment string `json:"comment"`
+	Expiry
 }
 
 // HandleGetBlocklists returns all blocklists
@@ -22,6 +68,41 @@ func (s *APIServer) handleGetBlocklists(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(stats)
 }
 
+// HandlePatchBlocklist enables or disables a blocklist. Lists backed by a
+// subscription are toggled through it so the state survives a restart.
+func (s *APIServer) handlePatchBlocklist(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req BlocklistPatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Enabled == nil {
+		http.Error(w, "Enabled is required", http.StatusBadRequest)
+		return
+	}
+
+	if s.subscriptions != nil {
+		if _, ok := s.subscriptions.Get(name); ok {
+			if err := s.subscriptions.SetEnabled(name, *req.Enabled); err != nil {
+				writeSubscriptionError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
+	if !s.dnsServer.GetBlocker().SetListEnabled(name, *req.Enabled) {
+		http.Error(w, "Blocklist not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
 // HandleAddDomainToBlocklist adds a domain to a blocklist
 func (s *APIServer) handleAddDomainToBlocklist(w http.ResponseWriter, r *http.Request) {
 	var req DomainRequest
@@ -35,7 +116,13 @@ func (s *APIServer) handleAddDomainToBlocklist(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	s.dnsServer.GetBlocker().AddDomainToBlocklist(req.Domain, req.List)
+	expiresAt, err := req.Expiry.Time()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.dnsServer.GetBlocker().AddDomainToBlocklistUntil(req.Domain, req.List, expiresAt)
 
 	w.WriteHeader(http.StatusCreated)
 }
@@ -61,15 +148,18 @@ func (s *APIServer) handleRemoveDomainFromBlocklist(w http.ResponseWriter, r *ht
 	w.WriteHeader(http.StatusOK)
 }
 
-// HandleGetWhitelist returns the current whitelist
+// HandleGetWhitelist returns the current whitelist, including the time left
+// on temporary entries
 func (s *APIServer) handleGetWhitelist(w http.ResponseWriter, r *http.Request) {
-	whitelist := s.dnsServer.GetBlocker().GetWhitelist()
+	whitelist := s.dnsServer.GetBlocker().GetAllowRules()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(whitelist)
 }
 
-// HandleAddToWhitelist adds a domain to the whitelist
+// HandleAddToWhitelist adds an entry to the whitelist. Besides plain
+// domains it accepts ||domain^ (domain and subdomains), *.domain
+// (subdomains only) and /regex/ entries.
 func (s *APIServer) handleAddToWhitelist(w http.ResponseWriter, r *http.Request) {
 	var req DomainRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -82,7 +172,16 @@ func (s *APIServer) handleAddToWhitelist(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	s.dnsServer.GetBlocker().AddToWhitelist(req.Domain)
+	expiresAt, err := req.Expiry.Time()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.dnsServer.GetBlocker().AddAllowRuleUntil(req.Domain, expiresAt); err != nil {
+		http.Error(w, "Invalid allowlist entry: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	w.WriteHeader(http.StatusCreated)
 }
@@ -105,15 +204,16 @@ func (s *APIServer) handleRemoveFromWhitelist(w http.ResponseWriter, r *http.Req
 	w.WriteHeader(http.StatusOK)
 }
 
-// HandleGetRegexPatterns returns all regex blocking patterns
+// HandleGetRegexPatterns returns all regex blocking rules with their hit
+// counters
 func (s *APIServer) handleGetRegexPatterns(w http.ResponseWriter, r *http.Request) {
-	patterns := s.dnsServer.GetBlocker().GetRegexPatterns()
+	rules := s.dnsServer.GetBlocker().GetRegexRules()
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(patterns)
+	json.NewEncoder(w).Encode(rules)
 }
 
-// HandleAddRegexPattern adds a regex blocking pattern
+// HandleAddRegexPattern adds a regex blocking rule
 func (s *APIServer) handleAddRegexPattern(w http.ResponseWriter, r *http.Request) {
 	var req RegexRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -126,15 +226,24 @@ func (s *APIServer) handleAddRegexPattern(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	if err := s.dnsServer.GetBlocker().AddBlockRegex(req.Pattern); err != nil {
+	expiresAt, err := req.Expiry.Time()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rule, err := s.dnsServer.GetBlocker().AddRegexRuleUntil(req.Pattern, req.Comment, expiresAt)
+	if err != nil {
 		http.Error(w, "Invalid regex pattern: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
 }
 
-// HandleRemoveRegexPattern removes a regex blocking pattern
+// HandleRemoveRegexPattern removes a regex blocking rule by ID or pattern
 func (s *APIServer) handleRemoveRegexPattern(w http.ResponseWriter, r *http.Request) {
 	var req RegexRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -142,12 +251,103 @@ func (s *APIServer) handleRemoveRegexPattern(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	if req.ID == "" && req.Pattern == "" {
+		http.Error(w, "ID or pattern is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.ID != "" {
+		if err := s.dnsServer.GetBlocker().RemoveRegexRule(req.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	} else {
+		s.dnsServer.GetBlocker().RemoveBlockRegex(req.Pattern)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// RegexTestResult reports how a candidate pattern would behave
+type RegexTestResult struct {
+	Pattern        string   `json:"pattern"`
+	Valid          bool     `json:"valid"`
+	Error          string   `json:"error,omitempty"`
+	PopularMatches []string `json:"popularMatches"`
+	Matches        []string `json:"matches"`
+	Tested         int      `json:"tested"`
+}
+
+// HandleTestRegexPattern dry-runs a pattern against the recent queries
+// without saving it
+func (s *APIServer) handleTestRegexPattern(w http.ResponseWriter, r *http.Request) {
+	var req RegexRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
 	if req.Pattern == "" {
 		http.Error(w, "Pattern is required", http.StatusBadRequest)
 		return
 	}
 
-	s.dnsServer.GetBlocker().RemoveBlockRegex(req.Pattern)
+	result := RegexTestResult{
+		Pattern:        req.Pattern,
+		PopularMatches: []string{},
+		Matches:        []string{},
+	}
 
-	w.WriteHeader(http.StatusOK)
+	regex, err := regexp.Compile(req.Pattern)
+	if err != nil {
+		result.Error = err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	if _, err := blocker.ValidateRegex(req.Pattern); err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Valid = true
+	}
+	if hits := blocker.PopularMatches(regex); hits != nil {
+		result.PopularMatches = hits
+	}
+
+	seen := make(map[string]struct{})
+	for _, domain := range s.recentDomains() {
+		if _, ok := seen[domain]; ok {
+			continue
+		}
+		seen[domain] = struct{}{}
+		if regex.MatchString(domain) {
+			result.Matches = append(result.Matches, domain)
+		}
+	}
+	result.Tested = len(seen)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// HandleExplain reports every rule matching a domain and the resulting
+// decision. The client defaults to the caller's address.
+func (s *APIServer) handleExplain(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("domain")
+	if domain == "" {
+		http.Error(w, "Domain is required", http.StatusBadRequest)
+		return
+	}
+
+	client := r.URL.Query().Get("client")
+	if client == "" {
+		client, _, _ = net.SplitHostPort(r.RemoteAddr)
+	} else if net.ParseIP(client) == nil {
+		http.Error(w, "Client must be an IP address", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.dnsServer.Explain(domain, client))
 }
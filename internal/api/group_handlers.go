@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/vivek-pk/goadblock/internal/blocker"
+	"github.com/vivek-pk/goadblock/internal/dns"
+)
+
+// writeGroupError maps group manager errors onto HTTP status codes
+func writeGroupError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, dns.ErrGroupNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, dns.ErrGroupExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// checkServices rejects groups blocking services missing from the catalogue
+func (s *APIServer) checkServices(group dns.ClientGroup) error {
+	for _, id := range group.Services {
+		if !s.dnsServer.GetBlocker().HasService(id) {
+			return fmt.Errorf("unknown service %q", id)
+		}
+	}
+	return nil
+}
+
+// HandleGetGroups returns all client groups
+func (s *APIServer) handleGetGroups(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.dnsServer.Groups().List())
+}
+
+// HandleGetGroup returns a single client group
+func (s *APIServer) handleGetGroup(w http.ResponseWriter, r *http.Request) {
+	group, ok := s.dnsServer.Groups().Get(mux.Vars(r)["name"])
+	if !ok {
+		http.Error(w, dns.ErrGroupNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+// HandleAddGroup creates a client group
+func (s *APIServer) handleAddGroup(w http.ResponseWriter, r *http.Request) {
+	var group dns.ClientGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.checkServices(group); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.dnsServer.Groups().Add(group); err != nil {
+		writeGroupError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+// HandleUpdateGroup replaces an existing client group
+func (s *APIServer) handleUpdateGroup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var group dns.ClientGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if group.Name != "" && group.Name != name {
+		http.Error(w, "Groups cannot be renamed", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.checkServices(group); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.dnsServer.Groups().Update(name, group); err != nil {
+		writeGroupError(w, err)
+		return
+	}
+
+	group, _ = s.dnsServer.Groups().Get(name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+// HandleDeleteGroup removes a client group
+func (s *APIServer) handleDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	if err := s.dnsServer.Groups().Remove(mux.Vars(r)["name"]); err != nil {
+		writeGroupError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleBlockService blocks a catalogue service for a group
+func (s *APIServer) handleBlockService(w http.ResponseWriter, r *http.Request) {
+	s.setServiceBlocked(w, r, true)
+}
+
+// HandleUnblockService unblocks a catalogue service for a group
+func (s *APIServer) handleUnblockService(w http.ResponseWriter, r *http.Request) {
+	s.setServiceBlocked(w, r, false)
+}
+
+func (s *APIServer) setServiceBlocked(w http.ResponseWriter, r *http.Request, blocked bool) {
+	vars := mux.Vars(r)
+	if blocked && !s.dnsServer.GetBlocker().HasService(vars["id"]) {
+		http.Error(w, "Service not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.dnsServer.Groups().SetServiceBlocked(vars["name"], vars["id"], blocked); err != nil {
+		writeGroupError(w, err)
+		return
+	}
+
+	group, _ := s.dnsServer.Groups().Get(vars["name"])
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+// ServiceStatus is a catalogue entry with the groups blocking it
+type ServiceStatus struct {
+	blocker.Service
+	Groups []string `json:"groups"`
+}
+
+// HandleGetServices returns the blocked services catalogue
+func (s *APIServer) handleGetServices(w http.ResponseWriter, r *http.Request) {
+	groups := s.dnsServer.Groups().List()
+
+	services := s.dnsServer.GetBlocker().GetServices()
+	statuses := make([]ServiceStatus, 0, len(services))
+	for _, svc := range services {
+		status := ServiceStatus{Service: svc, Groups: []string{}}
+		for _, group := range groups {
+			for _, id := range group.Services {
+				if id == svc.ID {
+					status.Groups = append(status.Groups, group.Name)
+					break
+				}
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// HandleReloadServices re-reads the catalogue file
+func (s *APIServer) handleReloadServices(w http.ResponseWriter, r *http.Request) {
+	if err := s.dnsServer.GetBlocker().ReloadServices(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.handleGetServices(w, r)
+}
+
+// HandleDoH answers DNS over HTTPS queries
+func (s *APIServer) handleDoH(w http.ResponseWriter, r *http.Request) {
+	s.dnsServer.ServeDoH(w, r, mux.Vars(r)["token"])
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/vivek-pk/goadblock/internal/dns"
+)
+
+// writeRewriteError maps record manager errors onto HTTP status codes
+func writeRewriteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, dns.ErrRecordNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, dns.ErrRecordExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// HandleGetRewrites returns all local records
+func (s *APIServer) handleGetRewrites(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.dnsServer.Records().List())
+}
+
+// HandleAddRewrite creates a local record
+func (s *APIServer) handleAddRewrite(w http.ResponseWriter, r *http.Request) {
+	var req dns.LocalRecord
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	record, err := s.dnsServer.Records().Add(req)
+	if err != nil {
+		writeRewriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(record)
+}
+
+// HandleUpdateRewrite replaces an existing local record
+func (s *APIServer) handleUpdateRewrite(w http.ResponseWriter, r *http.Request) {
+	var req dns.LocalRecord
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	record, err := s.dnsServer.Records().Update(mux.Vars(r)["id"], req)
+	if err != nil {
+		writeRewriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
+
+// HandleDeleteRewrite removes a local record
+func (s *APIServer) handleDeleteRewrite(w http.ResponseWriter, r *http.Request) {
+	if err := s.dnsServer.Records().Remove(mux.Vars(r)["id"]); err != nil {
+		writeRewriteError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
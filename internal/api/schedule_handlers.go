@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/vivek-pk/goadblock/internal/blocker"
+)
+
+// writeScheduleError maps schedule manager errors onto HTTP status codes
+func writeScheduleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, blocker.ErrScheduleNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, blocker.ErrScheduleOverlap):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// HandleGetSchedules returns all schedules
+func (s *APIServer) handleGetSchedules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.schedules.List())
+}
+
+// HandleAddSchedule creates a schedule
+func (s *APIServer) handleAddSchedule(w http.ResponseWriter, r *http.Request) {
+	var req blocker.Schedule
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	schedule, err := s.schedules.Add(req)
+	if err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// HandleUpdateSchedule replaces an existing schedule
+func (s *APIServer) handleUpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	var req blocker.Schedule
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	schedule, err := s.schedules.Update(mux.Vars(r)["id"], req)
+	if err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// HandleDeleteSchedule removes a schedule
+func (s *APIServer) handleDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	if err := s.schedules.Remove(mux.Vars(r)["id"]); err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
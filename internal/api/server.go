@@ -10,11 +10,14 @@ import (
 	"log"
 	"net/http"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/vivek-pk/goadblock/internal/blocker"
+	"github.com/vivek-pk/goadblock/internal/dhcp"
 	"github.com/vivek-pk/goadblock/internal/dns"
 )
 
@@ -25,6 +28,7 @@ type Query struct {
 	ID        string    `json:"id"`
 	Domain    string    `json:"domain"`
 	Blocked   bool      `json:"blocked"`
+	Reason    string    `json:"reason,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
 }
 
@@ -35,13 +39,19 @@ type HourlyStats struct {
 
 type ClientStats struct {
 	IP             string    `json:"ip"`
+	Hostname       string    `json:"hostname,omitempty"`
+	MAC            string    `json:"mac,omitempty"`
 	TotalQueries   int64     `json:"totalQueries"`
 	BlockedQueries int64     `json:"blockedQueries"`
+	RateLimited    int64     `json:"rateLimited"`
 	LastSeen       time.Time `json:"lastSeen"`
 }
 
 type APIServer struct {
 	dnsServer     *dns.Server
+	subscriptions *blocker.SubscriptionManager
+	schedules     *blocker.ScheduleManager
+	dhcp          *dhcp.Server
 	port          int
 	startTime     time.Time
 	recentQueries []Query
@@ -92,7 +102,7 @@ func InitTemplates() *template.Template {
 }
 
 // Add method to track queries
-func (s *APIServer) AddQuery(domain string, clientIP string, blocked bool) {
+func (s *APIServer) AddQuery(domain string, clientIP string, blocked bool, reason string) {
 	s.queriesLock.Lock()
 	defer s.queriesLock.Unlock()
 
@@ -100,6 +110,7 @@ func (s *APIServer) AddQuery(domain string, clientIP string, blocked bool) {
 		ID:        uuid.New().String(),
 		Domain:    domain,
 		Blocked:   blocked,
+		Reason:    reason,
 		Timestamp: time.Now(),
 	}
 
@@ -142,6 +153,7 @@ func (s *APIServer) trackClientQuery(ip string, blocked bool) {
 			IP: ip,
 		}
 		s.clientStats[ip] = stats
+		go s.resolveClient(ip)
 	}
 
 	stats.TotalQueries++
@@ -151,6 +163,19 @@ func (s *APIServer) trackClientQuery(ip string, blocked bool) {
 	stats.LastSeen = time.Now()
 }
 
+// recentDomains returns the names from the recent query log without the
+// trailing dot, most recent first
+func (s *APIServer) recentDomains() []string {
+	s.queriesLock.RLock()
+	defer s.queriesLock.RUnlock()
+
+	domains := make([]string, len(s.recentQueries))
+	for i, q := range s.recentQueries {
+		domains[i] = strings.TrimSuffix(strings.ToLower(q.Domain), ".")
+	}
+	return domains
+}
+
 // Add new handler for queries
 func (s *APIServer) handleQueries(w http.ResponseWriter, r *http.Request) {
 	s.queriesLock.RLock()
@@ -189,13 +214,63 @@ func (s *APIServer) handleHourlyStats(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// RefreshHostnames re-resolves the hostnames of known clients every
+// interval until ctx is cancelled
+func (s *APIServer) RefreshHostnames(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.clientStatsMu.RLock()
+			ips := make([]string, 0, len(s.clientStats))
+			for ip := range s.clientStats {
+				ips = append(ips, ip)
+			}
+			s.clientStatsMu.RUnlock()
+
+			for _, ip := range ips {
+				s.resolveClient(ip)
+			}
+		}
+	}
+}
+
+// resolveClient looks up a client's hostname and MAC address and records
+// them
+func (s *APIServer) resolveClient(ip string) {
+	if s.dnsServer == nil {
+		return
+	}
+	hostname := s.dnsServer.ResolveHostname(ip)
+	mac := s.dnsServer.ClientMAC(ip)
+
+	s.clientStatsMu.Lock()
+	defer s.clientStatsMu.Unlock()
+
+	if stats, ok := s.clientStats[ip]; ok {
+		stats.Hostname = hostname
+		stats.MAC = mac
+	}
+}
+
 func (s *APIServer) handleClients(w http.ResponseWriter, r *http.Request) {
+	var limited map[string]int64
+	if s.dnsServer != nil {
+		limited = s.dnsServer.RateLimited()
+	}
+
 	s.clientStatsMu.RLock()
 	defer s.clientStatsMu.RUnlock()
 
 	clients := make([]*ClientStats, 0, len(s.clientStats))
 	for _, stats := range s.clientStats {
-		clients = append(clients, stats)
+		client := *stats
+		client.RateLimited = limited[stats.IP]
+		clients = append(clients, &client)
 	}
 
 	// Sort by last seen, most recent first
@@ -209,6 +284,30 @@ func (s *APIServer) handleClients(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// HandleGetLeases returns the current DHCP leases from every source
+func (s *APIServer) handleGetLeases(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"leases": s.dnsServer.Leases(),
+	})
+}
+
+// HandleGetDHCP returns the built-in DHCP server's leases and reservations
+func (s *APIServer) handleGetDHCP(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{
+		"enabled":      s.dhcp != nil,
+		"leases":       []dhcp.Lease{},
+		"reservations": []dhcp.Reservation{},
+	}
+	if s.dhcp != nil {
+		response["leases"] = s.dhcp.Leases()
+		response["reservations"] = s.dhcp.Reservations()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 func (s *APIServer) Start() error {
 	s.server = &http.Server{
 		Addr:         fmt.Sprintf(":%d", s.port),
@@ -252,9 +351,58 @@ func (s *APIServer) setupRoutes() {
 
 	// Blocklist management routes
 	s.router.HandleFunc("/api/v1/blocklists", s.handleGetBlocklists).Methods("GET")
+	s.router.HandleFunc("/api/v1/blocklists/{name}", s.handlePatchBlocklist).Methods("PATCH")
 	s.router.HandleFunc("/api/v1/blocklist/domain", s.handleAddDomainToBlocklist).Methods("POST")
 	s.router.HandleFunc("/api/v1/blocklist/domain", s.handleRemoveDomainFromBlocklist).Methods("DELETE")
 
+	s.router.HandleFunc("/api/v1/explain", s.handleExplain).Methods("GET")
+
+	// Blocking pause routes
+	s.router.HandleFunc("/api/v1/blocking/status", s.handleBlockingStatus).Methods("GET")
+	s.router.HandleFunc("/api/v1/blocking/pause", s.handlePauseBlocking).Methods("POST")
+	s.router.HandleFunc("/api/v1/blocking/resume", s.handleResumeBlocking).Methods("POST")
+
+	// Blocklist subscription routes
+	s.router.HandleFunc("/api/v1/subscriptions", s.handleGetSubscriptions).Methods("GET")
+	s.router.HandleFunc("/api/v1/subscriptions", s.handleAddSubscription).Methods("POST")
+	s.router.HandleFunc("/api/v1/subscriptions/{name}", s.handleUpdateSubscription).Methods("PUT")
+	s.router.HandleFunc("/api/v1/subscriptions/{name}", s.handleDeleteSubscription).Methods("DELETE")
+	s.router.HandleFunc("/api/v1/subscriptions/{name}/enable", s.handleEnableSubscription).Methods("POST")
+	s.router.HandleFunc("/api/v1/subscriptions/{name}/disable", s.handleDisableSubscription).Methods("POST")
+
+	// Client group routes
+	s.router.HandleFunc("/api/v1/groups", s.handleGetGroups).Methods("GET")
+	s.router.HandleFunc("/api/v1/groups", s.handleAddGroup).Methods("POST")
+	s.router.HandleFunc("/api/v1/groups/{name}", s.handleGetGroup).Methods("GET")
+	s.router.HandleFunc("/api/v1/groups/{name}", s.handleUpdateGroup).Methods("PUT")
+	s.router.HandleFunc("/api/v1/groups/{name}", s.handleDeleteGroup).Methods("DELETE")
+	s.router.HandleFunc("/api/v1/groups/{name}/services/{id}", s.handleBlockService).Methods("POST")
+	s.router.HandleFunc("/api/v1/groups/{name}/services/{id}", s.handleUnblockService).Methods("DELETE")
+
+	// Blocked services catalogue
+	s.router.HandleFunc("/api/v1/services", s.handleGetServices).Methods("GET")
+	s.router.HandleFunc("/api/v1/services/reload", s.handleReloadServices).Methods("POST")
+
+	// Schedule routes
+	s.router.HandleFunc("/api/v1/schedules", s.handleGetSchedules).Methods("GET")
+	s.router.HandleFunc("/api/v1/schedules", s.handleAddSchedule).Methods("POST")
+	s.router.HandleFunc("/api/v1/schedules/{id}", s.handleUpdateSchedule).Methods("PUT")
+	s.router.HandleFunc("/api/v1/schedules/{id}", s.handleDeleteSchedule).Methods("DELETE")
+
+	// Local record routes
+	s.router.HandleFunc("/api/v1/rewrites", s.handleGetRewrites).Methods("GET")
+	s.router.HandleFunc("/api/v1/rewrites", s.handleAddRewrite).Methods("POST")
+	s.router.HandleFunc("/api/v1/rewrites/{id}", s.handleUpdateRewrite).Methods("PUT")
+	s.router.HandleFunc("/api/v1/rewrites/{id}", s.handleDeleteRewrite).Methods("DELETE")
+
+	// DHCP leases from the lease file and the built-in DHCP server
+	s.router.HandleFunc("/api/v1/leases", s.handleGetLeases).Methods("GET")
+	s.router.HandleFunc("/api/v1/dhcp", s.handleGetDHCP).Methods("GET")
+
+	// DNS over HTTPS, optionally with a token selecting a client group
+	s.router.HandleFunc("/dns-query", s.handleDoH).Methods("GET", "POST")
+	s.router.HandleFunc("/dns-query/{token}", s.handleDoH).Methods("GET", "POST")
+
 	// Whitelist management routes
 	s.router.HandleFunc("/api/v1/whitelist", s.handleGetWhitelist).Methods("GET")
 	s.router.HandleFunc("/api/v1/whitelist", s.handleAddToWhitelist).Methods("POST")
@@ -264,6 +412,7 @@ func (s *APIServer) setupRoutes() {
 	s.router.HandleFunc("/api/v1/regex", s.handleGetRegexPatterns).Methods("GET")
 	s.router.HandleFunc("/api/v1/regex", s.handleAddRegexPattern).Methods("POST")
 	s.router.HandleFunc("/api/v1/regex", s.handleRemoveRegexPattern).Methods("DELETE")
+	s.router.HandleFunc("/api/v1/regex/test", s.handleTestRegexPattern).Methods("POST")
 
 	// Add static file serving
 	fs := http.FileServer(http.Dir("./internal/api/static"))
@@ -281,10 +430,13 @@ func (s *APIServer) handleDashboard(w http.ResponseWriter, r *http.Request) {
 func (s *APIServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	metrics := s.dnsServer.GetMetrics()
 	response := map[string]interface{}{
-		"totalQueries":   metrics.TotalQueries,
-		"blockedQueries": metrics.BlockedQueries,
-		"cacheHits":      metrics.CacheHits,
-		"cacheMisses":    metrics.CacheMisses,
+		"totalQueries":       metrics.TotalQueries,
+		"blockedQueries":     metrics.BlockedQueries,
+		"cacheHits":          metrics.CacheHits,
+		"cacheMisses":        metrics.CacheMisses,
+		"rateLimitedQueries": metrics.RateLimitedQueries,
+		"refusedQueries":     metrics.RefusedQueries,
+		"qtypeFiltered":      s.dnsServer.QtypeFiltered(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -308,6 +460,21 @@ func (s *APIServer) SetDNSServer(server *dns.Server) {
 	s.dnsServer = server
 }
 
+// SetSchedules wires in the schedule manager
+func (s *APIServer) SetSchedules(schedules *blocker.ScheduleManager) {
+	s.schedules = schedules
+}
+
+// SetDHCP sets the built-in DHCP server, nil when it is disabled
+func (s *APIServer) SetDHCP(server *dhcp.Server) {
+	s.dhcp = server
+}
+
+// SetSubscriptions wires in the blocklist subscription manager
+func (s *APIServer) SetSubscriptions(subscriptions *blocker.SubscriptionManager) {
+	s.subscriptions = subscriptions
+}
+
 // Add handler functions for each page
 func (s *APIServer) handleBlocklistsPage(w http.ResponseWriter, r *http.Request) {
 	s.templates.ExecuteTemplate(w, "blocklists.html", nil)
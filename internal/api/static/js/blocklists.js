@@ -0,0 +1,59 @@
+// Blocklist management page
+function blocklists() {
+  return {
+    lists: [],
+    error: '',
+
+    init() {
+      this.fetchLists();
+      setInterval(() => this.fetchLists(), 5000);
+    },
+
+    async fetchLists() {
+      try {
+        const response = await fetch('/api/v1/blocklists');
+        if (!response.ok) {
+          throw new Error('Blocklists fetch failed');
+        }
+        const data = await response.json();
+        this.lists = Object.keys(data)
+          .sort()
+          .map((name) => ({
+            name,
+            domains: data[name].domains,
+            blocks: data[name].blocks,
+            enabled: data[name].enabled === 1,
+            degraded: data[name].degraded === 1,
+            saving: false,
+          }));
+        this.error = '';
+      } catch (error) {
+        console.error('Failed to fetch blocklists:', error);
+        this.error = 'Could not load blocklists';
+      }
+    },
+
+    async toggle(list, enabled) {
+      list.saving = true;
+      try {
+        const response = await fetch(
+          `/api/v1/blocklists/${encodeURIComponent(list.name)}`,
+          {
+            method: 'PATCH',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ enabled }),
+          }
+        );
+        if (!response.ok) {
+          throw new Error(await response.text());
+        }
+        list.enabled = enabled;
+      } catch (error) {
+        console.error('Failed to update blocklist:', error);
+        this.error = `Could not update ${list.name}`;
+      } finally {
+        list.saving = false;
+      }
+    },
+  };
+}
@@ -48,6 +48,14 @@ function dashboard() {
       blocks: [],
     },
     clientStats: [],
+    dhcp: {
+      enabled: false,
+      leases: [],
+    },
+    pause: {
+      paused: false,
+      until: null,
+    },
     currentPage: 'dashboard',
     currentTheme: savedTheme,
     uptimeTick: 0, // Property for Alpine to track
@@ -133,6 +141,62 @@ function dashboard() {
       );
     },
 
+    formatPauseRemaining() {
+      this.uptimeTick; // Re-evaluate every second for the countdown
+      if (!this.pause.until) {
+        return '';
+      }
+
+      const diff = Math.max(0, new Date(this.pause.until) - new Date());
+      const minutes = Math.floor(diff / 60000);
+      const seconds = Math.floor((diff % 60000) / 1000);
+      return `${minutes.toString().padStart(2, '0')}:${seconds
+        .toString()
+        .padStart(2, '0')}`;
+    },
+
+    async fetchPauseStatus() {
+      const response = await fetch('/api/v1/blocking/status');
+      if (!response.ok) {
+        throw new Error('Blocking status fetch failed');
+      }
+      const data = await response.json();
+      this.pause = {
+        paused: data.paused,
+        until: data.until || null,
+      };
+    },
+
+    async pauseBlocking(duration) {
+      try {
+        const response = await fetch('/api/v1/blocking/pause', {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ duration }),
+        });
+        if (!response.ok) {
+          throw new Error(await response.text());
+        }
+        await this.fetchPauseStatus();
+      } catch (error) {
+        console.error('Failed to pause blocking:', error);
+      }
+    },
+
+    async resumeBlocking() {
+      try {
+        const response = await fetch('/api/v1/blocking/resume', {
+          method: 'POST',
+        });
+        if (!response.ok) {
+          throw new Error(await response.text());
+        }
+        await this.fetchPauseStatus();
+      } catch (error) {
+        console.error('Failed to resume blocking:', error);
+      }
+    },
+
     getUptimePercentage() {
       const now = new Date();
       const diff = now - startTime; // Use the constant from closure
@@ -443,6 +507,9 @@ function dashboard() {
         const statusData = await statusResponse.json();
         this.status = statusData.status;
 
+        // Update blocking pause state
+        await this.fetchPauseStatus();
+
         // Fetch hourly stats
         const statsResponse = await fetch('/api/v1/stats/hourly');
         if (!statsResponse.ok) {
@@ -461,6 +528,19 @@ function dashboard() {
           lastSeen: new Date(client.lastSeen).toLocaleString(),
         }));
 
+        // Fetch DHCP leases; the panel stays hidden when DHCP is off
+        const dhcpResponse = await fetch('/api/v1/dhcp');
+        if (dhcpResponse.ok) {
+          const dhcpData = await dhcpResponse.json();
+          this.dhcp = {
+            enabled: dhcpData.enabled,
+            leases: (dhcpData.leases || []).map((lease) => ({
+              ...lease,
+              expires: new Date(lease.expires).toLocaleString(),
+            })),
+          };
+        }
+
         // Update chart
         if (chart) {
           chart.data.labels = statsData.hours;
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/vivek-pk/goadblock/internal/blocker"
+)
+
+// SubscriptionRequest is the body for creating or editing a subscription.
+// Enabled defaults to true when omitted.
+type SubscriptionRequest struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Format  string `json:"format"`
+	Refresh string `json:"refresh"`
+	Enabled *bool  `json:"enabled"`
+	Group   string `json:"group"`
+}
+
+func (req SubscriptionRequest) subscription() blocker.Subscription {
+	return blocker.Subscription{
+		Name:    req.Name,
+		URL:     req.URL,
+		Format:  req.Format,
+		Refresh: req.Refresh,
+		Enabled: req.Enabled == nil || *req.Enabled,
+		Group:   req.Group,
+	}
+}
+
+// writeSubscriptionError maps manager errors onto HTTP status codes
+func writeSubscriptionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, blocker.ErrSubscriptionNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, blocker.ErrSubscriptionExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// writeSubscription responds with a subscription as the manager stored it,
+// defaults filled in
+func (s *APIServer) writeSubscription(w http.ResponseWriter, name string, status int) {
+	sub, ok := s.subscriptions.Get(name)
+	if !ok {
+		writeSubscriptionError(w, blocker.ErrSubscriptionNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(sub)
+}
+
+// HandleGetSubscriptions returns all blocklist subscriptions
+func (s *APIServer) handleGetSubscriptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.subscriptions.List())
+}
+
+// HandleAddSubscription creates a subscription and starts loading it
+func (s *APIServer) handleAddSubscription(w http.ResponseWriter, r *http.Request) {
+	var req SubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.subscriptions.Add(req.subscription()); err != nil {
+		writeSubscriptionError(w, err)
+		return
+	}
+
+	s.writeSubscription(w, req.Name, http.StatusCreated)
+}
+
+// HandleUpdateSubscription replaces an existing subscription
+func (s *APIServer) handleUpdateSubscription(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req SubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name != "" && req.Name != name {
+		http.Error(w, "Subscriptions cannot be renamed", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.subscriptions.Update(name, req.subscription()); err != nil {
+		writeSubscriptionError(w, err)
+		return
+	}
+
+	s.writeSubscription(w, name, http.StatusOK)
+}
+
+// HandleDeleteSubscription removes a subscription and unloads its list
+func (s *APIServer) handleDeleteSubscription(w http.ResponseWriter, r *http.Request) {
+	if err := s.subscriptions.Remove(mux.Vars(r)["name"]); err != nil {
+		writeSubscriptionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleEnableSubscription switches a subscription on
+func (s *APIServer) handleEnableSubscription(w http.ResponseWriter, r *http.Request) {
+	if err := s.subscriptions.SetEnabled(mux.Vars(r)["name"], true); err != nil {
+		writeSubscriptionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleDisableSubscription switches a subscription off
+func (s *APIServer) handleDisableSubscription(w http.ResponseWriter, r *http.Request) {
+	if err := s.subscriptions.SetEnabled(mux.Vars(r)["name"], false); err != nil {
+		writeSubscriptionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,37 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.json")
+
+	for _, content := range []string{"first", "second"} {
+		if err := Write(path, []byte(content)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("Expected %q, got %q", content, data)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected no temporary files to be left behind, got %v", entries)
+	}
+
+	if err := Write(filepath.Join(dir, "missing", "data.json"), []byte("x")); err == nil {
+		t.Error("Expected writing into a missing directory to fail")
+	}
+}
@@ -0,0 +1,325 @@
+package blocker
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Allowlist entry kinds
+const (
+	AllowExact    = "exact"    // example.com
+	AllowSubtree  = "subtree"  // ||example.com^ matches the domain and every subdomain
+	AllowWildcard = "wildcard" // *.example.com matches subdomains but not the domain itself
+	AllowRegex    = "regex"    // /^ads?\.example\.com$/
+)
+
+// AllowRule is a parsed allowlist entry
+type AllowRule struct {
+	Kind  string
+	Value string // Domain, or pattern for regex rules
+}
+
+// ParseAllowRule parses an allowlist entry in one of the forms
+// "example.com", "||example.com^", "*.example.com" or "/pattern/"
+func ParseAllowRule(entry string) (AllowRule, error) {
+	entry = strings.TrimSpace(entry)
+
+	switch {
+	case len(entry) >= 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/"):
+		pattern := entry[1 : len(entry)-1]
+		if _, err := regexp.Compile(pattern); err != nil {
+			return AllowRule{}, err
+		}
+		return AllowRule{Kind: AllowRegex, Value: pattern}, nil
+	case strings.HasPrefix(entry, "||") && strings.HasSuffix(entry, "^"):
+		return allowDomainRule(AllowSubtree, entry[2:len(entry)-1])
+	case strings.HasPrefix(entry, "*."):
+		return allowDomainRule(AllowWildcard, entry[2:])
+	default:
+		return allowDomainRule(AllowExact, entry)
+	}
+}
+
+func allowDomainRule(kind, domain string) (AllowRule, error) {
+	domain = normalizeDomain(domain)
+	if domain == "" || strings.ContainsAny(domain, "*/^| ") {
+		return AllowRule{}, errors.New("invalid allowlist domain")
+	}
+	return AllowRule{Kind: kind, Value: domain}, nil
+}
+
+// String formats the rule back into its entry syntax
+func (r AllowRule) String() string {
+	switch r.Kind {
+	case AllowSubtree:
+		return "||" + r.Value + "^"
+	case AllowWildcard:
+		return "*." + r.Value
+	case AllowRegex:
+		return "/" + r.Value + "/"
+	default:
+		return r.Value
+	}
+}
+
+// allowSet holds parsed allowlist entries by kind
+type allowSet struct {
+	exact     map[string]struct{} // Exact allowlist entries
+	subtrees  map[string]struct{} // ||domain^ entries: the domain and all subdomains
+	wildcards map[string]struct{} // *.domain entries: subdomains only
+	regexes   []*regexp.Regexp
+}
+
+func newAllowSet() *allowSet {
+	return &allowSet{
+		exact:     make(map[string]struct{}),
+		subtrees:  make(map[string]struct{}),
+		wildcards: make(map[string]struct{}),
+	}
+}
+
+func (a *allowSet) add(rule AllowRule) {
+	switch rule.Kind {
+	case AllowSubtree:
+		a.subtrees[rule.Value] = struct{}{}
+	case AllowWildcard:
+		a.wildcards[rule.Value] = struct{}{}
+	case AllowRegex:
+		for _, regex := range a.regexes {
+			if regex.String() == rule.Value {
+				return
+			}
+		}
+		a.regexes = append(a.regexes, regexp.MustCompile(rule.Value))
+	default:
+		a.exact[rule.Value] = struct{}{}
+	}
+}
+
+func (a *allowSet) has(rule AllowRule) bool {
+	var set map[string]struct{}
+	switch rule.Kind {
+	case AllowSubtree:
+		set = a.subtrees
+	case AllowWildcard:
+		set = a.wildcards
+	case AllowRegex:
+		for _, regex := range a.regexes {
+			if regex.String() == rule.Value {
+				return true
+			}
+		}
+		return false
+	default:
+		set = a.exact
+	}
+
+	_, ok := set[rule.Value]
+	return ok
+}
+
+func (a *allowSet) remove(rule AllowRule) bool {
+	var set map[string]struct{}
+	switch rule.Kind {
+	case AllowSubtree:
+		set = a.subtrees
+	case AllowWildcard:
+		set = a.wildcards
+	case AllowRegex:
+		for i, regex := range a.regexes {
+			if regex.String() == rule.Value {
+				a.regexes = append(a.regexes[:i], a.regexes[i+1:]...)
+				return true
+			}
+		}
+		return false
+	default:
+		set = a.exact
+	}
+
+	if _, ok := set[rule.Value]; !ok {
+		return false
+	}
+	delete(set, rule.Value)
+	return true
+}
+
+// entries returns every entry in its string form, sorted
+func (a *allowSet) entries() []string {
+	entries := make([]string, 0, len(a.exact)+len(a.subtrees)+len(a.wildcards)+len(a.regexes))
+	for domain := range a.exact {
+		entries = append(entries, domain)
+	}
+	for domain := range a.subtrees {
+		entries = append(entries, AllowRule{Kind: AllowSubtree, Value: domain}.String())
+	}
+	for domain := range a.wildcards {
+		entries = append(entries, AllowRule{Kind: AllowWildcard, Value: domain}.String())
+	}
+	for _, regex := range a.regexes {
+		entries = append(entries, AllowRule{Kind: AllowRegex, Value: regex.String()}.String())
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// match returns the entries covering domain, most specific first: exact
+// entries, then subtree and wildcard entries from the closest label up, then
+// regexes. Unless all is set it stops at the first.
+func (a *allowSet) match(domain string, all bool) []RuleMatch {
+	var matches []RuleMatch
+	add := func(kind, value, match string) bool {
+		matches = append(matches, RuleMatch{
+			Type:   RuleAllowlist,
+			Rule:   AllowRule{Kind: kind, Value: value}.String(),
+			Match:  match,
+			Active: true,
+		})
+		return !all
+	}
+
+	if _, ok := a.exact[domain]; ok {
+		if add(AllowExact, domain, MatchExact) {
+			return matches
+		}
+	}
+
+	labels := strings.Split(domain, ".")
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		if i == 0 {
+			if _, ok := a.subtrees[candidate]; ok {
+				if add(AllowSubtree, candidate, MatchExact) {
+					return matches
+				}
+			}
+			continue
+		}
+
+		if _, ok := a.subtrees[candidate]; ok {
+			if add(AllowSubtree, candidate, MatchParent) {
+				return matches
+			}
+		}
+		if _, ok := a.wildcards[candidate]; ok {
+			if add(AllowWildcard, candidate, MatchParent) {
+				return matches
+			}
+		}
+	}
+
+	for _, regex := range a.regexes {
+		if regex.MatchString(domain) {
+			if add(AllowRegex, regex.String(), "") {
+				return matches
+			}
+		}
+	}
+
+	return matches
+}
+
+// AddAllowRule parses and adds an allowlist entry, see ParseAllowRule
+func (b *Blocker) AddAllowRule(entry string) error {
+	return b.AddAllowRuleUntil(entry, time.Time{})
+}
+
+// AddAllowRuleUntil adds an allowlist entry that is removed automatically at
+// expiresAt. A zero time makes the entry permanent, including when it
+// replaces an existing temporary entry. The expiry is ignored for entries
+// that are already permanent.
+func (b *Blocker) AddAllowRuleUntil(entry string, expiresAt time.Time) error {
+	rule, err := ParseAllowRule(entry)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := allowKey(rule)
+	if _, temporary := b.expiries[key]; !expiresAt.IsZero() && !temporary && b.allow.has(rule) {
+		return nil
+	}
+	b.setExpiryLocked(key, expiresAt)
+	b.allow.add(rule)
+	return nil
+}
+
+// RemoveAllowRule removes an allowlist entry given in the same syntax it was
+// added with. It reports whether anything was removed.
+func (b *Blocker) RemoveAllowRule(entry string) bool {
+	rule, err := ParseAllowRule(entry)
+	if err != nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.removeAllowRuleLocked(rule)
+}
+
+func (b *Blocker) removeAllowRuleLocked(rule AllowRule) bool {
+	delete(b.expiries, allowKey(rule))
+	return b.allow.remove(rule)
+}
+
+// AddToWhitelist adds an entry to the allowlist. Invalid entries are
+// ignored; use AddAllowRule to see the error.
+func (b *Blocker) AddToWhitelist(domain string) {
+	_ = b.AddAllowRule(domain)
+}
+
+// RemoveFromWhitelist removes an entry from the allowlist
+func (b *Blocker) RemoveFromWhitelist(domain string) {
+	b.RemoveAllowRule(domain)
+}
+
+// IsWhitelisted checks if any allowlist entry covers a domain
+func (b *Blocker) IsWhitelisted(domain string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return len(b.allow.match(normalizeDomain(domain), false)) > 0
+}
+
+// AllowEntry is an allowlist entry as reported by the API
+type AllowEntry struct {
+	Entry     string     `json:"entry"`
+	Kind      string     `json:"kind"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	ExpiresIn int64      `json:"expiresIn,omitempty"` // Seconds until removal
+}
+
+// GetAllowRules returns the allowlist entries with their expiry, sorted by
+// entry
+func (b *Blocker) GetAllowRules() []AllowEntry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := time.Now()
+	entries := b.allow.entries()
+	rules := make([]AllowEntry, 0, len(entries))
+	for _, entry := range entries {
+		rule, err := ParseAllowRule(entry)
+		if err != nil {
+			continue
+		}
+		e := AllowEntry{Entry: entry, Kind: rule.Kind}
+		e.ExpiresAt, e.ExpiresIn = b.expiryLocked(allowKey(rule), now)
+		rules = append(rules, e)
+	}
+	return rules
+}
+
+// GetWhitelist returns the current allowlist entries, sorted
+func (b *Blocker) GetWhitelist() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.allow.entries()
+}
@@ -1,292 +1,253 @@
 package blocker
 
 import (
-	"bufio"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 )
 
 // BlockList represents a named collection of blocked domains
 type BlockList struct {
 	Name    string
+	Source  string
+	Format  string
 	Domains map[string]struct{}
 	Count   int
+
+	// Manual holds the domains added through the API rather than downloaded.
+	// Refreshes replace Domains but merge these back in.
+	Manual map[string]struct{}
+
+	// Temporary holds domains blocked until their expiry. They are kept
+	// apart from Domains so that expiring never removes a listed domain.
+	Temporary map[string]struct{}
+
+	// Enabled lists take part in blocking decisions. A disabled list keeps
+	// its domains so it can be switched back on without re-downloading.
+	Enabled bool
+
+	// Degraded is set when the most recent load attempt failed. The list
+	// keeps serving whatever domains it had before the failure.
+	Degraded    bool
+	LastError   string
+	Failures    int
+	LastUpdated time.Time
+	ETag        string
 }
 
 // Blocker holds domain blocking information
 type Blocker struct {
 	blocklists     map[string]*BlockList
-	whitelist      map[string]struct{}
-	blockRegexes   []*regexp.Regexp
+	listOrder      []string // Blocklist names, sorted, for deterministic matching
+	allow          *allowSet
+	regexRules     []*RegexRule
+	regexCombined  *regexp.Regexp       // Alternation of all regexRules, nil when empty or too large
+	expiries       map[string]time.Time // Temporary rules by rule key, see expiry.go
 	mu             sync.RWMutex
 	blocklistStats map[string]int // Track blocks per blocklist
+	cacheDir       string         // Where downloaded lists are persisted, empty to disable
+	watcher        *localWatcher  // Reloads file:// lists on change, nil until started
+	schedules      []*compiledSchedule
+	services       *services        // Service catalogue, see services.go
+	servicesFile   string           // Catalogue override, empty for the built-in one
+	clock          func() time.Time // Time source for schedules
 }
 
 // New creates a new Blocker
 func New() *Blocker {
+	catalogue, err := parseServices(builtinServices)
+	if err != nil {
+		panic("blocker: invalid built-in service catalogue: " + err.Error())
+	}
+
 	return &Blocker{
 		blocklists:     make(map[string]*BlockList),
-		whitelist:      make(map[string]struct{}),
-		blockRegexes:   make([]*regexp.Regexp, 0),
+		allow:          newAllowSet(),
+		regexRules:     make([]*RegexRule, 0),
+		expiries:       make(map[string]time.Time),
 		blocklistStats: make(map[string]int),
+		clock:          time.Now,
+		services:       catalogue,
 	}
 }
 
-// Update the IsBlocked method to return both a boolean and a reason string
+// IsBlocked reports whether a domain should be blocked and, if so, the list
+// or regex responsible. Rules are evaluated in a fixed precedence order, see
+// Explain.
 func (b *Blocker) IsBlocked(domain string) (bool, string) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-
-	domain = strings.ToLower(domain)
-	domain = strings.TrimSuffix(domain, ".") // Remove trailing dot which DNS queries often have
-
-	// Check whitelist first
-	if _, ok := b.whitelist[domain]; ok {
-		log.Printf("Domain %s is whitelisted, allowing", domain)
-		return false, ""
-	}
-
-	// Check exact domain match in blocklists
-	for listName, list := range b.blocklists {
-		if _, ok := list.Domains[domain]; ok {
-			log.Printf("Domain %s found in blocklist %s", domain, listName)
-			b.blocklistStats[listName]++
-			return true, listName
-		}
-
-		// Check parent domains (subdomains)
-		parts := strings.Split(domain, ".")
-		for i := 1; i < len(parts); i++ {
-			parentDomain := strings.Join(parts[i:], ".")
-			if _, ok := list.Domains[parentDomain]; ok {
-				log.Printf("Domain %s matched parent domain %s in blocklist %s",
-					domain, parentDomain, listName)
-				b.blocklistStats[listName]++
-				return true, listName
-			}
-		}
-	}
-
-	// Check regex patterns
-	for _, regex := range b.blockRegexes {
-		if regex.MatchString(domain) {
-			log.Printf("Domain %s matched regex pattern: %s", domain, regex.String())
-			return true, "regex:" + regex.String()
-		}
-	}
-
-	log.Printf("Domain %s not found in any blocklist, allowing", domain)
-	return false, ""
+	return b.IsBlockedFor(domain, nil)
 }
 
-// LoadFromURL loads blocked domains from a URL
-func (b *Blocker) LoadFromURL(url string, name string) error {
-	if name == "" {
-		name = url // Use URL as name if not provided
-	}
-
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	return b.loadFromReader(resp.Body, name)
+// normalizeDomain lowercases a name and removes the trailing dot which DNS
+// queries often have
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
 }
 
-func (b *Blocker) loadFromReader(reader io.Reader, listName string) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-
-	// Create new blocklist or get existing one
-	list, exists := b.blocklists[listName]
-	if !exists {
-		list = &BlockList{
-			Name:    listName,
-			Domains: make(map[string]struct{}),
-		}
-		b.blocklists[listName] = list
-		b.blocklistStats[listName] = 0
-	}
-
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+// GetBlocklistStats returns statistics about blocklists
+func (b *Blocker) GetBlocklistStats() map[string]map[string]int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-		// Skip empty lines and comments
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
+	stats := make(map[string]map[string]int)
 
-		// Parse hosts file format (0.0.0.0 example.com or 127.0.0.1 example.com)
-		fields := strings.Fields(line)
-		if len(fields) >= 2 {
-			domain := strings.ToLower(fields[1])
-			list.Domains[domain] = struct{}{}
+	for name, list := range b.blocklists {
+		stats[name] = map[string]int{
+			"domains":  list.Count,
+			"blocks":   b.blocklistStats[name],
+			"enabled":  boolToInt(list.Enabled),
+			"degraded": boolToInt(list.Degraded),
+			"failures": list.Failures,
 		}
 	}
 
-	// Update count
-	list.Count = len(list.Domains)
-
-	return scanner.Err()
+	return stats
 }
 
-// LoadMultipleLists loads multiple blocklists
-func (b *Blocker) LoadMultipleLists(sources map[string]string) error {
-	for name, url := range sources {
-		if err := b.LoadFromURL(url, name); err != nil {
-			return fmt.Errorf("failed to load blocklist %s: %w", name, err)
-		}
+func boolToInt(v bool) int {
+	if v {
+		return 1
 	}
-	return nil
+	return 0
 }
 
-// AddToWhitelist adds a domain to the whitelist
-func (b *Blocker) AddToWhitelist(domain string) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-
-	domain = strings.ToLower(domain)
-	b.whitelist[domain] = struct{}{}
+// AddDomainToBlocklist adds a domain to a specific blocklist
+func (b *Blocker) AddDomainToBlocklist(domain, listName string) {
+	b.AddDomainToBlocklistUntil(domain, listName, time.Time{})
 }
 
-// RemoveFromWhitelist removes a domain from the whitelist
-func (b *Blocker) RemoveFromWhitelist(domain string) {
+// AddDomainToBlocklistUntil adds a domain to a blocklist and removes it again
+// at expiresAt. A zero time makes the entry permanent. The expiry is ignored
+// for domains already added permanently, and expiring never removes a domain
+// the downloaded list has.
+func (b *Blocker) AddDomainToBlocklistUntil(domain, listName string, expiresAt time.Time) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
 	domain = strings.ToLower(domain)
-	delete(b.whitelist, domain)
+	key := blockKey(listName, domain)
+
+	// Create blocklist if it doesn't exist
+	list := b.getOrCreateList(listName)
+	if expiresAt.IsZero() {
+		b.setExpiryLocked(key, expiresAt)
+		delete(list.Temporary, domain)
+		list.Manual[domain] = struct{}{}
+		list.Domains[domain] = struct{}{}
+	} else if _, permanent := list.Manual[domain]; !permanent {
+		b.setExpiryLocked(key, expiresAt)
+		list.Temporary[domain] = struct{}{}
+	}
+	list.recount()
 }
 
-// IsWhitelisted checks if a domain is whitelisted
-func (b *Blocker) IsWhitelisted(domain string) bool {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+// setDomains replaces the downloaded domains of a list, keeping the ones
+// added through the API. Must be called with b.mu held for writing.
+func (l *BlockList) setDomains(domains map[string]struct{}) {
+	for domain := range l.Manual {
+		domains[domain] = struct{}{}
+	}
+	l.Domains = domains
+	l.recount()
+}
 
-	domain = strings.ToLower(domain)
-	_, ok := b.whitelist[domain]
+// has reports whether the list blocks domain, permanently or temporarily
+func (l *BlockList) has(domain string) bool {
+	if _, ok := l.Domains[domain]; ok {
+		return true
+	}
+	_, ok := l.Temporary[domain]
 	return ok
 }
 
-// AddBlockRegex adds a regex pattern for blocking
-func (b *Blocker) AddBlockRegex(pattern string) error {
-	regex, err := regexp.Compile(pattern)
-	if err != nil {
-		return err
+// recount updates Count, which includes temporary domains not also listed
+func (l *BlockList) recount() {
+	l.Count = len(l.Domains)
+	for domain := range l.Temporary {
+		if _, ok := l.Domains[domain]; !ok {
+			l.Count++
+		}
 	}
-
-	b.mu.Lock()
-	defer b.mu.Unlock()
-
-	b.blockRegexes = append(b.blockRegexes, regex)
-	return nil
 }
 
-// RemoveBlockRegex removes a regex pattern by its string representation
-func (b *Blocker) RemoveBlockRegex(pattern string) {
+// RemoveDomainFromBlocklist removes a domain from a specific blocklist
+func (b *Blocker) RemoveDomainFromBlocklist(domain, listName string) bool {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	// Find and remove the regex pattern
-	for i, regex := range b.blockRegexes {
-		if regex.String() == pattern {
-			b.blockRegexes = append(b.blockRegexes[:i], b.blockRegexes[i+1:]...)
-			break
-		}
-	}
+	return b.removeDomainLocked(strings.ToLower(domain), listName)
 }
 
-// GetBlocklistStats returns statistics about blocklists
-func (b *Blocker) GetBlocklistStats() map[string]map[string]int {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+func (b *Blocker) removeDomainLocked(domain, listName string) bool {
+	delete(b.expiries, blockKey(listName, domain))
 
-	stats := make(map[string]map[string]int)
-
-	for name, list := range b.blocklists {
-		stats[name] = map[string]int{
-			"domains": list.Count,
-			"blocks":  b.blocklistStats[name],
-		}
+	// Check if blocklist exists
+	list, exists := b.blocklists[listName]
+	if !exists {
+		return false
 	}
 
-	return stats
-}
-
-// GetWhitelist returns the current whitelist
-func (b *Blocker) GetWhitelist() []string {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-
-	whitelist := make([]string, 0, len(b.whitelist))
-	for domain := range b.whitelist {
-		whitelist = append(whitelist, domain)
+	// Check if domain exists in blocklist
+	if !list.has(domain) {
+		return false
 	}
 
-	return whitelist
-}
+	// Remove domain
+	delete(list.Manual, domain)
+	delete(list.Temporary, domain)
+	delete(list.Domains, domain)
+	list.recount()
 
-// GetRegexPatterns returns the current regex patterns
-func (b *Blocker) GetRegexPatterns() []string {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+	return true
+}
 
-	patterns := make([]string, len(b.blockRegexes))
-	for i, regex := range b.blockRegexes {
-		patterns[i] = regex.String()
+// expireDomainLocked ends a temporary block, leaving any permanent entry for
+// the same domain in place
+func (b *Blocker) expireDomainLocked(domain, listName string) {
+	if list, exists := b.blocklists[listName]; exists {
+		delete(list.Temporary, domain)
+		list.recount()
 	}
-
-	return patterns
 }
 
-// AddDomainToBlocklist adds a domain to a specific blocklist
-func (b *Blocker) AddDomainToBlocklist(domain, listName string) {
+// RemoveList drops a whole blocklist and its statistics
+func (b *Blocker) RemoveList(listName string) bool {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	domain = strings.ToLower(domain)
-
-	// Create blocklist if it doesn't exist
 	if _, exists := b.blocklists[listName]; !exists {
-		b.blocklists[listName] = &BlockList{
-			Name:    listName,
-			Domains: make(map[string]struct{}),
+		return false
+	}
+	delete(b.blocklists, listName)
+	delete(b.blocklistStats, listName)
+	for i, name := range b.listOrder {
+		if name == listName {
+			b.listOrder = append(b.listOrder[:i], b.listOrder[i+1:]...)
+			break
 		}
-		b.blocklistStats[listName] = 0
 	}
-
-	b.blocklists[listName].Domains[domain] = struct{}{}
-	b.blocklists[listName].Count = len(b.blocklists[listName].Domains)
+	return true
 }
 
-// RemoveDomainFromBlocklist removes a domain from a specific blocklist
-func (b *Blocker) RemoveDomainFromBlocklist(domain, listName string) bool {
+// SetListEnabled switches a blocklist on or off without touching its domains
+func (b *Blocker) SetListEnabled(listName string, enabled bool) bool {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	domain = strings.ToLower(domain)
-
-	// Check if blocklist exists
 	list, exists := b.blocklists[listName]
 	if !exists {
 		return false
 	}
+	list.Enabled = enabled
+	return true
+}
 
-	// Check if domain exists in blocklist
-	if _, ok := list.Domains[domain]; !ok {
-		return false
-	}
-
-	// Remove domain
-	delete(list.Domains, domain)
-	list.Count = len(list.Domains)
+// HasList reports whether a blocklist is registered, enabled or not
+func (b *Blocker) HasList(listName string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-	return true
+	_, exists := b.blocklists[listName]
+	return exists
 }
@@ -0,0 +1,618 @@
+package blocker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	fetchRetryBackoff = time.Millisecond
+}
+
+func TestLoadMultipleListsToleratesFailures(t *testing.T) {
+	failing := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/good":
+			fmt.Fprintln(w, "# comment")
+			fmt.Fprintln(w, "0.0.0.0 ads.example.com")
+		case "/flaky":
+			if failing {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "0.0.0.0 tracker.example.net")
+		}
+	}))
+	defer srv.Close()
+
+	b := New()
+	err := b.LoadMultipleLists(map[string]string{
+		"good":  srv.URL + "/good",
+		"flaky": srv.URL + "/flaky",
+	})
+	assert.Error(t, err)
+
+	blocked, _ := b.IsBlocked("ads.example.com.")
+	assert.True(t, blocked, "lists that loaded should still be served")
+
+	stats := b.GetBlocklistStats()
+	assert.Equal(t, 0, stats["good"]["degraded"])
+	assert.Equal(t, 1, stats["flaky"]["degraded"])
+	assert.Equal(t, 1, stats["flaky"]["failures"])
+
+	failing = false
+	assert.NoError(t, b.loadConcurrently(b.degradedLists()))
+
+	stats = b.GetBlocklistStats()
+	assert.Equal(t, 0, stats["flaky"]["degraded"])
+	blocked, reason := b.IsBlocked("tracker.example.net")
+	assert.True(t, blocked)
+	assert.Equal(t, "flaky", reason)
+}
+
+func TestCachedListsSurviveRestart(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprintln(w, "0.0.0.0 ads.example.com")
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	sources := map[string]string{"ads": srv.URL}
+
+	b := New()
+	assert.NoError(t, b.SetCacheDir(dir))
+	assert.NoError(t, b.LoadMultipleLists(sources))
+
+	// A fresh blocker is populated from disk before any network access
+	restarted := New()
+	assert.NoError(t, restarted.SetCacheDir(dir))
+	assert.Equal(t, 1, restarted.LoadCachedLists(sources))
+	assert.Equal(t, 1, requests)
+
+	blocked, _ := restarted.IsBlocked("ads.example.com")
+	assert.True(t, blocked)
+
+	// Refreshing sends the cached ETag and keeps the list on 304
+	assert.NoError(t, restarted.LoadMultipleLists(sources))
+	assert.Equal(t, 2, requests)
+	blocked, _ = restarted.IsBlocked("ads.example.com")
+	assert.True(t, blocked)
+
+	// A list whose source changed is not served from the old source's copy
+	moved := New()
+	assert.NoError(t, moved.SetCacheDir(dir))
+	assert.Equal(t, 0, moved.LoadCachedLists(map[string]string{"ads": srv.URL + "/other"}))
+
+	// Names differing only in characters unsafe for files are kept apart
+	slash, _ := cachePaths(dir, "a/b")
+	colon, _ := cachePaths(dir, "a:b")
+	assert.NotEqual(t, slash, colon)
+}
+
+func TestManualDomainsSurviveRefresh(t *testing.T) {
+	listed := "ads.example.com"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "0.0.0.0 "+listed)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	sources := map[string]string{"ads": srv.URL}
+
+	b := New()
+	assert.NoError(t, b.SetCacheDir(dir))
+	assert.NoError(t, b.LoadMultipleLists(sources))
+	b.AddDomainToBlocklist("manual.example.com", "ads")
+
+	listed = "tracker.example.net"
+	assert.NoError(t, b.LoadMultipleLists(sources))
+
+	blocked, reason := b.IsBlocked("manual.example.com")
+	assert.True(t, blocked, "domains added by hand should survive a refresh")
+	assert.Equal(t, "ads", reason)
+	blocked, _ = b.IsBlocked("ads.example.com")
+	assert.False(t, blocked, "domains dropped upstream should go")
+	assert.Equal(t, 2, b.GetBlocklistStats()["ads"]["domains"])
+
+	// Loading from the cache keeps them too
+	assert.Equal(t, 1, b.LoadCachedLists(sources))
+	blocked, _ = b.IsBlocked("manual.example.com")
+	assert.True(t, blocked)
+
+	assert.True(t, b.RemoveDomainFromBlocklist("manual.example.com", "ads"))
+	assert.NoError(t, b.LoadMultipleLists(sources))
+	blocked, _ = b.IsBlocked("manual.example.com")
+	assert.False(t, blocked, "removed domains should not come back")
+}
+
+func TestLocalDirectoryListReloadsOnChange(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.hosts"), []byte("0.0.0.0 one.example\n"), 0o644))
+
+	b := New()
+	assert.NoError(t, b.LoadFromURL("file://"+dir, "local"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, b.WatchLocalLists(ctx))
+
+	blocked, _ := b.IsBlocked("one.example")
+	assert.True(t, blocked)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "b.hosts"), []byte("0.0.0.0 two.example\n"), 0o644))
+
+	assert.Eventually(t, func() bool {
+		blocked, _ := b.IsBlocked("two.example")
+		return blocked
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestSubscriptionsPersist(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "subscriptions.json")
+	listPath := filepath.Join(dir, "list.txt")
+	assert.NoError(t, os.WriteFile(listPath, []byte("blocked.example\n"), 0o644))
+
+	m := NewSubscriptionManager(New(), path)
+	assert.NoError(t, m.Load(nil))
+
+	sub := Subscription{Name: "custom", URL: "file://" + listPath, Format: FormatDomains, Enabled: true}
+	assert.NoError(t, m.Add(sub))
+	assert.ErrorIs(t, m.Add(sub), ErrSubscriptionExists)
+	assert.Error(t, m.Add(Subscription{Name: "bad", URL: "x", Format: "adblock"}))
+	assert.NoError(t, m.SetEnabled("custom", false))
+	assert.ErrorIs(t, m.Remove("missing"), ErrSubscriptionNotFound)
+
+	// Saved subscriptions take precedence over the defaults
+	b := New()
+	reloaded := NewSubscriptionManager(b, path)
+	assert.NoError(t, reloaded.Load([]Subscription{{Name: "default", URL: "https://example.com", Enabled: true}}))
+	subs := reloaded.List()
+	assert.Len(t, subs, 1)
+	assert.Equal(t, "custom", subs[0].Name)
+	assert.False(t, subs[0].Enabled)
+
+	assert.NoError(t, reloaded.SetEnabled("custom", true))
+	assert.NoError(t, reloaded.LoadAll())
+	blocked, reason := b.IsBlocked("blocked.example")
+	assert.True(t, blocked)
+	assert.Equal(t, "custom", reason)
+}
+
+func TestFailedSubscriptionSavesAreReverted(t *testing.T) {
+	m := NewSubscriptionManager(New(), "")
+	sub := Subscription{Name: "ads", URL: "https://example.com/ads.txt", Enabled: false}
+	assert.NoError(t, m.Load([]Subscription{sub}))
+
+	// Saves fail because the data directory is a regular file
+	notDir := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, os.WriteFile(notDir, nil, 0o644))
+	m.path = filepath.Join(notDir, "subscriptions.json")
+
+	assert.Error(t, m.Add(Subscription{Name: "new", URL: "https://example.com/new.txt"}))
+	assert.Error(t, m.Update("ads", Subscription{URL: "https://example.com/other.txt"}))
+	assert.Error(t, m.SetEnabled("ads", true))
+	assert.Error(t, m.Remove("ads"))
+
+	sub.Format = FormatHosts
+	assert.Equal(t, []Subscription{sub}, m.List())
+
+	// The next successful save must not pick up the failed changes
+	m.path = filepath.Join(t.TempDir(), "subscriptions.json")
+	assert.NoError(t, m.saveLocked())
+	reloaded := NewSubscriptionManager(New(), m.path)
+	assert.NoError(t, reloaded.Load(nil))
+	assert.Equal(t, []Subscription{sub}, reloaded.List())
+}
+
+func TestDisabledListKeepsDomains(t *testing.T) {
+	b := New()
+	b.AddDomainToBlocklist("noisy.example", "noisy")
+
+	assert.True(t, b.SetListEnabled("noisy", false))
+	blocked, _ := b.IsBlocked("noisy.example")
+	assert.False(t, blocked)
+	assert.Equal(t, 1, b.GetBlocklistStats()["noisy"]["domains"])
+
+	assert.True(t, b.SetListEnabled("noisy", true))
+	blocked, _ = b.IsBlocked("noisy.example")
+	assert.True(t, blocked)
+
+	assert.False(t, b.SetListEnabled("missing", true))
+}
+
+func TestExplainReportsAllMatchesInPrecedenceOrder(t *testing.T) {
+	b := New()
+	b.AddDomainToBlocklist("example.com", "b-list")
+	b.AddDomainToBlocklist("ads.example.com", "z-list")
+	b.AddDomainToBlocklist("ads.example.com", "a-list")
+	assert.NoError(t, b.AddBlockRegex(`^ads\.`))
+	b.SetListEnabled("a-list", false)
+
+	exp := b.Explain("ADS.example.com.")
+	assert.Equal(t, "ads.example.com", exp.Domain)
+	assert.Equal(t, []RuleMatch{
+		{Type: RuleBlocklist, Source: "a-list", Rule: "ads.example.com", Match: MatchExact, Active: false},
+		{Type: RuleBlocklist, Source: "z-list", Rule: "ads.example.com", Match: MatchExact, Active: true},
+		{Type: RuleBlocklist, Source: "b-list", Rule: "example.com", Match: MatchParent, Active: true},
+		{Type: RuleRegex, ID: b.GetRegexRules()[0].ID, Rule: `^ads\.`, Active: true},
+	}, exp.Matches)
+	assert.True(t, exp.Blocked)
+	assert.Equal(t, "z-list", exp.Winner.Source)
+
+	// IsBlocked agrees with the explanation
+	blocked, reason := b.IsBlocked("ads.example.com")
+	assert.True(t, blocked)
+	assert.Equal(t, "z-list", reason)
+
+	b.AddToWhitelist("ads.example.com")
+	exp = b.Explain("ads.example.com")
+	assert.False(t, exp.Blocked)
+	assert.Equal(t, RuleAllowlist, exp.Winner.Type)
+	assert.Len(t, exp.Matches, 5)
+}
+
+func TestAllowlistRules(t *testing.T) {
+	b := New()
+	b.AddDomainToBlocklist("example.com", "ads")
+	b.AddDomainToBlocklist("partner.net", "ads")
+	b.AddDomainToBlocklist("tracker.org", "ads")
+	assert.NoError(t, b.AddBlockRegex(`^metrics\.`))
+
+	for _, entry := range []string{
+		"exact.example.com",
+		"||partner.net^",
+		"*.cdn.example.com",
+		`/^ok[0-9]+\.tracker\.org$/`,
+	} {
+		assert.NoError(t, b.AddAllowRule(entry), entry)
+	}
+
+	tests := []struct {
+		domain  string
+		blocked bool
+		rule    string
+	}{
+		{"example.com", true, "example.com"},
+		{"exact.example.com", false, "exact.example.com"},
+		{"sub.exact.example.com", true, "example.com"},
+		{"partner.net", false, "||partner.net^"},
+		{"a.b.partner.net", false, "||partner.net^"},
+		{"cdn.example.com", true, "example.com"},
+		{"img.cdn.example.com", false, "*.cdn.example.com"},
+		{"ok1.tracker.org", false, `/^ok[0-9]+\.tracker\.org$/`},
+		{"bad.tracker.org", true, "tracker.org"},
+		{"metrics.partner.net", false, "||partner.net^"},
+		{"metrics.other.io", true, `^metrics\.`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			exp := b.Explain(tt.domain)
+			assert.Equal(t, tt.blocked, exp.Blocked)
+			if assert.NotNil(t, exp.Winner) {
+				assert.Equal(t, tt.rule, exp.Winner.Rule)
+			}
+
+			blocked, _ := b.IsBlocked(tt.domain)
+			assert.Equal(t, tt.blocked, blocked)
+			assert.Equal(t, !tt.blocked, b.IsWhitelisted(tt.domain))
+		})
+	}
+}
+
+func TestParseAllowRule(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  AllowRule
+		err   bool
+	}{
+		{"Example.COM.", AllowRule{Kind: AllowExact, Value: "example.com"}, false},
+		{"||example.com^", AllowRule{Kind: AllowSubtree, Value: "example.com"}, false},
+		{"*.example.com", AllowRule{Kind: AllowWildcard, Value: "example.com"}, false},
+		{"/^a+$/", AllowRule{Kind: AllowRegex, Value: "^a+$"}, false},
+		{"/(/", AllowRule{}, true},
+		{"||^", AllowRule{}, true},
+		{"*.*.example.com", AllowRule{}, true},
+		{"", AllowRule{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			got, err := ParseAllowRule(tt.entry)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRegexRules(t *testing.T) {
+	b := New()
+
+	for _, pattern := range []string{`.*`, `\.com$`, `^(www\.)?[a-z]+\.(com|org)$`} {
+		_, err := b.AddRegexRule(pattern, "")
+		assert.ErrorIs(t, err, ErrRegexTooBroad, pattern)
+	}
+	_, err := b.AddRegexRule(`(`, "")
+	assert.Error(t, err)
+
+	// Narrow rules aimed at one big service are still allowed
+	_, err = b.AddRegexRule(`^(.+\.)?tiktok\.com$`, "video app")
+	assert.NoError(t, err)
+
+	rule, err := b.AddRegexRule(`^ad[0-9]+\.`, "numbered ad hosts")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, rule.ID)
+	assert.Equal(t, "numbered ad hosts", rule.Comment)
+
+	for _, domain := range []string{"ad1.example.com", "ad22.example.net", "adx.example.com"} {
+		b.IsBlocked(domain)
+	}
+	rules := b.GetRegexRules()
+	assert.Len(t, rules, 2)
+	assert.Equal(t, int64(2), rules[1].Hits)
+
+	assert.NoError(t, b.RemoveRegexRule(rule.ID))
+	assert.ErrorIs(t, b.RemoveRegexRule(rule.ID), ErrRegexNotFound)
+	blocked, _ := b.IsBlocked("ad1.example.com")
+	assert.False(t, blocked)
+	blocked, _ = b.IsBlocked("www.tiktok.com")
+	assert.True(t, blocked)
+}
+
+func TestRegexHitsConcurrentWithListing(t *testing.T) {
+	b := New()
+	_, err := b.AddRegexRule(`^ads[0-9]+\.`, "")
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			b.IsBlocked(fmt.Sprintf("ads%d.example", i))
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		b.GetRegexRules()
+	}
+	<-done
+
+	assert.Equal(t, int64(200), b.GetRegexRules()[0].Hits)
+}
+
+func TestManyRegexRules(t *testing.T) {
+	b := New()
+
+	// Each rule compiles on its own, but together they exceed the size
+	// limit of a single regex. They are loaded at once to keep the test fast.
+	b.mu.Lock()
+	for i := 0; i < 8; i++ {
+		pattern := fmt.Sprintf(`^(?:%s%d\.){1,1000}example$`, strings.Repeat("x", 450), i)
+		regex, err := ValidateRegex(pattern)
+		assert.NoError(t, err)
+		b.regexRules = append(b.regexRules, &RegexRule{ID: fmt.Sprint(i), Pattern: pattern, regex: regex})
+	}
+	b.rebuildRegexLocked()
+	b.mu.Unlock()
+
+	rule, err := b.AddRegexRule(`^ads[0-9]+\.`, "")
+	assert.NoError(t, err)
+
+	blocked, _ := b.IsBlocked(strings.Repeat("x", 450) + "7.example")
+	assert.True(t, blocked)
+	blocked, _ = b.IsBlocked("ads1.example.com")
+	assert.True(t, blocked)
+	blocked, _ = b.IsBlocked("example.com")
+	assert.False(t, blocked)
+
+	assert.NoError(t, b.RemoveRegexRule(rule.ID))
+	blocked, _ = b.IsBlocked("ads1.example.com")
+	assert.False(t, blocked)
+}
+
+func TestTemporaryRulesExpire(t *testing.T) {
+	b := New()
+	now := time.Now()
+	soon := now.Add(time.Hour)
+
+	b.AddDomainToBlocklist("games.example", "custom")
+	assert.NoError(t, b.AddAllowRuleUntil("games.example", soon))
+	b.AddDomainToBlocklistUntil("chat.example", "custom", soon)
+	rule, err := b.AddRegexRuleUntil(`^ads[0-9]+\.`, "", soon)
+	assert.NoError(t, err)
+	assert.NotNil(t, rule.ExpiresAt)
+	assert.InDelta(t, 3600, rule.ExpiresIn, 2)
+
+	allow := b.GetAllowRules()
+	assert.Len(t, allow, 1)
+	assert.Equal(t, soon, *allow[0].ExpiresAt)
+
+	blocked, _ := b.IsBlocked("games.example")
+	assert.False(t, blocked)
+
+	assert.Equal(t, 0, b.PruneExpired(now))
+	assert.Equal(t, 3, b.PruneExpired(soon))
+
+	blocked, _ = b.IsBlocked("games.example")
+	assert.True(t, blocked, "allowlist entry should have expired")
+	blocked, _ = b.IsBlocked("chat.example")
+	assert.False(t, blocked, "temporary block should have expired")
+	assert.Empty(t, b.GetRegexRules())
+
+	// Re-adding without an expiry makes a rule permanent
+	b.AddDomainToBlocklistUntil("chat.example", "custom", soon)
+	b.AddDomainToBlocklist("chat.example", "custom")
+	assert.Equal(t, 0, b.PruneExpired(soon))
+}
+
+func TestTemporaryRulesKeepPermanentOnes(t *testing.T) {
+	b := New()
+	now := time.Now()
+	soon := now.Add(time.Hour)
+
+	// A temporary add on top of a permanent rule leaves it permanent
+	b.AddDomainToBlocklist("games.example", "custom")
+	b.AddDomainToBlocklistUntil("games.example", "custom", soon)
+	assert.NoError(t, b.AddAllowRule("news.example"))
+	assert.NoError(t, b.AddAllowRuleUntil("news.example", soon))
+	rule, err := b.AddRegexRule(`^ads[0-9]+\.`, "")
+	assert.NoError(t, err)
+	rule, err = b.AddRegexRuleUntil(`^ads[0-9]+\.`, "", soon)
+	assert.NoError(t, err)
+	assert.Nil(t, rule.ExpiresAt)
+
+	assert.Equal(t, 0, b.PruneExpired(soon))
+	blocked, _ := b.IsBlocked("games.example")
+	assert.True(t, blocked)
+	assert.Equal(t, []string{"news.example"}, b.GetWhitelist())
+	assert.Len(t, b.GetRegexRules(), 1)
+
+	// A temporary block of a domain a downloaded list has leaves the list
+	// entry when it expires
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "0.0.0.0 ads.example.com")
+	}))
+	defer srv.Close()
+	assert.NoError(t, b.LoadMultipleLists(map[string]string{"ads": srv.URL}))
+
+	b.AddDomainToBlocklistUntil("ads.example.com", "ads", soon)
+	b.AddDomainToBlocklistUntil("tracker.example.com", "ads", soon)
+	assert.Equal(t, 2, b.GetBlocklistStats()["ads"]["domains"])
+
+	assert.Equal(t, 2, b.PruneExpired(soon))
+	blocked, reason := b.IsBlocked("ads.example.com")
+	assert.True(t, blocked, "listed domain should outlive the temporary block")
+	assert.Equal(t, "ads", reason)
+	blocked, _ = b.IsBlocked("tracker.example.com")
+	assert.False(t, blocked)
+	assert.Equal(t, 1, b.GetBlocklistStats()["ads"]["domains"])
+}
+
+func TestSchedules(t *testing.T) {
+	b := New()
+	b.AddDomainToBlocklist("social.example", "social")
+	b.AddDomainToBlocklist("games.example", "gaming")
+	b.AddDomainToBlocklist("ads.example", "ads")
+
+	kids, err := NewPolicy("kids", nil, nil, nil, nil)
+	assert.NoError(t, err)
+
+	m := NewScheduleManager(b, filepath.Join(t.TempDir(), "schedules.json"))
+	nights, err := m.Add(Schedule{
+		Name:  "school nights",
+		Group: "kids",
+		Lists: []string{"social", "gaming"},
+		Days:  []string{"Sunday", "mon", "tue", "wed", "thu"},
+		Start: "21:00",
+		End:   "07:00",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sun", "mon", "tue", "wed", "thu"}, nights.Days)
+
+	// 2024-01-07 is a Sunday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name    string
+		now     time.Time
+		policy  *Policy
+		domain  string
+		blocked bool
+	}{
+		{"sunday night", at(7, 22, 0), kids, "social.example", true},
+		{"past midnight", at(8, 6, 59), kids, "games.example", true},
+		{"morning", at(8, 7, 0), kids, "games.example", false},
+		{"friday night", at(12, 23, 0), kids, "social.example", false},
+		{"thursday into friday", at(12, 1, 0), kids, "social.example", true},
+		{"unscheduled list", at(12, 12, 0), kids, "ads.example", true},
+		{"other clients", at(12, 12, 0), nil, "social.example", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b.clock = func() time.Time { return tt.now }
+			blocked, _ := b.IsBlockedFor(tt.domain, tt.policy)
+			assert.Equal(t, tt.blocked, blocked)
+		})
+	}
+
+	// Overlapping and malformed schedules are rejected
+	_, err = m.Add(Schedule{Group: "kids", Lists: []string{"gaming"}, Days: []string{"mon"}, Start: "06:00", End: "08:00"})
+	assert.ErrorIs(t, err, ErrScheduleOverlap)
+	_, err = m.Add(Schedule{Lists: []string{"ads"}, Days: []string{"sun"}, Start: "00:00", End: "02:00"})
+	assert.NoError(t, err)
+	_, err = m.Add(Schedule{Lists: []string{"ads"}, Days: []string{"sat"}, Start: "23:00", End: "00:30"})
+	assert.ErrorIs(t, err, ErrScheduleOverlap, "saturday night runs into sunday morning")
+	_, err = m.Add(Schedule{Group: "kids", Lists: []string{"gaming"}, Days: []string{"fri"}, Start: "21:00", End: "23:00"})
+	assert.NoError(t, err)
+	for _, bad := range []Schedule{
+		{Lists: []string{"gaming"}, Start: "9:00", End: "10:00"},
+		{Lists: []string{"gaming"}, Start: "09:00", End: "09:00"},
+		{Lists: []string{"gaming"}, Start: "09:00", End: "25:00"},
+		{Lists: []string{"gaming"}, Days: []string{"funday"}, Start: "09:00", End: "10:00"},
+		{Start: "09:00", End: "10:00"},
+	} {
+		_, err := m.Add(bad)
+		assert.Error(t, err, "%+v", bad)
+	}
+
+	// Schedules survive a restart
+	reloaded := NewScheduleManager(New(), m.path)
+	assert.NoError(t, reloaded.Load())
+	assert.Equal(t, m.List(), reloaded.List())
+}
+
+func TestBlockedServices(t *testing.T) {
+	b := New()
+	assert.True(t, b.HasService("youtube"))
+
+	kids, err := NewPolicy("kids", nil, nil, nil, []string{"youtube", "tiktok"})
+	assert.NoError(t, err)
+
+	blocked, reason := b.IsBlockedFor("i.ytimg.com", kids)
+	assert.True(t, blocked)
+	assert.Equal(t, "service:youtube", reason)
+	blocked, _ = b.IsBlockedFor("tiktokcdn-eu.com", kids)
+	assert.True(t, blocked, "service regexes apply")
+	blocked, _ = b.IsBlockedFor("i.ytimg.com", nil)
+	assert.False(t, blocked, "services are only blocked for policies that ask for it")
+
+	exp := b.ExplainFor("www.youtube.com", kids)
+	assert.Equal(t, &RuleMatch{Type: RuleService, Source: "youtube", Rule: "youtube.com", Match: MatchParent, Active: true}, exp.Winner)
+
+	// An updated catalogue replaces the built-in one
+	path := filepath.Join(t.TempDir(), "services.json")
+	assert.NoError(t, b.SetServicesFile(path))
+	assert.NoError(t, os.WriteFile(path, []byte(`{"services": [{"id": "youtube", "name": "YouTube", "domains": ["example-video.com"]}]}`), 0o644))
+	assert.NoError(t, b.ReloadServices())
+	assert.Len(t, b.GetServices(), 1)
+	blocked, _ = b.IsBlockedFor("cdn.example-video.com", kids)
+	assert.True(t, blocked)
+	blocked, _ = b.IsBlockedFor("i.ytimg.com", kids)
+	assert.False(t, blocked)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"services": [{"id": "broken"}]}`), 0o644))
+	assert.Error(t, b.ReloadServices())
+	assert.True(t, b.HasService("youtube"), "a bad file keeps the previous catalogue")
+}
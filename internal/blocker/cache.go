@@ -0,0 +1,142 @@
+package blocker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/vivek-pk/goadblock/internal/atomicfile"
+)
+
+// CacheMeta describes a blocklist copy persisted on disk
+type CacheMeta struct {
+	Name      string    `json:"name"`
+	Source    string    `json:"source"`
+	Format    string    `json:"format,omitempty"`
+	FetchedAt time.Time `json:"fetchedAt"`
+	ETag      string    `json:"etag,omitempty"`
+	Checksum  string    `json:"checksum"`
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// SetCacheDir enables persisting downloaded blocklists under dir
+func (b *Blocker) SetCacheDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create blocklist cache dir: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cacheDir = dir
+	return nil
+}
+
+// LoadCachedLists populates the blocker from the on-disk cache without
+// touching the network. Only lists named in sources are loaded so removed
+// subscriptions are not resurrected. It returns the number of lists loaded.
+func (b *Blocker) LoadCachedLists(sources map[string]string) int {
+	b.mu.RLock()
+	dir := b.cacheDir
+	b.mu.RUnlock()
+
+	if dir == "" {
+		return 0
+	}
+
+	loaded := 0
+	for name, source := range sources {
+		meta, data, err := readCache(dir, name)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Ignoring cached blocklist %s: %v", name, err)
+			}
+			continue
+		}
+		if meta.Source != source {
+			log.Printf("Ignoring cached blocklist %s: fetched from %s, now %s", name, meta.Source, source)
+			continue
+		}
+
+		domains, err := parseList(bytes.NewReader(data), meta.Format)
+		if err != nil {
+			log.Printf("Ignoring cached blocklist %s: %v", name, err)
+			continue
+		}
+
+		b.mu.Lock()
+		list := b.getOrCreateList(name)
+		list.Source = meta.Source
+		list.Format = meta.Format
+		list.setDomains(domains)
+		list.ETag = meta.ETag
+		list.LastUpdated = meta.FetchedAt
+		b.mu.Unlock()
+
+		log.Printf("Loaded cached blocklist %s (%d domains, fetched %s)",
+			name, len(domains), meta.FetchedAt.Format(time.RFC3339))
+		loaded++
+	}
+	return loaded
+}
+
+// cachePaths returns where a list is cached. Names are made safe for the
+// file system and suffixed with a hash of the original, so names that only
+// differ in unsafe characters do not share files.
+func cachePaths(dir, name string) (dataPath, metaPath string) {
+	base := unsafeFileChars.ReplaceAllString(name, "_") + "-" + checksum([]byte(name))[:8]
+	return filepath.Join(dir, base+".txt"), filepath.Join(dir, base+".json")
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func readCache(dir, name string) (*CacheMeta, []byte, error) {
+	dataPath, metaPath := cachePaths(dir, name)
+
+	raw, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta CacheMeta
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if checksum(data) != meta.Checksum {
+		return nil, nil, fmt.Errorf("checksum mismatch")
+	}
+
+	return &meta, data, nil
+}
+
+// writeCache stores a list atomically: the data and metadata are written to
+// temporary files and renamed into place, data first, so a crash never leaves
+// metadata pointing at a partial file.
+func writeCache(dir string, meta CacheMeta, data []byte) error {
+	dataPath, metaPath := cachePaths(dir, meta.Name)
+	meta.Checksum = checksum(data)
+
+	rawMeta, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := atomicfile.Write(dataPath, data); err != nil {
+		return err
+	}
+	return atomicfile.Write(metaPath, rawMeta)
+}
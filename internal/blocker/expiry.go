@@ -0,0 +1,94 @@
+package blocker
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+// Temporary rules are tracked in Blocker.expiries under a key naming the
+// rule. The rule itself lives in its usual place; expiry only decides when
+// it is removed.
+
+func allowKey(rule AllowRule) string {
+	return "allow\x00" + rule.String()
+}
+
+func blockKey(listName, domain string) string {
+	return "block\x00" + listName + "\x00" + domain
+}
+
+func regexKey(id string) string {
+	return "regex\x00" + id
+}
+
+// setExpiryLocked records when a rule expires, a zero time clears it. Must
+// be called with b.mu held for writing.
+func (b *Blocker) setExpiryLocked(key string, expiresAt time.Time) {
+	if expiresAt.IsZero() {
+		delete(b.expiries, key)
+		return
+	}
+	b.expiries[key] = expiresAt
+}
+
+// expiryLocked returns a rule's expiry and the whole seconds left, or nil
+// for permanent rules. Must be called with b.mu held.
+func (b *Blocker) expiryLocked(key string, now time.Time) (*time.Time, int64) {
+	expiresAt, ok := b.expiries[key]
+	if !ok {
+		return nil, 0
+	}
+	remaining := int64(expiresAt.Sub(now).Seconds())
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &expiresAt, remaining
+}
+
+// PruneExpired removes every temporary rule that expired by now and returns
+// how many were removed
+func (b *Blocker) PruneExpired(now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	removed := 0
+	for key, expiresAt := range b.expiries {
+		if now.Before(expiresAt) {
+			continue
+		}
+
+		parts := strings.Split(key, "\x00")
+		switch parts[0] {
+		case "allow":
+			if rule, err := ParseAllowRule(parts[1]); err == nil {
+				b.removeAllowRuleLocked(rule)
+			}
+		case "block":
+			b.expireDomainLocked(parts[2], parts[1])
+		case "regex":
+			b.removeRegexLocked(parts[1])
+		}
+		delete(b.expiries, key)
+
+		log.Printf("Temporary %s rule %s expired", parts[0], strings.Join(parts[1:], " "))
+		removed++
+	}
+	return removed
+}
+
+// RunExpiry prunes expired rules every interval until ctx is cancelled
+func (b *Blocker) RunExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			b.PruneExpired(now)
+		}
+	}
+}
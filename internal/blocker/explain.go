@@ -0,0 +1,195 @@
+package blocker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rule types reported in a RuleMatch
+const (
+	RuleAllowlist = "allowlist"
+	RuleBlocklist = "blocklist"
+	RuleRegex     = "regex"
+	RuleService   = "service"
+)
+
+// Ways a blocklist entry can match a domain
+const (
+	MatchExact  = "exact"
+	MatchParent = "parent"
+)
+
+// RuleMatch is a single rule that applies to a domain
+type RuleMatch struct {
+	Type   string `json:"type"`
+	ID     string `json:"id,omitempty"`     // Rule ID for regex rules
+	Source string `json:"source,omitempty"` // Blocklist or service name, or policy name for policy rules
+	Rule   string `json:"rule"`             // The entry or pattern that matched
+	Match  string `json:"match,omitempty"`  // exact or parent, for domain rules
+	Active bool   `json:"active"`           // False when the owning list is disabled
+}
+
+// Explanation describes how the blocker decided on a domain
+type Explanation struct {
+	Domain  string      `json:"domain"`
+	Matches []RuleMatch `json:"matches"`
+	Winner  *RuleMatch  `json:"winner,omitempty"`
+	Reason  string      `json:"reason"`
+	Blocked bool        `json:"blocked"`
+}
+
+// Explain returns every rule matching domain and which one decides the
+// outcome. Precedence, highest first:
+//
+//  1. allowlist entries: exact, then subtree and wildcard entries from the
+//     closest parent up, then regexes
+//  2. exact matches in enabled blocklists, by list name
+//  3. parent domain matches, closest parent first, then by list name
+//  4. blocked services, domains from the closest label up, then regexes
+//  5. regex patterns, in the order they were added
+//
+// Explain does not count towards blocklist statistics.
+func (b *Blocker) Explain(domain string) Explanation {
+	return b.ExplainFor(domain, nil)
+}
+
+// ExplainFor is Explain evaluated under a client policy. The policy's
+// allowlist entries and regexes follow the global ones of the same kind, and
+// lists outside the policy or their schedule are reported as inactive.
+func (b *Blocker) ExplainFor(domain string, policy *Policy) Explanation {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	domain = normalizeDomain(domain)
+	exp := Explanation{
+		Domain:  domain,
+		Matches: b.matchLocked(domain, policy, true),
+	}
+
+	for i := range exp.Matches {
+		if exp.Matches[i].Active {
+			exp.Winner = &exp.Matches[i]
+			break
+		}
+	}
+
+	if exp.Winner == nil {
+		exp.Reason = "no active rule matches"
+		return exp
+	}
+
+	w := exp.Winner
+	switch {
+	case w.Type == RuleAllowlist:
+		exp.Reason = fmt.Sprintf("allowlist entry %s takes precedence over block rules", w.Rule)
+	case w.Type == RuleService:
+		exp.Reason = fmt.Sprintf("service %s is blocked and %s is one of its rules", w.Source, w.Rule)
+	case w.Type == RuleRegex:
+		exp.Reason = fmt.Sprintf("regex %s matched and no list or allowlist rule applies", w.Rule)
+	case w.Match == MatchExact:
+		exp.Reason = fmt.Sprintf("exact entry in blocklist %s", w.Source)
+	default:
+		exp.Reason = fmt.Sprintf("parent domain %s is listed in blocklist %s", w.Rule, w.Source)
+	}
+	exp.Blocked = w.Type != RuleAllowlist
+	return exp
+}
+
+// matchLocked returns the rules matching domain in precedence order under
+// policy, which may be nil. Unless all is set it stops at the first active
+// rule, which decides the outcome, and skips inactive lists. Must be called
+// with b.mu held.
+func (b *Blocker) matchLocked(domain string, policy *Policy, all bool) []RuleMatch {
+	var matches []RuleMatch
+	done := func() bool { return !all && len(matches) > 0 }
+
+	// A group policy outside its schedule does not apply
+	now := b.clock()
+	group := ""
+	if policy != nil {
+		if !b.scheduledLocked("", policy.Name, now) {
+			policy = nil
+		} else {
+			group = policy.Name
+		}
+	}
+
+	// Allowlist
+	matches = append(matches, b.allow.match(domain, all)...)
+	if done() {
+		return matches
+	}
+	if policy != nil {
+		for _, m := range policy.allow.match(domain, all) {
+			m.Source = policy.Name
+			matches = append(matches, m)
+		}
+		if done() {
+			return matches
+		}
+	}
+
+	// Blocklists: the domain itself, then each parent from closest up
+	labels := strings.Split(domain, ".")
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		kind := MatchExact
+		if i > 0 {
+			kind = MatchParent
+		}
+
+		for _, name := range b.listOrder {
+			list := b.blocklists[name]
+			active := list.Enabled && policy.usesList(name) && b.scheduledLocked(name, group, now)
+			if !active && !all {
+				continue
+			}
+			if list.has(candidate) {
+				matches = append(matches, RuleMatch{
+					Type:   RuleBlocklist,
+					Source: name,
+					Rule:   candidate,
+					Match:  kind,
+					Active: active,
+				})
+				if done() {
+					return matches
+				}
+			}
+		}
+	}
+
+	// Blocked services
+	matches = append(matches, b.matchServicesLocked(domain, labels, policy, all)...)
+	if done() {
+		return matches
+	}
+
+	// Regex patterns. The combined matcher rejects most domains in a single
+	// pass; only on a hit do we look for the individual rules. Without one
+	// every rule is tried.
+	if b.regexCombined == nil || b.regexCombined.MatchString(domain) {
+		for _, rule := range b.regexRules {
+			if rule.regex.MatchString(domain) {
+				matches = append(matches, RuleMatch{Type: RuleRegex, ID: rule.ID, Rule: rule.Pattern, Active: true})
+				if done() {
+					return matches
+				}
+			}
+		}
+	}
+
+	// Policy regexes have no ID and are not counted
+	if policy != nil {
+		for _, rule := range policy.regexes {
+			if rule.regex.MatchString(domain) {
+				matches = append(matches, RuleMatch{Type: RuleRegex, Source: policy.Name, Rule: rule.Pattern, Active: true})
+				if done() {
+					return matches
+				}
+			}
+		}
+	}
+
+	return matches
+}
@@ -0,0 +1,338 @@
+package blocker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFetchTimeout = 30 * time.Second
+	defaultFetchRetries = 3
+)
+
+// Download settings, kept as variables so tests can shorten them
+var (
+	fetchClient       = &http.Client{Timeout: defaultFetchTimeout}
+	fetchRetries      = defaultFetchRetries
+	fetchRetryBackoff = 2 * time.Second
+)
+
+// Supported list formats
+const (
+	FormatHosts   = "hosts"   // "0.0.0.0 example.com" lines
+	FormatDomains = "domains" // one bare domain per line
+)
+
+// ValidFormat reports whether format names a supported list format. The
+// empty string is accepted and means FormatHosts.
+func ValidFormat(format string) bool {
+	switch format {
+	case "", FormatHosts, FormatDomains:
+		return true
+	}
+	return false
+}
+
+// LoadFromURL loads a hosts formatted list from a URL. See LoadList.
+func (b *Blocker) LoadFromURL(url string, name string) error {
+	if name == "" {
+		name = url // Use URL as name if not provided
+	}
+	return b.LoadList(name, url, FormatHosts)
+}
+
+// LoadList loads blocked domains from a source, retrying transient failures.
+// file:// URLs are read from the local filesystem; when they point at a
+// directory every regular file in it is merged into the list. If every
+// attempt fails the list is registered as degraded so it can be retried
+// later by RetryDegradedLists.
+func (b *Blocker) LoadList(name, source, format string) error {
+	if format == "" {
+		format = FormatHosts
+	}
+
+	if path, ok := localPath(source); ok {
+		return b.loadLocal(path, source, name, format)
+	}
+
+	b.mu.RLock()
+	etag := ""
+	if list, ok := b.blocklists[name]; ok && list.Source == source && list.Count > 0 {
+		etag = list.ETag
+	}
+	cacheDir := b.cacheDir
+	b.mu.RUnlock()
+
+	result, err := fetchWithRetry(source, etag)
+	if err != nil {
+		b.markDegraded(name, source, format, err)
+		return err
+	}
+
+	if result.notModified {
+		b.markFresh(name)
+		return nil
+	}
+
+	domains, err := parseList(bytes.NewReader(result.body), format)
+	if err != nil {
+		b.markDegraded(name, source, format, err)
+		return err
+	}
+
+	b.replaceList(name, source, format, result.etag, domains)
+
+	if cacheDir != "" {
+		meta := CacheMeta{Name: name, Source: source, Format: format, FetchedAt: time.Now(), ETag: result.etag}
+		if err := writeCache(cacheDir, meta, result.body); err != nil {
+			log.Printf("Failed to cache blocklist %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// listSource identifies what LoadList needs to (re)load a list
+type listSource struct {
+	name, source, format string
+}
+
+// LoadMultipleLists downloads hosts formatted blocklists concurrently. A
+// failing list does not prevent the others from loading; all failures are
+// returned joined together and the failed lists are marked as degraded.
+func (b *Blocker) LoadMultipleLists(sources map[string]string) error {
+	lists := make([]listSource, 0, len(sources))
+	for name, url := range sources {
+		lists = append(lists, listSource{name: name, source: url, format: FormatHosts})
+	}
+	return b.loadConcurrently(lists)
+}
+
+func (b *Blocker) loadConcurrently(lists []listSource) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+
+	for _, l := range lists {
+		wg.Add(1)
+		go func(l listSource) {
+			defer wg.Done()
+			if err := b.LoadList(l.name, l.source, l.format); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("failed to load blocklist %s: %w", l.name, err))
+				mu.Unlock()
+			}
+		}(l)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// RetryDegradedLists periodically retries every degraded list until ctx is
+// cancelled.
+func (b *Blocker) RetryDegradedLists(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lists := b.degradedLists()
+			if len(lists) == 0 {
+				continue
+			}
+			log.Printf("Retrying %d degraded blocklists", len(lists))
+			if err := b.loadConcurrently(lists); err != nil {
+				log.Printf("Blocklist retry incomplete: %v", err)
+			}
+		}
+	}
+}
+
+func (b *Blocker) degradedLists() []listSource {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	lists := make([]listSource, 0)
+	for name, list := range b.blocklists {
+		if list.Degraded && list.Source != "" {
+			lists = append(lists, listSource{name: name, source: list.Source, format: list.Format})
+		}
+	}
+	return lists
+}
+
+type fetchResult struct {
+	body        []byte
+	etag        string
+	notModified bool
+}
+
+func fetchWithRetry(url, etag string) (*fetchResult, error) {
+	var err error
+	for attempt := 0; attempt < fetchRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(fetchRetryBackoff * time.Duration(1<<(attempt-1)))
+		}
+
+		var result *fetchResult
+		result, err = fetch(url, etag)
+		if err == nil {
+			return result, nil
+		}
+		log.Printf("Fetching %s failed (attempt %d/%d): %v", url, attempt+1, fetchRetries, err)
+	}
+	return nil, err
+}
+
+// fetch downloads a list, sending If-None-Match when we already hold a copy
+// with a known ETag
+func fetch(url, etag string) (*fetchResult, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return &fetchResult{etag: etag, notModified: true}, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &fetchResult{body: body, etag: resp.Header.Get("ETag")}, nil
+}
+
+// parseHosts reads hosts file formatted lines (0.0.0.0 example.com or
+// 127.0.0.1 example.com) into a domain set
+func parseHosts(reader io.Reader) (map[string]struct{}, error) {
+	return parseList(reader, FormatHosts)
+}
+
+// parseList reads a list in the given format into a domain set
+func parseList(reader io.Reader, format string) (map[string]struct{}, error) {
+	domains := make(map[string]struct{})
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Skip empty lines and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		switch {
+		case format == FormatDomains:
+			domains[strings.ToLower(fields[0])] = struct{}{}
+		case len(fields) >= 2:
+			domains[strings.ToLower(fields[1])] = struct{}{}
+		}
+	}
+
+	return domains, scanner.Err()
+}
+
+func (b *Blocker) loadFromReader(reader io.Reader, listName string) error {
+	domains, err := parseHosts(reader)
+	if err != nil {
+		return err
+	}
+
+	b.replaceList(listName, "", FormatHosts, "", domains)
+	return nil
+}
+
+// replaceList swaps in a freshly parsed domain set for a list, creating the
+// list if needed. Parsing happens before the lock is taken so a slow download
+// never stalls queries.
+func (b *Blocker) replaceList(name, source, format, etag string, domains map[string]struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	list := b.getOrCreateList(name)
+	if source != "" {
+		list.Source = source
+	}
+	list.Format = format
+	list.ETag = etag
+	list.setDomains(domains)
+	list.Degraded = false
+	list.LastError = ""
+	list.Failures = 0
+	list.LastUpdated = time.Now()
+}
+
+func (b *Blocker) markFresh(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	list := b.getOrCreateList(name)
+	list.Degraded = false
+	list.LastError = ""
+	list.Failures = 0
+	list.LastUpdated = time.Now()
+}
+
+func (b *Blocker) markDegraded(name, source, format string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	list := b.getOrCreateList(name)
+	list.Source = source
+	list.Format = format
+	list.Degraded = true
+	list.LastError = err.Error()
+	list.Failures++
+}
+
+// getOrCreateList must be called with b.mu held for writing
+func (b *Blocker) getOrCreateList(name string) *BlockList {
+	list, exists := b.blocklists[name]
+	if !exists {
+		list = &BlockList{
+			Name:      name,
+			Domains:   make(map[string]struct{}),
+			Manual:    make(map[string]struct{}),
+			Temporary: make(map[string]struct{}),
+			Enabled:   true,
+		}
+		b.blocklists[name] = list
+		b.blocklistStats[name] = 0
+
+		i := sort.SearchStrings(b.listOrder, name)
+		b.listOrder = append(b.listOrder, "")
+		copy(b.listOrder[i+1:], b.listOrder[i:])
+		b.listOrder[i] = name
+	}
+	return list
+}
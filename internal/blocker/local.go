@@ -0,0 +1,203 @@
+package blocker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Editors and copy tools emit bursts of events; wait for them to settle
+// before reloading
+const localReloadDelay = 500 * time.Millisecond
+
+// localWatcher reloads file:// lists when their files change on disk
+type localWatcher struct {
+	fsw     *fsnotify.Watcher
+	mu      sync.Mutex
+	watched map[string]struct{}
+	pending map[string]*time.Timer
+}
+
+func localPath(source string) (string, bool) {
+	if !strings.HasPrefix(source, "file://") {
+		return "", false
+	}
+	return filepath.Clean(strings.TrimPrefix(source, "file://")), true
+}
+
+func (b *Blocker) loadLocal(path, source, name, format string) error {
+	data, err := readLocal(path)
+	if err != nil {
+		b.markDegraded(name, source, format, err)
+		return err
+	}
+
+	domains, err := parseList(bytes.NewReader(data), format)
+	if err != nil {
+		b.markDegraded(name, source, format, err)
+		return err
+	}
+
+	b.replaceList(name, source, format, "", domains)
+	b.watchLocal(path)
+	return nil
+}
+
+// readLocal returns the contents of a file, or of every regular file in a
+// directory concatenated in name order
+func readLocal(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return os.ReadFile(path)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		// Skip hidden files, which includes editor swap files
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", entry.Name(), err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// WatchLocalLists reloads file:// lists whenever the files or directories
+// behind them change, until ctx is cancelled. Lists loaded after the watcher
+// starts are picked up automatically.
+func (b *Blocker) WatchLocalLists(ctx context.Context) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	w := &localWatcher{
+		fsw:     fsw,
+		watched: make(map[string]struct{}),
+		pending: make(map[string]*time.Timer),
+	}
+
+	b.mu.Lock()
+	b.watcher = w
+	paths := make([]string, 0)
+	for _, list := range b.blocklists {
+		if path, ok := localPath(list.Source); ok {
+			paths = append(paths, path)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, path := range paths {
+		b.watchLocal(path)
+	}
+
+	go func() {
+		defer fsw.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-fsw.Events:
+				if !ok {
+					return
+				}
+				b.scheduleLocalReload(event.Name)
+			case err, ok := <-fsw.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Blocklist watcher error: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// watchLocal adds a list path to the watcher if one is running. Files are
+// watched through their parent directory so that editors which replace the
+// file on save are still noticed.
+func (b *Blocker) watchLocal(path string) {
+	b.mu.RLock()
+	w := b.watcher
+	b.mu.RUnlock()
+	if w == nil {
+		return
+	}
+
+	dir := path
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		dir = filepath.Dir(path)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.watched[dir]; ok {
+		return
+	}
+	if err := w.fsw.Add(dir); err != nil {
+		log.Printf("Failed to watch %s: %v", dir, err)
+		return
+	}
+	w.watched[dir] = struct{}{}
+}
+
+// scheduleLocalReload finds every list backed by the changed path and
+// reloads it once events have settled
+func (b *Blocker) scheduleLocalReload(changed string) {
+	b.mu.RLock()
+	w := b.watcher
+	affected := make(map[string]listSource)
+	for name, list := range b.blocklists {
+		path, ok := localPath(list.Source)
+		if !ok {
+			continue
+		}
+		if path == changed || path == filepath.Dir(changed) {
+			affected[name] = listSource{name: name, source: list.Source, format: list.Format}
+		}
+	}
+	b.mu.RUnlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for name, l := range affected {
+		if timer, ok := w.pending[name]; ok {
+			timer.Stop()
+		}
+		w.pending[name] = time.AfterFunc(localReloadDelay, func() {
+			w.mu.Lock()
+			delete(w.pending, name)
+			w.mu.Unlock()
+
+			if err := b.LoadList(l.name, l.source, l.format); err != nil {
+				log.Printf("Failed to reload local blocklist %s: %v", name, err)
+				return
+			}
+			log.Printf("Reloaded local blocklist %s", name)
+		})
+	}
+}
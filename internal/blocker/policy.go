@@ -0,0 +1,133 @@
+package blocker
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// Policy narrows or extends blocking for a subset of clients. It is built
+// once with NewPolicy and is safe to share between goroutines.
+type Policy struct {
+	Name string
+
+	// lists restricts which blocklists apply; nil means every enabled list.
+	// A list named here still has to be enabled globally to take effect.
+	lists map[string]struct{}
+
+	// allow and regexes apply on top of the global allowlist and regexes
+	allow   *allowSet
+	regexes []*RegexRule
+
+	// services are blocked catalogue entries, see services.go
+	services map[string]struct{}
+}
+
+// NewPolicy compiles a policy. A nil lists slice keeps every enabled list;
+// an empty one disables blocklists altogether. Allowlist entries use the
+// ParseAllowRule syntax, regexes go through ValidateRegex and services are
+// catalogue IDs.
+func NewPolicy(name string, lists, allowlist, regexes, services []string) (*Policy, error) {
+	p := &Policy{Name: name, allow: newAllowSet(), services: make(map[string]struct{})}
+
+	for _, id := range services {
+		p.services[id] = struct{}{}
+	}
+
+	if lists != nil {
+		p.lists = make(map[string]struct{}, len(lists))
+		for _, list := range lists {
+			p.lists[list] = struct{}{}
+		}
+	}
+
+	for _, entry := range allowlist {
+		rule, err := ParseAllowRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("allowlist entry %q: %w", entry, err)
+		}
+		p.allow.add(rule)
+	}
+
+	for _, pattern := range regexes {
+		regex, err := ValidateRegex(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("regex %q: %w", pattern, err)
+		}
+		p.regexes = append(p.regexes, &RegexRule{Pattern: pattern, regex: regex})
+	}
+
+	return p, nil
+}
+
+// Lists returns the blocklists the policy is restricted to, sorted, or nil
+// when it uses every enabled list
+func (p *Policy) Lists() []string {
+	if p == nil || p.lists == nil {
+		return nil
+	}
+	lists := make([]string, 0, len(p.lists))
+	for list := range p.lists {
+		lists = append(lists, list)
+	}
+	sort.Strings(lists)
+	return lists
+}
+
+// Services returns the IDs of the services the policy blocks, sorted
+func (p *Policy) Services() []string {
+	if p == nil {
+		return nil
+	}
+	ids := make([]string, 0, len(p.services))
+	for id := range p.services {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// usesList reports whether a blocklist takes part in decisions under p. A
+// nil policy uses every list.
+func (p *Policy) usesList(name string) bool {
+	if p == nil || p.lists == nil {
+		return true
+	}
+	_, ok := p.lists[name]
+	return ok
+}
+
+// IsBlockedFor is IsBlocked evaluated under a client policy. A nil policy
+// behaves exactly like IsBlocked.
+func (b *Blocker) IsBlockedFor(domain string, policy *Policy) (bool, string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	domain = normalizeDomain(domain)
+
+	matches := b.matchLocked(domain, policy, false)
+	if len(matches) == 0 {
+		log.Printf("Domain %s not found in any blocklist, allowing", domain)
+		return false, ""
+	}
+
+	match := matches[0]
+	switch match.Type {
+	case RuleAllowlist:
+		log.Printf("Domain %s is whitelisted, allowing", domain)
+		return false, ""
+	case RuleService:
+		log.Printf("Domain %s matched %s of blocked service %s", domain, match.Rule, match.Source)
+		return true, "service:" + match.Source
+	case RuleRegex:
+		log.Printf("Domain %s matched regex pattern: %s", domain, match.Rule)
+		if match.ID != "" {
+			b.countRegexHitLocked(match.ID)
+		}
+		return true, "regex:" + match.Rule
+	default:
+		log.Printf("Domain %s matched %s in blocklist %s", domain, match.Rule, match.Source)
+		b.blocklistStats[match.Source]++
+		return true, match.Source
+	}
+}
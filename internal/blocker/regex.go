@@ -0,0 +1,245 @@
+package blocker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxRegexLength bounds the size of a single pattern
+const maxRegexLength = 512
+
+// maxPopularMatches is how many popular domains a pattern may match before
+// it is considered too broad. A couple are allowed so that rules aimed at a
+// single big service can still be written.
+const maxPopularMatches = 2
+
+var (
+	ErrRegexTooLong  = fmt.Errorf("pattern is longer than %d characters", maxRegexLength)
+	ErrRegexTooBroad = errors.New("pattern is too broad")
+	ErrRegexNotFound = errors.New("regex rule not found")
+)
+
+// popularDomains is the sample a new pattern is checked against to catch
+// rules that would block large parts of the web
+var popularDomains = []string{
+	"google.com", "www.google.com", "youtube.com", "www.youtube.com",
+	"facebook.com", "www.facebook.com", "wikipedia.org", "en.wikipedia.org",
+	"amazon.com", "www.amazon.com", "apple.com", "www.apple.com",
+	"microsoft.com", "login.microsoftonline.com", "github.com", "api.github.com",
+	"cloudflare.com", "netflix.com", "instagram.com", "whatsapp.net",
+	"linkedin.com", "reddit.com", "yahoo.com", "bing.com",
+	"twitter.com", "x.com", "zoom.us", "office.com",
+	"icloud.com", "baidu.com", "example.com", "tiktok.com",
+}
+
+// RegexRule is a regex blocking rule with bookkeeping
+type RegexRule struct {
+	ID        string     `json:"id"`
+	Pattern   string     `json:"pattern"`
+	Comment   string     `json:"comment,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	ExpiresIn int64      `json:"expiresIn,omitempty"` // Seconds until removal
+	Hits      int64      `json:"hits"`
+
+	regex *regexp.Regexp
+}
+
+// ValidateRegex compiles a pattern and rejects ones that are too long or
+// match too many popular domains. The compiled regex is returned for reuse.
+func ValidateRegex(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > maxRegexLength {
+		return nil, ErrRegexTooLong
+	}
+
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if regex.MatchString("") {
+		return nil, fmt.Errorf("%w: matches the empty name", ErrRegexTooBroad)
+	}
+
+	hits := PopularMatches(regex)
+	if len(hits) > maxPopularMatches {
+		return nil, fmt.Errorf("%w: matches %s", ErrRegexTooBroad, strings.Join(hits, ", "))
+	}
+	return regex, nil
+}
+
+// PopularMatches returns the popular sample domains a regex matches
+func PopularMatches(regex *regexp.Regexp) []string {
+	var hits []string
+	for _, domain := range popularDomains {
+		if regex.MatchString(domain) {
+			hits = append(hits, domain)
+		}
+	}
+	return hits
+}
+
+// AddRegexRule validates and adds a regex blocking rule
+func (b *Blocker) AddRegexRule(pattern, comment string) (RegexRule, error) {
+	return b.AddRegexRuleUntil(pattern, comment, time.Time{})
+}
+
+// AddRegexRuleUntil adds a regex rule that is removed automatically at
+// expiresAt. A zero time makes the rule permanent. Adding a pattern that
+// already exists updates its expiry, unless the rule is permanent.
+func (b *Blocker) AddRegexRuleUntil(pattern, comment string, expiresAt time.Time) (RegexRule, error) {
+	regex, err := ValidateRegex(pattern)
+	if err != nil {
+		return RegexRule{}, err
+	}
+
+	rule := &RegexRule{
+		ID:        uuid.New().String(),
+		Pattern:   pattern,
+		Comment:   comment,
+		CreatedAt: time.Now(),
+		regex:     regex,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, existing := range b.regexRules {
+		if existing.Pattern == pattern {
+			key := regexKey(existing.ID)
+			if _, temporary := b.expiries[key]; temporary || expiresAt.IsZero() {
+				b.setExpiryLocked(key, expiresAt)
+			}
+			return b.snapshotLocked(existing), nil
+		}
+	}
+
+	b.regexRules = append(b.regexRules, rule)
+	b.setExpiryLocked(regexKey(rule.ID), expiresAt)
+	b.rebuildRegexLocked()
+	return b.snapshotLocked(rule), nil
+}
+
+// AddBlockRegex adds a regex pattern for blocking
+func (b *Blocker) AddBlockRegex(pattern string) error {
+	_, err := b.AddRegexRule(pattern, "")
+	return err
+}
+
+// RemoveRegexRule removes a rule by ID
+func (b *Blocker) RemoveRegexRule(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.removeRegexLocked(id) {
+		return ErrRegexNotFound
+	}
+	return nil
+}
+
+func (b *Blocker) removeRegexLocked(id string) bool {
+	for i, rule := range b.regexRules {
+		if rule.ID == id {
+			b.regexRules = append(b.regexRules[:i], b.regexRules[i+1:]...)
+			delete(b.expiries, regexKey(id))
+			b.rebuildRegexLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveBlockRegex removes a regex pattern by its string representation
+func (b *Blocker) RemoveBlockRegex(pattern string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, rule := range b.regexRules {
+		if rule.Pattern == pattern {
+			b.removeRegexLocked(rule.ID)
+			break
+		}
+	}
+}
+
+// GetRegexRules returns a snapshot of the regex rules in evaluation order
+func (b *Blocker) GetRegexRules() []RegexRule {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	rules := make([]RegexRule, len(b.regexRules))
+	for i, rule := range b.regexRules {
+		rules[i] = b.snapshotLocked(rule)
+	}
+	return rules
+}
+
+// GetRegexPatterns returns the current regex patterns
+func (b *Blocker) GetRegexPatterns() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	patterns := make([]string, len(b.regexRules))
+	for i, rule := range b.regexRules {
+		patterns[i] = rule.Pattern
+	}
+
+	return patterns
+}
+
+// snapshotLocked copies a rule for callers, filling in its expiry. Must be
+// called with b.mu held. Fields are copied one by one because Hits may be
+// incremented concurrently under a read lock.
+func (b *Blocker) snapshotLocked(r *RegexRule) RegexRule {
+	c := RegexRule{
+		ID:        r.ID,
+		Pattern:   r.Pattern,
+		Comment:   r.Comment,
+		CreatedAt: r.CreatedAt,
+		Hits:      atomic.LoadInt64(&r.Hits),
+		regex:     r.regex,
+	}
+	c.ExpiresAt, c.ExpiresIn = b.expiryLocked(regexKey(r.ID), time.Now())
+	return c
+}
+
+// countRegexHitLocked bumps a rule's hit counter. Only a read lock is
+// needed since the counter is updated atomically.
+func (b *Blocker) countRegexHitLocked(id string) {
+	for _, rule := range b.regexRules {
+		if rule.ID == id {
+			atomic.AddInt64(&rule.Hits, 1)
+			return
+		}
+	}
+}
+
+// rebuildRegexLocked recompiles the combined matcher, must be called with
+// b.mu held for writing. Rules that compile on their own can still exceed
+// the size limit together, in which case there is no combined matcher and
+// each rule is tried in turn.
+func (b *Blocker) rebuildRegexLocked() {
+	b.regexCombined = nil
+	if len(b.regexRules) == 0 {
+		return
+	}
+
+	parts := make([]string, len(b.regexRules))
+	for i, rule := range b.regexRules {
+		parts[i] = "(?:" + rule.Pattern + ")"
+	}
+	// The error quotes the whole alternation, so it is not logged
+	combined, err := regexp.Compile(strings.Join(parts, "|"))
+	if err != nil {
+		log.Printf("%d regex rules are too large to combine, matching them one by one", len(b.regexRules))
+		return
+	}
+	b.regexCombined = combined
+}
@@ -0,0 +1,413 @@
+package blocker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vivek-pk/goadblock/internal/atomicfile"
+)
+
+var (
+	ErrScheduleNotFound = errors.New("schedule not found")
+	ErrScheduleOverlap  = errors.New("schedule overlaps an existing one")
+)
+
+const (
+	minutesPerDay  = 24 * 60
+	minutesPerWeek = 7 * minutesPerDay
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Schedule limits when lists or a group policy are in force. Outside its
+// windows a scheduled list takes no part in decisions for the schedule's
+// clients, and a scheduled group falls back to the default policy.
+//
+// Windows start at Start on each of Days, in the server's local time, and
+// run until End. An End at or before Start runs past midnight into the next
+// day, so "sun".."thu" 21:00-07:00 covers school nights.
+type Schedule struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name,omitempty"`
+	Group string   `json:"group,omitempty"` // Client group, empty for everyone
+	Lists []string `json:"lists,omitempty"` // Empty schedules the group itself
+	Days  []string `json:"days,omitempty"`  // mon, tue, ...; empty means every day
+	Start string   `json:"start"`           // HH:MM
+	End   string   `json:"end"`             // HH:MM, 24:00 for midnight
+}
+
+// compiledSchedule is a validated Schedule as minute-of-week intervals
+type compiledSchedule struct {
+	Schedule
+	windows [][2]int // [start, end) in minutes since Sunday 00:00, may exceed a week
+}
+
+// compile validates a schedule, normalizing its day names
+func (s *Schedule) compile() (*compiledSchedule, error) {
+	if s.Group == "" && len(s.Lists) == 0 {
+		return nil, errors.New("a schedule needs a group or at least one list")
+	}
+
+	start, err := parseClock(s.Start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start: %w", err)
+	}
+	end, err := parseClock(s.End)
+	if err != nil {
+		return nil, fmt.Errorf("invalid end: %w", err)
+	}
+	if start == end || start == minutesPerDay {
+		return nil, errors.New("start and end must describe a non-empty window")
+	}
+	if end < start {
+		end += minutesPerDay
+	}
+
+	days := s.Days
+	if len(days) == 0 {
+		days = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+	}
+
+	c := &compiledSchedule{Schedule: *s}
+	c.Days = make([]string, 0, len(days))
+	seen := make(map[time.Weekday]bool)
+	for _, day := range days {
+		key := strings.ToLower(strings.TrimSpace(day))
+		wd, ok := parseWeekday(key)
+		if !ok {
+			return nil, fmt.Errorf("invalid day %q", day)
+		}
+		if seen[wd] {
+			return nil, fmt.Errorf("day %q listed twice", day)
+		}
+		seen[wd] = true
+		c.Days = append(c.Days, key[:3])
+
+		offset := int(wd) * minutesPerDay
+		c.windows = append(c.windows, [2]int{offset + start, offset + end})
+	}
+	*s = c.Schedule
+	return c, nil
+}
+
+// parseWeekday accepts day names and their three letter abbreviations
+func parseWeekday(name string) (time.Weekday, bool) {
+	if len(name) < 3 {
+		return 0, false
+	}
+	wd, ok := weekdays[name[:3]]
+	return wd, ok && strings.HasPrefix(strings.ToLower(wd.String()), name)
+}
+
+// parseClock parses HH:MM into minutes after midnight, allowing 24:00
+func parseClock(value string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(value, "%d:%d", &h, &m); err != nil || n != 2 || len(value) != 5 {
+		return 0, fmt.Errorf("%q is not HH:MM", value)
+	}
+	if h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("%q is out of range", value)
+	}
+	return h*60 + m, nil
+}
+
+// ActiveAt reports whether t, in the server's local time, falls inside one
+// of the schedule's windows
+func (s Schedule) ActiveAt(t time.Time) bool {
+	c, err := s.compile()
+	return err == nil && c.activeAt(t)
+}
+
+func (c *compiledSchedule) activeAt(t time.Time) bool {
+	t = t.In(time.Local)
+	minute := int(t.Weekday())*minutesPerDay + t.Hour()*60 + t.Minute()
+	for _, w := range c.windows {
+		// Windows running past Saturday midnight continue on Sunday
+		if (minute >= w[0] && minute < w[1]) || minute+minutesPerWeek < w[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps reports whether two schedules govern the same target, i.e. the
+// same group and either a shared list or both the group itself, at the same
+// time
+func (c *compiledSchedule) overlaps(o *compiledSchedule) bool {
+	if c.Group != o.Group || (len(c.Lists) == 0) != (len(o.Lists) == 0) {
+		return false
+	}
+	if len(c.Lists) > 0 && !sharesList(c.Lists, o.Lists) {
+		return false
+	}
+
+	for _, a := range c.windows {
+		for _, b := range o.windows {
+			for _, shift := range []int{-minutesPerWeek, 0, minutesPerWeek} {
+				if a[0] < b[1]+shift && b[0]+shift < a[1] {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func sharesList(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setSchedules replaces the schedules the blocker evaluates
+func (b *Blocker) setSchedules(schedules []*compiledSchedule) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.schedules = schedules
+}
+
+// scheduledLocked reports whether a list, or the group policy itself when
+// list is empty, is in force for clients of group at now. Targets without
+// a schedule always are. Must be called with b.mu held.
+func (b *Blocker) scheduledLocked(list, group string, now time.Time) bool {
+	governed := false
+	for _, s := range b.schedules {
+		if list == "" {
+			if s.Group != group || group == "" || len(s.Lists) > 0 {
+				continue
+			}
+		} else if (s.Group != "" && s.Group != group) || !sharesList(s.Lists, []string{list}) {
+			continue
+		}
+
+		if s.activeAt(now) {
+			return true
+		}
+		governed = true
+	}
+	return !governed
+}
+
+// ScheduleManager owns the schedules, keeps the blocker in sync with them
+// and persists changes to disk
+type ScheduleManager struct {
+	blocker   *Blocker
+	path      string
+	mu        sync.Mutex
+	schedules map[string]*compiledSchedule
+}
+
+// NewScheduleManager creates a manager persisting to path. An empty path
+// disables persistence.
+func NewScheduleManager(b *Blocker, path string) *ScheduleManager {
+	return &ScheduleManager{
+		blocker:   b,
+		path:      path,
+		schedules: make(map[string]*compiledSchedule),
+	}
+}
+
+// Load reads persisted schedules
+func (m *ScheduleManager) Load() error {
+	if m.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var schedules []Schedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", m.path, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range schedules {
+		if err := m.putLocked(s); err != nil {
+			return fmt.Errorf("schedule %q: %w", s.ID, err)
+		}
+	}
+	m.applyLocked()
+	return nil
+}
+
+// List returns all schedules sorted by group, then start
+func (m *ScheduleManager) List() []Schedule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.listLocked()
+}
+
+// Get returns a single schedule
+func (m *ScheduleManager) Get(id string) (Schedule, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.schedules[id]
+	if !ok {
+		return Schedule{}, false
+	}
+	return s.Schedule, true
+}
+
+// Add validates and stores a new schedule, assigning its ID
+func (m *ScheduleManager) Add(s Schedule) (Schedule, error) {
+	s.ID = uuid.New().String()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.putLocked(s); err != nil {
+		return Schedule{}, err
+	}
+	if err := m.saveOrRevertLocked(s.ID, nil); err != nil {
+		return Schedule{}, err
+	}
+	return m.schedules[s.ID].Schedule, nil
+}
+
+// Update replaces an existing schedule
+func (m *ScheduleManager) Update(id string, s Schedule) (Schedule, error) {
+	s.ID = id
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, exists := m.schedules[id]
+	if !exists {
+		return Schedule{}, ErrScheduleNotFound
+	}
+	delete(m.schedules, id)
+	if err := m.putLocked(s); err != nil {
+		m.schedules[id] = old
+		return Schedule{}, err
+	}
+	if err := m.saveOrRevertLocked(id, old); err != nil {
+		return Schedule{}, err
+	}
+	return m.schedules[id].Schedule, nil
+}
+
+// Remove deletes a schedule
+func (m *ScheduleManager) Remove(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev, exists := m.schedules[id]
+	if !exists {
+		return ErrScheduleNotFound
+	}
+	delete(m.schedules, id)
+	return m.saveOrRevertLocked(id, prev)
+}
+
+// putLocked validates a schedule and stores it unless it overlaps another
+func (m *ScheduleManager) putLocked(s Schedule) error {
+	if s.ID == "" {
+		s.ID = uuid.New().String()
+	}
+	c, err := s.compile()
+	if err != nil {
+		return err
+	}
+
+	for _, other := range m.schedules {
+		if c.overlaps(other) {
+			return fmt.Errorf("%w: %s", ErrScheduleOverlap, other.describe())
+		}
+	}
+	m.schedules[c.ID] = c
+	return nil
+}
+
+// describe names a schedule for error messages
+func (c *compiledSchedule) describe() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.ID
+}
+
+// saveOrRevertLocked persists a change to one schedule and pushes the
+// schedules to the blocker. If saving fails the schedule is put back the way
+// it was, prev being nil when it did not exist, so that a change reported as
+// failed never takes effect.
+func (m *ScheduleManager) saveOrRevertLocked(id string, prev *compiledSchedule) error {
+	err := m.saveLocked()
+	if err != nil {
+		if prev == nil {
+			delete(m.schedules, id)
+		} else {
+			m.schedules[id] = prev
+		}
+	}
+	m.applyLocked()
+	return err
+}
+
+// applyLocked pushes the schedules to the blocker
+func (m *ScheduleManager) applyLocked() {
+	schedules := make([]*compiledSchedule, 0, len(m.schedules))
+	for _, s := range m.schedules {
+		schedules = append(schedules, s)
+	}
+	m.blocker.setSchedules(schedules)
+}
+
+func (m *ScheduleManager) listLocked() []Schedule {
+	schedules := make([]Schedule, 0, len(m.schedules))
+	for _, s := range m.schedules {
+		schedules = append(schedules, s.Schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		if schedules[i].Group != schedules[j].Group {
+			return schedules[i].Group < schedules[j].Group
+		}
+		if schedules[i].Start != schedules[j].Start {
+			return schedules[i].Start < schedules[j].Start
+		}
+		return schedules[i].ID < schedules[j].ID
+	})
+	return schedules
+}
+
+// saveLocked persists the schedules, must be called with m.mu held
+func (m *ScheduleManager) saveLocked() error {
+	if m.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(m.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		return err
+	}
+	return atomicfile.Write(m.path, data)
+}
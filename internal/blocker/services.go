@@ -0,0 +1,190 @@
+package blocker
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//go:embed services.json
+var builtinServices []byte
+
+// Service is a catalogue entry mapping a service to the rules that block it.
+// Domains match themselves and all their subdomains.
+type Service struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Domains []string `json:"domains"`
+	Regexes []string `json:"regexes,omitempty"`
+}
+
+// serviceCatalogue is the file format of services.json
+type serviceCatalogue struct {
+	Services []Service `json:"services"`
+}
+
+// compiledService is a Service ready for matching
+type compiledService struct {
+	Service
+	regexes []*regexp.Regexp
+}
+
+// services holds the catalogue and the index used while matching
+type services struct {
+	byID     map[string]*compiledService
+	byDomain map[string][]string // Domain to the IDs of services listing it, sorted
+}
+
+// parseServices validates a JSON catalogue
+func parseServices(data []byte) (*services, error) {
+	var catalogue serviceCatalogue
+	if err := json.Unmarshal(data, &catalogue); err != nil {
+		return nil, err
+	}
+
+	s := &services{
+		byID:     make(map[string]*compiledService),
+		byDomain: make(map[string][]string),
+	}
+	for _, svc := range catalogue.Services {
+		if svc.ID == "" {
+			return nil, errors.New("service without an id")
+		}
+		if _, exists := s.byID[svc.ID]; exists {
+			return nil, fmt.Errorf("service %q listed twice", svc.ID)
+		}
+		if len(svc.Domains) == 0 && len(svc.Regexes) == 0 {
+			return nil, fmt.Errorf("service %q has no rules", svc.ID)
+		}
+
+		c := &compiledService{Service: svc}
+		for i, domain := range svc.Domains {
+			domain = normalizeDomain(domain)
+			c.Domains[i] = domain
+			s.byDomain[domain] = append(s.byDomain[domain], svc.ID)
+		}
+		for _, pattern := range svc.Regexes {
+			regex, err := ValidateRegex(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("service %q: regex %q: %w", svc.ID, pattern, err)
+			}
+			c.regexes = append(c.regexes, regex)
+		}
+		s.byID[svc.ID] = c
+	}
+
+	for _, ids := range s.byDomain {
+		sort.Strings(ids)
+	}
+	return s, nil
+}
+
+// SetServicesFile sets the JSON file an updated catalogue is read from and
+// loads it. While the file does not exist the built-in catalogue is used.
+func (b *Blocker) SetServicesFile(path string) error {
+	b.mu.Lock()
+	b.servicesFile = path
+	b.mu.Unlock()
+
+	return b.ReloadServices()
+}
+
+// ReloadServices re-reads the catalogue file. Policies blocking services
+// that no longer exist keep them, but they match nothing.
+func (b *Blocker) ReloadServices() error {
+	b.mu.RLock()
+	path := b.servicesFile
+	b.mu.RUnlock()
+
+	data := builtinServices
+	if path != "" {
+		file, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			data = file
+		case !os.IsNotExist(err):
+			return err
+		}
+	}
+
+	s, err := parseServices(data)
+	if err != nil {
+		return fmt.Errorf("invalid service catalogue: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.services = s
+	return nil
+}
+
+// GetServices returns the catalogue sorted by ID
+func (b *Blocker) GetServices() []Service {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	list := make([]Service, 0, len(b.services.byID))
+	for _, svc := range b.services.byID {
+		list = append(list, svc.Service)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// HasService reports whether the catalogue contains a service
+func (b *Blocker) HasService(id string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	_, ok := b.services.byID[id]
+	return ok
+}
+
+// matchServicesLocked returns the services blocked under policy covering
+// domain, domain rules from the closest label up and then regexes. Unless
+// all is set it stops at the first. Must be called with b.mu held.
+func (b *Blocker) matchServicesLocked(domain string, labels []string, policy *Policy, all bool) []RuleMatch {
+	var matches []RuleMatch
+	if policy == nil || len(policy.services) == 0 {
+		return matches
+	}
+
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		kind := MatchExact
+		if i > 0 {
+			kind = MatchParent
+		}
+		for _, id := range b.services.byDomain[candidate] {
+			if _, ok := policy.services[id]; !ok {
+				continue
+			}
+			matches = append(matches, RuleMatch{Type: RuleService, Source: id, Rule: candidate, Match: kind, Active: true})
+			if !all {
+				return matches
+			}
+		}
+	}
+
+	for _, id := range policy.Services() {
+		svc, ok := b.services.byID[id]
+		if !ok {
+			continue
+		}
+		for _, regex := range svc.regexes {
+			if regex.MatchString(domain) {
+				matches = append(matches, RuleMatch{Type: RuleService, Source: id, Rule: regex.String(), Active: true})
+				if !all {
+					return matches
+				}
+			}
+		}
+	}
+	return matches
+}
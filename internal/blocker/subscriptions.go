@@ -0,0 +1,368 @@
+package blocker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vivek-pk/goadblock/internal/atomicfile"
+)
+
+// DefaultRefreshInterval is used for subscriptions that don't set one
+const DefaultRefreshInterval = 24 * time.Hour
+
+var (
+	ErrSubscriptionExists   = errors.New("subscription already exists")
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+)
+
+// Subscription describes a blocklist source the blocker keeps loaded
+type Subscription struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Format  string `json:"format"`
+	Refresh string `json:"refresh,omitempty"` // Go duration, e.g. "12h"
+	Enabled bool   `json:"enabled"`
+	Group   string `json:"group,omitempty"`
+}
+
+// Validate checks a subscription and fills in defaults
+func (s *Subscription) Validate() error {
+	if s.Name == "" {
+		return errors.New("name is required")
+	}
+	if s.URL == "" {
+		return errors.New("url is required")
+	}
+	if s.Format == "" {
+		s.Format = FormatHosts
+	}
+	if !ValidFormat(s.Format) {
+		return fmt.Errorf("unsupported format %q", s.Format)
+	}
+	if s.Refresh != "" {
+		d, err := time.ParseDuration(s.Refresh)
+		if err != nil {
+			return fmt.Errorf("invalid refresh interval: %w", err)
+		}
+		if d < time.Minute {
+			return errors.New("refresh interval must be at least 1m")
+		}
+	}
+	return nil
+}
+
+// RefreshInterval returns how often the subscription should be re-fetched
+func (s *Subscription) RefreshInterval() time.Duration {
+	if d, err := time.ParseDuration(s.Refresh); err == nil && d > 0 {
+		return d
+	}
+	return DefaultRefreshInterval
+}
+
+// SubscriptionManager owns the set of blocklist subscriptions, keeps the
+// blocker in sync with it and persists changes to disk
+type SubscriptionManager struct {
+	blocker     *Blocker
+	path        string
+	mu          sync.Mutex
+	subs        map[string]*Subscription
+	lastRefresh map[string]time.Time
+}
+
+// NewSubscriptionManager creates a manager persisting to path. An empty path
+// disables persistence.
+func NewSubscriptionManager(b *Blocker, path string) *SubscriptionManager {
+	return &SubscriptionManager{
+		blocker:     b,
+		path:        path,
+		subs:        make(map[string]*Subscription),
+		lastRefresh: make(map[string]time.Time),
+	}
+}
+
+// Load reads persisted subscriptions, falling back to defaults when nothing
+// has been saved yet. Lists are not fetched; call Sources and the blocker's
+// loaders, or Run, for that.
+func (m *SubscriptionManager) Load(defaults []Subscription) error {
+	subs := defaults
+	if m.path != "" {
+		data, err := os.ReadFile(m.path)
+		switch {
+		case err == nil:
+			subs = nil
+			if err := json.Unmarshal(data, &subs); err != nil {
+				return fmt.Errorf("failed to parse %s: %w", m.path, err)
+			}
+		case !os.IsNotExist(err):
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range subs {
+		sub := subs[i]
+		if err := sub.Validate(); err != nil {
+			return fmt.Errorf("subscription %q: %w", sub.Name, err)
+		}
+		if _, exists := m.subs[sub.Name]; exists {
+			return fmt.Errorf("subscription %q: %w", sub.Name, ErrSubscriptionExists)
+		}
+		m.subs[sub.Name] = &sub
+	}
+	return nil
+}
+
+// List returns all subscriptions sorted by name
+func (m *SubscriptionManager) List() []Subscription {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	subs := make([]Subscription, 0, len(m.subs))
+	for _, sub := range m.subs {
+		subs = append(subs, *sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Name < subs[j].Name })
+	return subs
+}
+
+// Get returns a single subscription
+func (m *SubscriptionManager) Get(name string) (Subscription, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub, ok := m.subs[name]
+	if !ok {
+		return Subscription{}, false
+	}
+	return *sub, true
+}
+
+// Add registers a new subscription and loads it if enabled
+func (m *SubscriptionManager) Add(sub Subscription) error {
+	if err := sub.Validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if _, exists := m.subs[sub.Name]; exists {
+		m.mu.Unlock()
+		return ErrSubscriptionExists
+	}
+	m.subs[sub.Name] = &sub
+	err := m.saveOrRevertLocked(sub.Name, nil)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	m.apply(sub)
+	return nil
+}
+
+// Update replaces an existing subscription. Renaming is not supported.
+func (m *SubscriptionManager) Update(name string, sub Subscription) error {
+	sub.Name = name
+	if err := sub.Validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	prev, exists := m.subs[name]
+	if !exists {
+		m.mu.Unlock()
+		return ErrSubscriptionNotFound
+	}
+	m.subs[name] = &sub
+	err := m.saveOrRevertLocked(name, prev)
+	if err == nil {
+		delete(m.lastRefresh, name)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	m.apply(sub)
+	return nil
+}
+
+// SetEnabled switches a subscription on or off
+func (m *SubscriptionManager) SetEnabled(name string, enabled bool) error {
+	m.mu.Lock()
+	prev, exists := m.subs[name]
+	if !exists {
+		m.mu.Unlock()
+		return ErrSubscriptionNotFound
+	}
+	updated := *prev
+	updated.Enabled = enabled
+	m.subs[name] = &updated
+	err := m.saveOrRevertLocked(name, prev)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Lists that were loaded before keep their data while disabled, so
+	// switching them back on needs no download
+	if m.blocker.SetListEnabled(name, enabled) {
+		return nil
+	}
+	m.apply(updated)
+	return nil
+}
+
+// Remove deletes a subscription and unloads its list
+func (m *SubscriptionManager) Remove(name string) error {
+	m.mu.Lock()
+	prev, exists := m.subs[name]
+	if !exists {
+		m.mu.Unlock()
+		return ErrSubscriptionNotFound
+	}
+	delete(m.subs, name)
+	err := m.saveOrRevertLocked(name, prev)
+	if err == nil {
+		delete(m.lastRefresh, name)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	m.blocker.RemoveList(name)
+	return nil
+}
+
+// Sources returns the name to URL mapping of enabled subscriptions
+func (m *SubscriptionManager) Sources() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sources := make(map[string]string)
+	for name, sub := range m.subs {
+		if sub.Enabled {
+			sources[name] = sub.URL
+		}
+	}
+	return sources
+}
+
+// LoadAll fetches every enabled subscription concurrently
+func (m *SubscriptionManager) LoadAll() error {
+	return m.blocker.loadConcurrently(m.due(time.Time{}))
+}
+
+// Run refreshes subscriptions as their intervals elapse until ctx is
+// cancelled
+func (m *SubscriptionManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			lists := m.due(now)
+			if len(lists) == 0 {
+				continue
+			}
+			log.Printf("Refreshing %d blocklist subscriptions", len(lists))
+			if err := m.blocker.loadConcurrently(lists); err != nil {
+				log.Printf("Blocklist refresh incomplete: %v", err)
+			}
+		}
+	}
+}
+
+// due returns enabled subscriptions whose refresh interval has elapsed at
+// now, marking them as refreshed. A zero now selects every enabled one.
+func (m *SubscriptionManager) due(now time.Time) []listSource {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stamp := now
+	if stamp.IsZero() {
+		stamp = time.Now()
+	}
+
+	lists := make([]listSource, 0)
+	for name, sub := range m.subs {
+		if !sub.Enabled {
+			continue
+		}
+		if !now.IsZero() && now.Sub(m.lastRefresh[name]) < sub.RefreshInterval() {
+			continue
+		}
+		m.lastRefresh[name] = stamp
+		lists = append(lists, listSource{name: name, source: sub.URL, format: sub.Format})
+	}
+	return lists
+}
+
+// apply brings the blocker in line with a changed subscription
+func (m *SubscriptionManager) apply(sub Subscription) {
+	if !sub.Enabled {
+		m.blocker.SetListEnabled(sub.Name, false)
+		return
+	}
+	m.blocker.SetListEnabled(sub.Name, true)
+
+	go func() {
+		if err := m.blocker.LoadList(sub.Name, sub.URL, sub.Format); err != nil {
+			log.Printf("Failed to load blocklist %s: %v", sub.Name, err)
+		}
+	}()
+
+	m.mu.Lock()
+	m.lastRefresh[sub.Name] = time.Now()
+	m.mu.Unlock()
+}
+
+// saveOrRevertLocked persists a change to one subscription. If that fails
+// the subscription is put back the way it was, prev being nil when it did
+// not exist, so that a failed change is not saved along with a later one.
+func (m *SubscriptionManager) saveOrRevertLocked(name string, prev *Subscription) error {
+	err := m.saveLocked()
+	if err != nil {
+		if prev == nil {
+			delete(m.subs, name)
+		} else {
+			m.subs[name] = prev
+		}
+	}
+	return err
+}
+
+// saveLocked persists the subscriptions, must be called with m.mu held
+func (m *SubscriptionManager) saveLocked() error {
+	if m.path == "" {
+		return nil
+	}
+
+	subs := make([]Subscription, 0, len(m.subs))
+	for _, sub := range m.subs {
+		subs = append(subs, *sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Name < subs[j].Name })
+
+	data, err := json.MarshalIndent(subs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		return err
+	}
+	return atomicfile.Write(m.path, data)
+}
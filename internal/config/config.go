@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -15,6 +16,7 @@ func InitConfig() error {
 	pflag.Int("dns-port", 53, "Port for the DNS server")
 	pflag.Int("http-port", 8080, "Port for the HTTP server")
 	pflag.String("config", "", "Config file path")
+	pflag.String("data-dir", "data", "Directory for persisted state such as cached blocklists")
 
 	pflag.Parse()
 
@@ -48,6 +50,7 @@ func InitConfig() error {
 	viper.SetDefault("http.port", 8080)
 	viper.SetDefault("dns.port", 53)
 	viper.SetDefault("config", "")
+	viper.SetDefault("data.dir", "data")
 
 	return nil
 }
@@ -71,3 +74,267 @@ func GetHttpPort() int {
 func GetConfigPath() string {
 	return viper.GetString("config")
 }
+
+func GetDataDir() string {
+	return viper.GetString("data.dir")
+}
+
+func GetLocalResolver() string {
+	return viper.GetString("dns.local_resolver")
+}
+
+func GetHostsFile() string {
+	return viper.GetString("dns.hosts_file")
+}
+
+func GetLeaseFile() string {
+	return viper.GetString("dns.leases.file")
+}
+
+func GetLeaseFormat() string {
+	return viper.GetString("dns.leases.format")
+}
+
+func GetLeaseDomain() string {
+	return viper.GetString("dns.leases.domain")
+}
+
+func GetServeLeases() bool {
+	return viper.GetBool("dns.leases.serve_records")
+}
+
+func GetRebindProtection() bool {
+	return viper.GetBool("dns.rebinding.enabled")
+}
+
+func GetRebindMode() string {
+	return viper.GetString("dns.rebinding.mode")
+}
+
+func GetRebindAllowlist() []string {
+	return viper.GetStringSlice("dns.rebinding.allowlist")
+}
+
+func GetDNS64Prefix() string {
+	return viper.GetString("dns.dns64.prefix")
+}
+
+func GetDNS64Clients() []string {
+	return viper.GetStringSlice("dns.dns64.clients")
+}
+
+func GetTLSListen() string {
+	return viper.GetString("dns.tls.listen")
+}
+
+func GetTLSCertFile() string {
+	return viper.GetString("dns.tls.cert_file")
+}
+
+func GetTLSKeyFile() string {
+	return viper.GetString("dns.tls.key_file")
+}
+
+func GetAllowedClients() []string {
+	return viper.GetStringSlice("dns.access.allowed")
+}
+
+func GetDeniedClients() []string {
+	return viper.GetStringSlice("dns.access.denied")
+}
+
+func GetRefuseAny() bool {
+	return viper.GetBool("dns.refuse_any")
+}
+
+// RateLimitConfig limits how fast each client may query
+type RateLimitConfig struct {
+	QPS        float64
+	Burst      int
+	IPv4Prefix int
+	IPv6Prefix int
+	Action     string
+	Exempt     []string
+}
+
+func GetRateLimit() RateLimitConfig {
+	return RateLimitConfig{
+		QPS:        viper.GetFloat64("dns.rate_limit.qps"),
+		Burst:      viper.GetInt("dns.rate_limit.burst"),
+		IPv4Prefix: viper.GetInt("dns.rate_limit.ipv4_prefix"),
+		IPv6Prefix: viper.GetInt("dns.rate_limit.ipv6_prefix"),
+		Action:     viper.GetString("dns.rate_limit.action"),
+		Exempt:     viper.GetStringSlice("dns.rate_limit.exempt"),
+	}
+}
+
+// BlocklistConfig is a blocklist subscription as written in the config file.
+// Entries may also be plain URL strings.
+type BlocklistConfig struct {
+	Name    string `mapstructure:"name"`
+	URL     string `mapstructure:"url"`
+	Format  string `mapstructure:"format"`
+	Refresh string `mapstructure:"refresh"`
+	Enabled *bool  `mapstructure:"enabled"`
+	Group   string `mapstructure:"group"`
+}
+
+// IsEnabled treats a missing enabled flag as true
+func (c BlocklistConfig) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+func GetBlocklists() ([]BlocklistConfig, error) {
+	raw, ok := viper.Get("blocklists").([]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	lists := make([]BlocklistConfig, 0, len(raw))
+	for i, entry := range raw {
+		if url, ok := entry.(string); ok {
+			lists = append(lists, BlocklistConfig{Name: url, URL: url})
+			continue
+		}
+
+		var list BlocklistConfig
+		if err := mapstructure.Decode(entry, &list); err != nil {
+			return nil, fmt.Errorf("invalid blocklist entry %d: %w", i, err)
+		}
+		if list.Name == "" {
+			list.Name = list.URL
+		}
+		lists = append(lists, list)
+	}
+	return lists, nil
+}
+
+// GroupConfig is a client group as written in the config file
+type GroupConfig struct {
+	Name         string   `mapstructure:"name"`
+	Clients      []string `mapstructure:"clients"`
+	MACs         []string `mapstructure:"macs"`
+	Tokens       []string `mapstructure:"tokens"`
+	Lists        []string `mapstructure:"lists"`
+	Allowlist    []string `mapstructure:"allowlist"`
+	Regexes      []string `mapstructure:"regexes"`
+	Services     []string `mapstructure:"services"`
+	SafeSearch   bool     `mapstructure:"safe_search"`
+	BlockingMode string   `mapstructure:"blocking_mode"`
+	BlockingIP   string   `mapstructure:"blocking_ip"`
+}
+
+func GetGroups() ([]GroupConfig, error) {
+	raw := viper.Get("groups")
+	if raw == nil {
+		return nil, nil
+	}
+
+	var groups []GroupConfig
+	if err := mapstructure.Decode(raw, &groups); err != nil {
+		return nil, fmt.Errorf("invalid groups: %w", err)
+	}
+	return groups, nil
+}
+
+// RecordConfig is a local DNS record as written in the config file
+type RecordConfig struct {
+	Name  string `mapstructure:"name"`
+	Type  string `mapstructure:"type"`
+	Value string `mapstructure:"value"`
+	TTL   uint32 `mapstructure:"ttl"`
+}
+
+func GetRewrites() ([]RecordConfig, error) {
+	raw := viper.Get("rewrites")
+	if raw == nil {
+		return nil, nil
+	}
+
+	var records []RecordConfig
+	if err := mapstructure.Decode(raw, &records); err != nil {
+		return nil, fmt.Errorf("invalid rewrites: %w", err)
+	}
+	return records, nil
+}
+
+// ForwarderConfig sends queries under a domain suffix, or the reverse zones
+// of a CIDR, to their own upstreams
+type ForwarderConfig struct {
+	Suffix       string   `mapstructure:"suffix"`
+	Upstreams    []string `mapstructure:"upstreams"`
+	Strategy     string   `mapstructure:"strategy"`
+	SkipBlocking bool     `mapstructure:"skip_blocking"`
+}
+
+func GetForwarders() ([]ForwarderConfig, error) {
+	raw := viper.Get("dns.forwarders")
+	if raw == nil {
+		return nil, nil
+	}
+
+	var forwarders []ForwarderConfig
+	if err := mapstructure.Decode(raw, &forwarders); err != nil {
+		return nil, fmt.Errorf("invalid forwarders: %w", err)
+	}
+	return forwarders, nil
+}
+
+// QtypePolicyConfig answers some query types with NODATA for the listed
+// client groups, or for everyone
+type QtypePolicyConfig struct {
+	Name   string   `mapstructure:"name"`
+	Types  []string `mapstructure:"types"`
+	Groups []string `mapstructure:"groups"`
+}
+
+func GetQtypePolicies() ([]QtypePolicyConfig, error) {
+	raw := viper.Get("dns.qtype_policies")
+	if raw == nil {
+		return nil, nil
+	}
+
+	var policies []QtypePolicyConfig
+	if err := mapstructure.Decode(raw, &policies); err != nil {
+		return nil, fmt.Errorf("invalid qtype policies: %w", err)
+	}
+	return policies, nil
+}
+
+// DHCPConfig configures the built-in DHCP server
+type DHCPConfig struct {
+	Enabled      bool                `mapstructure:"enabled"`
+	Listen       string              `mapstructure:"listen"`
+	ServerIP     string              `mapstructure:"server_ip"`
+	RangeStart   string              `mapstructure:"range_start"`
+	RangeEnd     string              `mapstructure:"range_end"`
+	SubnetMask   string              `mapstructure:"subnet_mask"`
+	Router       string              `mapstructure:"router"`
+	DNS          []string            `mapstructure:"dns"`
+	Domain       string              `mapstructure:"domain"`
+	LeaseTime    string              `mapstructure:"lease_time"`
+	Reservations []ReservationConfig `mapstructure:"reservations"`
+}
+
+// ReservationConfig pins a client to an address
+type ReservationConfig struct {
+	MAC      string `mapstructure:"mac"`
+	IP       string `mapstructure:"ip"`
+	Hostname string `mapstructure:"hostname"`
+}
+
+func GetDHCP() (DHCPConfig, error) {
+	var dhcp DHCPConfig
+	raw := viper.Get("dhcp")
+	if raw == nil {
+		return dhcp, nil
+	}
+
+	if err := mapstructure.Decode(raw, &dhcp); err != nil {
+		return dhcp, fmt.Errorf("invalid dhcp: %w", err)
+	}
+	if dhcp.Listen == "" {
+		dhcp.Listen = ":67"
+	}
+	return dhcp, nil
+}
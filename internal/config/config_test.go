@@ -123,3 +123,41 @@ http:
 	os.Unsetenv("GOADBLOCK_HTTP_PORT")
 	os.Unsetenv("GOADBLOCK_CONFIG")
 }
+
+func TestBlocklistsFromConfigFile(t *testing.T) {
+	resetViper()
+	configContent := `blocklists:
+  - 'https://example.com/hosts.txt'
+  - name: 'social'
+    url: 'https://example.com/social.txt'
+    format: 'domains'
+    refresh: '12h'
+    enabled: false
+    group: 'social'`
+
+	tmpfile, err := os.CreateTemp("", "config*.yaml")
+	assert.NoError(t, err, "Should create temp file")
+	defer os.Remove(tmpfile.Name())
+
+	_, err = tmpfile.WriteString(configContent)
+	assert.NoError(t, err, "Should write to temp file")
+	tmpfile.Close()
+
+	os.Setenv("GOADBLOCK_CONFIG", tmpfile.Name())
+	defer os.Unsetenv("GOADBLOCK_CONFIG")
+
+	err = InitConfig()
+	assert.NoError(t, err)
+
+	lists, err := GetBlocklists()
+	assert.NoError(t, err)
+	assert.Len(t, lists, 2)
+
+	assert.Equal(t, "https://example.com/hosts.txt", lists[0].Name)
+	assert.True(t, lists[0].IsEnabled())
+
+	assert.Equal(t, "social", lists[1].Name)
+	assert.Equal(t, "domains", lists[1].Format)
+	assert.Equal(t, "12h", lists[1].Refresh)
+	assert.False(t, lists[1].IsEnabled())
+}
@@ -0,0 +1,166 @@
+package dhcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/vivek-pk/goadblock/internal/atomicfile"
+)
+
+// Lease is an address handed to a client
+type Lease struct {
+	IP       string    `json:"ip"`
+	MAC      string    `json:"mac"`
+	Hostname string    `json:"hostname,omitempty"`
+	Expires  time.Time `json:"expires"`
+	Static   bool      `json:"static,omitempty"` // Handed out from a reservation
+}
+
+// expired reports whether the lease has run out at now
+func (l Lease) expired(now time.Time) bool {
+	return !now.Before(l.Expires)
+}
+
+// leaseStore holds one lease per client, expired ones included so that
+// returning clients get their old address back, and persists them. It is
+// guarded by the server's mutex.
+type leaseStore struct {
+	path  string
+	byMAC map[string]Lease
+	ips   map[string]string // Address to MAC
+}
+
+func newLeaseStore(path string) *leaseStore {
+	return &leaseStore{
+		path:  path,
+		byMAC: make(map[string]Lease),
+		ips:   make(map[string]string),
+	}
+}
+
+// load reads persisted leases, if any
+func (l *leaseStore) load() error {
+	if l.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var leases []Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", l.path, err)
+	}
+	for _, lease := range leases {
+		l.put(lease)
+	}
+	return nil
+}
+
+// save persists every lease
+func (l *leaseStore) save() error {
+	if l.path == "" {
+		return nil
+	}
+
+	leases := make([]Lease, 0, len(l.byMAC))
+	for _, lease := range l.byMAC {
+		leases = append(leases, lease)
+	}
+	sortLeases(leases)
+
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return err
+	}
+
+	return atomicfile.Write(l.path, data)
+}
+
+// put stores a lease, replacing the client's previous one and any other
+// client's lease on the same address
+func (l *leaseStore) put(lease Lease) {
+	if old, ok := l.byMAC[lease.MAC]; ok {
+		delete(l.ips, old.IP)
+	}
+	if other, ok := l.ips[lease.IP]; ok {
+		delete(l.byMAC, other)
+	}
+	l.byMAC[lease.MAC] = lease
+	l.ips[lease.IP] = lease.MAC
+}
+
+// remove deletes a client's lease on ip, reporting whether there was one
+func (l *leaseStore) remove(mac, ip string) bool {
+	lease, ok := l.byMAC[mac]
+	if !ok || lease.IP != ip {
+		return false
+	}
+	delete(l.byMAC, mac)
+	delete(l.ips, ip)
+	return true
+}
+
+// release ends a client's lease on ip now, keeping the address associated
+// with the client for its next request
+func (l *leaseStore) release(mac, ip string, now time.Time) bool {
+	lease, ok := l.byMAC[mac]
+	if !ok || lease.IP != ip || lease.expired(now) {
+		return false
+	}
+	lease.Expires = now
+	l.byMAC[mac] = lease
+	return true
+}
+
+func (l *leaseStore) forMAC(mac string) (Lease, bool) {
+	lease, ok := l.byMAC[mac]
+	return lease, ok
+}
+
+func (l *leaseStore) forIP(ip string) (Lease, bool) {
+	mac, ok := l.ips[ip]
+	if !ok {
+		return Lease{}, false
+	}
+	return l.byMAC[mac], true
+}
+
+// oldestExpired returns the lease that ran out longest ago
+func (l *leaseStore) oldestExpired(now time.Time) (Lease, bool) {
+	var oldest Lease
+	found := false
+	for _, lease := range l.byMAC {
+		if lease.expired(now) && (!found || lease.Expires.Before(oldest.Expires)) {
+			oldest, found = lease, true
+		}
+	}
+	return oldest, found
+}
+
+// active returns the leases that have not run out, sorted by address
+func (l *leaseStore) active(now time.Time) []Lease {
+	leases := make([]Lease, 0, len(l.byMAC))
+	for _, lease := range l.byMAC {
+		if !lease.expired(now) {
+			leases = append(leases, lease)
+		}
+	}
+	sortLeases(leases)
+	return leases
+}
+
+func sortLeases(leases []Lease) {
+	sort.Slice(leases, func(i, j int) bool { return compareIP(leases[i].IP, leases[j].IP) < 0 })
+}
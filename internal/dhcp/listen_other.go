@@ -0,0 +1,11 @@
+//go:build !unix
+
+package dhcp
+
+import "net"
+
+// listen opens the server socket. Broadcast replies depend on the
+// platform's defaults here.
+func listen(addr string) (net.PacketConn, error) {
+	return net.ListenPacket("udp4", addr)
+}
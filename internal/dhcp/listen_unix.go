@@ -0,0 +1,27 @@
+//go:build unix
+
+package dhcp
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// listen opens the server socket with broadcast enabled, so that replies
+// reach clients that have no address yet
+func listen(addr string) (net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return lc.ListenPacket(context.Background(), "udp4", addr)
+}
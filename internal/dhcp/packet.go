@@ -0,0 +1,214 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// BOOTP operations
+const (
+	opRequest = 1
+	opReply   = 2
+)
+
+// DHCP message types, option 53
+const (
+	MsgDiscover = 1
+	MsgOffer    = 2
+	MsgRequest  = 3
+	MsgDecline  = 4
+	MsgAck      = 5
+	MsgNak      = 6
+	MsgRelease  = 7
+	MsgInform   = 8
+)
+
+// DHCP options used by the server
+const (
+	OptPad           = 0
+	OptSubnetMask    = 1
+	OptRouter        = 3
+	OptDNS           = 6
+	OptHostname      = 12
+	OptDomainName    = 15
+	OptRequestedIP   = 50
+	OptLeaseTime     = 51
+	OptMessageType   = 53
+	OptServerID      = 54
+	OptParamRequest  = 55
+	OptMessage       = 56
+	OptRenewalTime   = 58
+	OptRebindingTime = 59
+	OptClientID      = 61
+	OptEnd           = 255
+)
+
+// headerLen is the fixed BOOTP header up to the options, including the
+// magic cookie
+const headerLen = 240
+
+// minPacketLen is the smallest packet BOOTP relays and old clients accept
+const minPacketLen = 300
+
+// broadcastFlag asks for replies to be broadcast, for clients that cannot
+// receive unicast before they are configured
+const broadcastFlag = 0x8000
+
+var magicCookie = [4]byte{99, 130, 83, 99}
+
+// Packet is a DHCPv4 message. Options hold the raw option values by code;
+// options split over several instances are joined when parsing.
+type Packet struct {
+	Op      byte
+	HType   byte
+	HLen    byte
+	Hops    byte
+	XID     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	Options map[byte][]byte
+}
+
+// ParsePacket decodes a DHCPv4 message
+func ParsePacket(b []byte) (*Packet, error) {
+	if len(b) < headerLen {
+		return nil, fmt.Errorf("packet too short: %d bytes", len(b))
+	}
+	if [4]byte(b[236:240]) != magicCookie {
+		return nil, errors.New("missing DHCP magic cookie")
+	}
+
+	p := &Packet{
+		Op:      b[0],
+		HType:   b[1],
+		HLen:    b[2],
+		Hops:    b[3],
+		XID:     binary.BigEndian.Uint32(b[4:8]),
+		Secs:    binary.BigEndian.Uint16(b[8:10]),
+		Flags:   binary.BigEndian.Uint16(b[10:12]),
+		CIAddr:  net.IP(append([]byte(nil), b[12:16]...)),
+		YIAddr:  net.IP(append([]byte(nil), b[16:20]...)),
+		SIAddr:  net.IP(append([]byte(nil), b[20:24]...)),
+		GIAddr:  net.IP(append([]byte(nil), b[24:28]...)),
+		Options: make(map[byte][]byte),
+	}
+	if p.HLen > 16 {
+		return nil, fmt.Errorf("invalid hardware address length %d", p.HLen)
+	}
+	p.CHAddr = net.HardwareAddr(append([]byte(nil), b[28:28+p.HLen]...))
+
+	opts := b[headerLen:]
+	for i := 0; i < len(opts); {
+		code := opts[i]
+		switch code {
+		case OptPad:
+			i++
+			continue
+		case OptEnd:
+			return p, nil
+		}
+		if i+1 >= len(opts) {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		n := int(opts[i+1])
+		if i+2+n > len(opts) {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		p.Options[code] = append(p.Options[code], opts[i+2:i+2+n]...)
+		i += 2 + n
+	}
+	return nil, errors.New("options are not terminated")
+}
+
+// Marshal encodes the message, padding it to the BOOTP minimum size.
+// Options are written in code order after the message type.
+func (p *Packet) Marshal() []byte {
+	b := make([]byte, headerLen, minPacketLen)
+	b[0], b[1], b[2], b[3] = p.Op, p.HType, p.HLen, p.Hops
+	binary.BigEndian.PutUint32(b[4:8], p.XID)
+	binary.BigEndian.PutUint16(b[8:10], p.Secs)
+	binary.BigEndian.PutUint16(b[10:12], p.Flags)
+	copy(b[12:16], p.CIAddr.To4())
+	copy(b[16:20], p.YIAddr.To4())
+	copy(b[20:24], p.SIAddr.To4())
+	copy(b[24:28], p.GIAddr.To4())
+	copy(b[28:44], p.CHAddr)
+	copy(b[236:240], magicCookie[:])
+
+	codes := make([]int, 0, len(p.Options))
+	for code := range p.Options {
+		if code != OptMessageType {
+			codes = append(codes, int(code))
+		}
+	}
+	sort.Ints(codes)
+	if _, ok := p.Options[OptMessageType]; ok {
+		codes = append([]int{OptMessageType}, codes...)
+	}
+
+	for _, code := range codes {
+		value := p.Options[byte(code)]
+		// Values over 255 bytes are split into consecutive instances
+		for first := true; first || len(value) > 0; first = false {
+			n := len(value)
+			if n > 255 {
+				n = 255
+			}
+			b = append(b, byte(code), byte(n))
+			b = append(b, value[:n]...)
+			value = value[n:]
+		}
+	}
+	b = append(b, OptEnd)
+
+	for len(b) < minPacketLen {
+		b = append(b, OptPad)
+	}
+	return b
+}
+
+// MessageType returns the value of option 53, 0 when it is missing
+func (p *Packet) MessageType() byte {
+	if v := p.Options[OptMessageType]; len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+// IPOption returns an option holding a single IPv4 address
+func (p *Packet) IPOption(code byte) net.IP {
+	if v := p.Options[code]; len(v) == net.IPv4len {
+		return net.IP(v)
+	}
+	return nil
+}
+
+// SetIPs sets an option to a list of IPv4 addresses
+func (p *Packet) SetIPs(code byte, ips ...net.IP) {
+	value := make([]byte, 0, len(ips)*net.IPv4len)
+	for _, ip := range ips {
+		value = append(value, ip.To4()...)
+	}
+	p.Options[code] = value
+}
+
+// SetDuration sets an option to a time in whole seconds
+func (p *Packet) SetDuration(code byte, d time.Duration) {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(d/time.Second))
+	p.Options[code] = value
+}
+
+// Broadcast reports whether the client asked for broadcast replies
+func (p *Packet) Broadcast() bool {
+	return p.Flags&broadcastFlag != 0
+}
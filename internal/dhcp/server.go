@@ -0,0 +1,517 @@
+// Package dhcp implements a small DHCPv4 server that hands out addresses
+// from a single range, with static reservations, and points clients at
+// GoAdBlock for DNS.
+package dhcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ports clients and servers (or relays) listen on
+const (
+	ServerPort = 67
+	ClientPort = 68
+)
+
+const (
+	defaultLeaseTime = 24 * time.Hour
+
+	// offerTimeout is how long an offered address is held for a client
+	// that has not requested it yet
+	offerTimeout = time.Minute
+
+	// declineHold keeps declined addresses, which are likely in use by a
+	// host the server doesn't know about, out of the pool
+	declineHold = 10 * time.Minute
+)
+
+// Reservation binds a MAC address to a fixed address, optionally with a
+// hostname that overrides the one the client sends
+type Reservation struct {
+	MAC      string `json:"mac"`
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// Config describes the network the server hands out addresses on
+type Config struct {
+	ServerIP     net.IP        // This host's address on the network, the DHCP server identifier
+	RangeStart   net.IP        // First address of the dynamic pool
+	RangeEnd     net.IP        // Last address of the dynamic pool
+	SubnetMask   net.IPMask    // Netmask handed to clients
+	Router       net.IP        // Default gateway, none when nil
+	DNS          []net.IP      // DNS servers handed to clients, ServerIP when empty
+	Domain       string        // Domain name handed to clients
+	LeaseTime    time.Duration // 24 hours when zero
+	Reservations []Reservation
+}
+
+// validate checks the config and fills in defaults
+func (c *Config) validate() error {
+	for name, ip := range map[string]net.IP{"server IP": c.ServerIP, "range start": c.RangeStart, "range end": c.RangeEnd} {
+		if ip.To4() == nil {
+			return fmt.Errorf("%s must be an IPv4 address", name)
+		}
+	}
+	c.ServerIP, c.RangeStart, c.RangeEnd = c.ServerIP.To4(), c.RangeStart.To4(), c.RangeEnd.To4()
+
+	if len(c.SubnetMask) == 0 {
+		c.SubnetMask = c.ServerIP.DefaultMask()
+	}
+	if ones, bits := c.SubnetMask.Size(); bits != 32 || ones == 0 {
+		return errors.New("subnet mask must be an IPv4 netmask")
+	}
+	subnet := &net.IPNet{IP: c.ServerIP.Mask(c.SubnetMask), Mask: c.SubnetMask}
+
+	if ipToInt(c.RangeStart) > ipToInt(c.RangeEnd) {
+		return fmt.Errorf("range %s-%s is empty", c.RangeStart, c.RangeEnd)
+	}
+	if !subnet.Contains(c.RangeStart) || !subnet.Contains(c.RangeEnd) {
+		return fmt.Errorf("range %s-%s is outside %s", c.RangeStart, c.RangeEnd, subnet)
+	}
+	if c.Router != nil {
+		if c.Router = c.Router.To4(); c.Router == nil {
+			return errors.New("router must be an IPv4 address")
+		}
+	}
+	if len(c.DNS) == 0 {
+		c.DNS = []net.IP{c.ServerIP}
+	}
+	for i, ip := range c.DNS {
+		if c.DNS[i] = ip.To4(); c.DNS[i] == nil {
+			return fmt.Errorf("DNS server %s must be an IPv4 address", ip)
+		}
+	}
+	if c.LeaseTime <= 0 {
+		c.LeaseTime = defaultLeaseTime
+	}
+
+	seenMAC := make(map[string]bool)
+	seenIP := make(map[string]bool)
+	for i, r := range c.Reservations {
+		mac, err := net.ParseMAC(r.MAC)
+		if err != nil {
+			return fmt.Errorf("reservation %d: %w", i, err)
+		}
+		ip := net.ParseIP(r.IP).To4()
+		if ip == nil || !subnet.Contains(ip) {
+			return fmt.Errorf("reservation %d: %q is not an address in %s", i, r.IP, subnet)
+		}
+		if ip.Equal(c.ServerIP) || ip.Equal(c.Router) {
+			return fmt.Errorf("reservation %d: %s is taken by the server or router", i, ip)
+		}
+		r.MAC, r.IP, r.Hostname = mac.String(), ip.String(), hostname(r.Hostname)
+		if seenMAC[r.MAC] || seenIP[r.IP] {
+			return fmt.Errorf("reservation %d: %s or %s is reserved twice", i, r.MAC, r.IP)
+		}
+		seenMAC[r.MAC], seenIP[r.IP] = true, true
+		c.Reservations[i] = r
+	}
+	return nil
+}
+
+// Server is a DHCPv4 server for a single subnet
+type Server struct {
+	config Config
+
+	// Reservations by MAC and by address
+	reserved   map[string]Reservation
+	reservedIP map[string]string
+
+	leases   *leaseStore
+	offers   map[string]offer     // Pending offers by MAC
+	declined map[string]time.Time // Declined addresses and when they return to the pool
+	clock    func() time.Time
+
+	mu       sync.Mutex
+	onChange func([]Lease)
+
+	conn net.PacketConn
+}
+
+// offer is an address offered to a client that has not requested it yet
+type offer struct {
+	ip      string
+	expires time.Time
+}
+
+// NewServer creates a DHCP server persisting its leases to path. An empty
+// path keeps leases in memory only.
+func NewServer(config Config, path string) (*Server, error) {
+	config.Reservations = append([]Reservation(nil), config.Reservations...)
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		config:     config,
+		reserved:   make(map[string]Reservation),
+		reservedIP: make(map[string]string),
+		leases:     newLeaseStore(path),
+		offers:     make(map[string]offer),
+		declined:   make(map[string]time.Time),
+		clock:      time.Now,
+	}
+	for _, r := range config.Reservations {
+		s.reserved[r.MAC] = r
+		s.reservedIP[r.IP] = r.MAC
+	}
+	return s, nil
+}
+
+// Load reads persisted leases
+func (s *Server) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leases.load()
+}
+
+// OnChange registers fn to be called with the active leases whenever they
+// change, and once straight away
+func (s *Server) OnChange(fn func([]Lease)) {
+	s.mu.Lock()
+	s.onChange = fn
+	leases := s.leases.active(s.clock())
+	s.mu.Unlock()
+
+	fn(leases)
+}
+
+// Leases returns the active leases sorted by address
+func (s *Server) Leases() []Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leases.active(s.clock())
+}
+
+// Reservations returns the static reservations
+func (s *Server) Reservations() []Reservation {
+	return append([]Reservation(nil), s.config.Reservations...)
+}
+
+// Start listens on addr, usually ":67", and serves until Shutdown
+func (s *Server) Start(addr string) error {
+	conn, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Serve answers DHCP requests arriving on conn until Shutdown or a read
+// error
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		req, err := ParsePacket(buf[:n])
+		if err != nil || req.Op != opRequest {
+			continue
+		}
+		reply := s.handle(req)
+		if reply == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(reply.Marshal(), replyAddr(req, reply, peer)); err != nil {
+			log.Printf("Failed to send DHCP reply to %s: %v", reply.CHAddr, err)
+		}
+	}
+}
+
+// Shutdown stops serving
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// replyAddr picks where a reply goes (RFC 2131 section 4.1): back to the
+// relay, to a configured client, to a client that sent from an address
+// already, or broadcast to a client without one
+func replyAddr(req, reply *Packet, peer net.Addr) net.Addr {
+	if !req.GIAddr.IsUnspecified() {
+		return &net.UDPAddr{IP: req.GIAddr, Port: ServerPort}
+	}
+	if !req.CIAddr.IsUnspecified() {
+		return &net.UDPAddr{IP: req.CIAddr, Port: ClientPort}
+	}
+	if udp, ok := peer.(*net.UDPAddr); ok && !udp.IP.IsUnspecified() && !req.Broadcast() && reply.MessageType() != MsgNak {
+		return udp
+	}
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: ClientPort}
+}
+
+// handle processes a request and returns the reply, nil when there is
+// none to send
+func (s *Server) handle(req *Packet) *Packet {
+	if req.HType != 1 || req.HLen != 6 {
+		return nil
+	}
+	mac := req.CHAddr.String()
+
+	s.mu.Lock()
+	reply, changed := s.handleLocked(req, mac)
+	var leases []Lease
+	if changed {
+		if err := s.leases.save(); err != nil {
+			log.Printf("Failed to save DHCP leases: %v", err)
+		}
+		leases = s.leases.active(s.clock())
+	}
+	onChange := s.onChange
+	s.mu.Unlock()
+
+	if changed && onChange != nil {
+		onChange(leases)
+	}
+	return reply
+}
+
+func (s *Server) handleLocked(req *Packet, mac string) (reply *Packet, changed bool) {
+	now := s.clock()
+
+	switch req.MessageType() {
+	case MsgDiscover:
+		ip := s.allocateLocked(mac, req.IPOption(OptRequestedIP), now)
+		if ip == nil {
+			log.Printf("DHCP pool exhausted, no address for %s", mac)
+			return nil, false
+		}
+		s.offers[mac] = offer{ip: ip.String(), expires: now.Add(offerTimeout)}
+		return s.replyLocked(req, MsgOffer, ip), false
+
+	case MsgRequest:
+		// A request naming another server declines our offer
+		if id := req.IPOption(OptServerID); id != nil && !id.Equal(s.config.ServerIP) {
+			delete(s.offers, mac)
+			return nil, false
+		}
+
+		ip := req.IPOption(OptRequestedIP)
+		if ip == nil {
+			ip = req.CIAddr.To4()
+		}
+		if ip == nil || ip.IsUnspecified() || !s.availableLocked(mac, ip, now) {
+			return s.nak(req, "requested address is not available"), false
+		}
+
+		delete(s.offers, mac)
+		name := hostname(string(req.Options[OptHostname]))
+		if r, ok := s.reserved[mac]; ok && r.Hostname != "" {
+			name = r.Hostname
+		}
+		_, static := s.reserved[mac]
+		s.leases.put(Lease{
+			IP:       ip.String(),
+			MAC:      mac,
+			Hostname: name,
+			Expires:  now.Add(s.config.LeaseTime),
+			Static:   static,
+		})
+		return s.replyLocked(req, MsgAck, ip), true
+
+	case MsgDecline:
+		ip := req.IPOption(OptRequestedIP)
+		if ip == nil {
+			return nil, false
+		}
+		log.Printf("DHCP client %s declined %s, holding it back", mac, ip)
+		s.declined[ip.String()] = now.Add(declineHold)
+		return nil, s.leases.remove(mac, ip.String())
+
+	case MsgRelease:
+		return nil, s.leases.release(mac, req.CIAddr.String(), now)
+
+	case MsgInform:
+		reply := s.replyLocked(req, MsgAck, nil)
+		delete(reply.Options, OptLeaseTime)
+		delete(reply.Options, OptRenewalTime)
+		delete(reply.Options, OptRebindingTime)
+		return reply, false
+	}
+	return nil, false
+}
+
+// allocateLocked picks an address for a client: its reservation, its
+// previous address, the address it asked for, then the first free one
+func (s *Server) allocateLocked(mac string, requested net.IP, now time.Time) net.IP {
+	if r, ok := s.reserved[mac]; ok {
+		return net.ParseIP(r.IP).To4()
+	}
+	if lease, ok := s.leases.forMAC(mac); ok {
+		if ip := net.ParseIP(lease.IP).To4(); s.availableLocked(mac, ip, now) {
+			return ip
+		}
+	}
+	if requested != nil && s.inRange(requested) && s.availableLocked(mac, requested, now) {
+		return requested.To4()
+	}
+
+	start, end := ipToInt(s.config.RangeStart), ipToInt(s.config.RangeEnd)
+	for n := start; n <= end && n >= start; n++ {
+		if ip := intToIP(n); s.availableLocked(mac, ip, now) {
+			return ip
+		}
+	}
+
+	// Reuse the address whose lease ran out longest ago
+	if lease, ok := s.leases.oldestExpired(now); ok {
+		if ip := net.ParseIP(lease.IP).To4(); s.inRange(ip) {
+			s.leases.remove(lease.MAC, lease.IP)
+			return ip
+		}
+	}
+	return nil
+}
+
+// availableLocked reports whether ip may be leased to mac: it is in the
+// pool or reserved for mac, and no one else holds, is offered or has
+// reserved it
+func (s *Server) availableLocked(mac string, ip net.IP, now time.Time) bool {
+	ip = ip.To4()
+	if ip == nil || ip.Equal(s.config.ServerIP) || ip.Equal(s.config.Router) {
+		return false
+	}
+	key := ip.String()
+
+	if owner, ok := s.reservedIP[key]; ok {
+		return owner == mac
+	}
+	if r, ok := s.reserved[mac]; ok && r.IP != key {
+		return false
+	}
+	if !s.inRange(ip) {
+		return false
+	}
+	if until, ok := s.declined[key]; ok {
+		if now.Before(until) {
+			return false
+		}
+		delete(s.declined, key)
+	}
+	if lease, ok := s.leases.forIP(key); ok && lease.MAC != mac && !lease.expired(now) {
+		return false
+	}
+	for other, o := range s.offers {
+		if o.ip == key && other != mac && now.Before(o.expires) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) inRange(ip net.IP) bool {
+	n := ipToInt(ip)
+	return ip.To4() != nil && n >= ipToInt(s.config.RangeStart) && n <= ipToInt(s.config.RangeEnd)
+}
+
+// replyLocked builds an OFFER or ACK for ip with the network options
+func (s *Server) replyLocked(req *Packet, msgType byte, ip net.IP) *Packet {
+	reply := s.newReply(req, msgType)
+	if ip != nil {
+		reply.YIAddr = ip
+	}
+
+	lease := s.config.LeaseTime
+	reply.SetDuration(OptLeaseTime, lease)
+	reply.SetDuration(OptRenewalTime, lease/2)
+	reply.SetDuration(OptRebindingTime, lease*7/8)
+	reply.Options[OptSubnetMask] = []byte(s.config.SubnetMask)
+	reply.SetIPs(OptDNS, s.config.DNS...)
+	if s.config.Router != nil {
+		reply.SetIPs(OptRouter, s.config.Router)
+	}
+	if s.config.Domain != "" {
+		reply.Options[OptDomainName] = []byte(s.config.Domain)
+	}
+	return reply
+}
+
+func (s *Server) nak(req *Packet, message string) *Packet {
+	reply := s.newReply(req, MsgNak)
+	reply.Options[OptMessage] = []byte(message)
+	return reply
+}
+
+func (s *Server) newReply(req *Packet, msgType byte) *Packet {
+	reply := &Packet{
+		Op:      opReply,
+		HType:   req.HType,
+		HLen:    req.HLen,
+		XID:     req.XID,
+		Flags:   req.Flags,
+		CIAddr:  net.IPv4zero,
+		YIAddr:  net.IPv4zero,
+		SIAddr:  net.IPv4zero,
+		GIAddr:  req.GIAddr,
+		CHAddr:  req.CHAddr,
+		Options: map[byte][]byte{OptMessageType: {msgType}},
+	}
+	reply.SetIPs(OptServerID, s.config.ServerIP)
+	if msgType == MsgAck && req.MessageType() == MsgInform {
+		reply.CIAddr = req.CIAddr
+	}
+	return reply
+}
+
+// hostname returns a client-supplied hostname if it is usable as a single
+// DNS label, lowercased
+func hostname(name string) string {
+	name = strings.ToLower(strings.TrimRight(name, "\x00"))
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	if name == "" || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' {
+		return ""
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return ""
+		}
+	}
+	return name
+}
+
+func ipToInt(ip net.IP) uint32 {
+	ip = ip.To4()
+	if ip == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip)
+}
+
+func intToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// compareIP orders addresses numerically
+func compareIP(a, b string) int {
+	return bytes.Compare(net.ParseIP(a).To16(), net.ParseIP(b).To16())
+}
@@ -0,0 +1,314 @@
+package dhcp
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClient stands in for a DHCP client, talking to the server over
+// loopback
+type testClient struct {
+	t      *testing.T
+	conn   net.PacketConn
+	server net.Addr
+	mac    net.HardwareAddr
+	xid    uint32
+}
+
+func startTestServer(t *testing.T, config Config, path string) (*Server, net.Addr) {
+	t.Helper()
+
+	server, err := NewServer(config, path)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := server.Load(); err != nil {
+		t.Fatalf("Failed to load leases: %v", err)
+	}
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+	return server, conn.LocalAddr()
+}
+
+func newTestClient(t *testing.T, server net.Addr, mac string) *testClient {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, conn: conn, server: server, mac: hw, xid: 0x1234}
+}
+
+// packet builds a client message
+func (c *testClient) packet(msgType byte, options map[byte][]byte) *Packet {
+	c.xid++
+	req := &Packet{
+		Op:      opRequest,
+		HType:   1,
+		HLen:    6,
+		XID:     c.xid,
+		CIAddr:  net.IPv4zero,
+		YIAddr:  net.IPv4zero,
+		SIAddr:  net.IPv4zero,
+		GIAddr:  net.IPv4zero,
+		CHAddr:  c.mac,
+		Options: map[byte][]byte{OptMessageType: {msgType}},
+	}
+	for code, value := range options {
+		req.Options[code] = value
+	}
+	return req
+}
+
+// send sends a message and returns the reply, nil when none arrives
+func (c *testClient) send(msgType byte, options map[byte][]byte) *Packet {
+	c.t.Helper()
+
+	req := c.packet(msgType, options)
+	if _, err := c.conn.WriteTo(req.Marshal(), c.server); err != nil {
+		c.t.Fatal(err)
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, 1500)
+	n, _, err := c.conn.ReadFrom(buf)
+	if err != nil {
+		return nil
+	}
+	reply, err := ParsePacket(buf[:n])
+	if err != nil {
+		c.t.Fatalf("Failed to parse reply: %v", err)
+	}
+	if reply.XID != c.xid {
+		c.t.Fatalf("Expected transaction %x, got %x", c.xid, reply.XID)
+	}
+	return reply
+}
+
+// lease runs a DISCOVER and REQUEST exchange and returns the address
+func (c *testClient) lease(hostname string) net.IP {
+	c.t.Helper()
+
+	offer := c.send(MsgDiscover, nil)
+	if offer == nil || offer.MessageType() != MsgOffer {
+		c.t.Fatalf("Expected an offer, got %+v", offer)
+	}
+
+	ack := c.send(MsgRequest, map[byte][]byte{
+		OptRequestedIP: offer.YIAddr.To4(),
+		OptServerID:    offer.IPOption(OptServerID),
+		OptHostname:    []byte(hostname),
+	})
+	if ack == nil || ack.MessageType() != MsgAck {
+		c.t.Fatalf("Expected an ACK, got %+v", ack)
+	}
+	if !ack.YIAddr.Equal(offer.YIAddr) {
+		c.t.Fatalf("Expected %s to be acknowledged, got %s", offer.YIAddr, ack.YIAddr)
+	}
+	return ack.YIAddr
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	p := &Packet{
+		Op:      opReply,
+		HType:   1,
+		HLen:    6,
+		XID:     42,
+		Flags:   broadcastFlag,
+		CIAddr:  net.IPv4zero,
+		YIAddr:  net.ParseIP("192.168.1.100"),
+		SIAddr:  net.IPv4zero,
+		GIAddr:  net.IPv4zero,
+		CHAddr:  net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		Options: map[byte][]byte{OptMessageType: {MsgOffer}, OptDomainName: make([]byte, 300)},
+	}
+	p.SetIPs(OptDNS, net.ParseIP("192.168.1.2"), net.ParseIP("192.168.1.3"))
+
+	b := p.Marshal()
+	if len(b) < minPacketLen {
+		t.Errorf("Expected at least %d bytes, got %d", minPacketLen, len(b))
+	}
+	if b[headerLen] != OptMessageType {
+		t.Errorf("Expected the message type to come first, got option %d", b[headerLen])
+	}
+
+	parsed, err := ParsePacket(b)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if parsed.MessageType() != MsgOffer || !parsed.YIAddr.Equal(p.YIAddr) || parsed.CHAddr.String() != p.CHAddr.String() {
+		t.Errorf("Round trip changed the packet: %+v", parsed)
+	}
+	if len(parsed.Options[OptDomainName]) != 300 || len(parsed.Options[OptDNS]) != 8 {
+		t.Errorf("Expected long options to be split and joined, got %v", parsed.Options)
+	}
+
+	if _, err := ParsePacket(b[:headerLen+2]); err == nil {
+		t.Error("Expected a truncated packet to be rejected")
+	}
+}
+
+func TestServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcp_leases.json")
+	config := Config{
+		ServerIP:   net.ParseIP("192.168.1.2"),
+		RangeStart: net.ParseIP("192.168.1.100"),
+		RangeEnd:   net.ParseIP("192.168.1.102"),
+		SubnetMask: net.CIDRMask(24, 32),
+		Router:     net.ParseIP("192.168.1.1"),
+		Domain:     "lan",
+		LeaseTime:  time.Hour,
+		Reservations: []Reservation{
+			{MAC: "aa:bb:cc:00:00:01", IP: "192.168.1.10", Hostname: "nas"},
+		},
+	}
+	server, addr := startTestServer(t, config, path)
+
+	var mu sync.Mutex
+	var changes [][]Lease
+	server.OnChange(func(leases []Lease) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, leases)
+	})
+
+	laptop := newTestClient(t, addr, "00:11:22:33:44:55")
+	offer := laptop.send(MsgDiscover, nil)
+	if offer == nil || !offer.YIAddr.Equal(net.ParseIP("192.168.1.100")) {
+		t.Fatalf("Expected the first pool address to be offered, got %+v", offer)
+	}
+	if dns := offer.IPOption(OptDNS); !dns.Equal(config.ServerIP) {
+		t.Errorf("Expected this host as the DNS server, got %v", offer.Options[OptDNS])
+	}
+	if router := offer.IPOption(OptRouter); !router.Equal(config.Router) {
+		t.Errorf("Expected the router option, got %v", offer.Options[OptRouter])
+	}
+	if mask := offer.Options[OptSubnetMask]; net.IP(mask).String() != "255.255.255.0" {
+		t.Errorf("Expected a /24 netmask, got %v", mask)
+	}
+
+	// A second client is not offered the address held for the first
+	phone := newTestClient(t, addr, "00:11:22:33:44:66")
+	if ip := phone.lease("Phone"); !ip.Equal(net.ParseIP("192.168.1.101")) {
+		t.Errorf("Expected the next free address, got %s", ip)
+	}
+	if ip := laptop.lease("laptop.example.com"); !ip.Equal(net.ParseIP("192.168.1.100")) {
+		t.Errorf("Expected the offered address, got %s", ip)
+	}
+
+	// Reservations win over the pool and name the client
+	nas := newTestClient(t, addr, "aa:bb:cc:00:00:01")
+	if ip := nas.lease("diskstation"); !ip.Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("Expected the reserved address, got %s", ip)
+	}
+
+	leases := server.Leases()
+	want := map[string]string{"192.168.1.10": "nas", "192.168.1.100": "laptop", "192.168.1.101": "phone"}
+	if len(leases) != len(want) {
+		t.Fatalf("Expected %d leases, got %+v", len(want), leases)
+	}
+	for _, lease := range leases {
+		if want[lease.IP] != lease.Hostname {
+			t.Errorf("Expected %s to be named %q, got %q", lease.IP, want[lease.IP], lease.Hostname)
+		}
+	}
+	mu.Lock()
+	if len(changes) != 4 || len(changes[3]) != 3 {
+		t.Errorf("Expected a change notification per lease, got %d", len(changes))
+	}
+	mu.Unlock()
+
+	// Someone else's address is refused. NAKs are broadcast, so they are
+	// checked without the network.
+	intruder := newTestClient(t, addr, "00:11:22:33:44:77")
+	for _, ip := range []string{"192.168.1.100", "192.168.1.10", "10.0.0.5"} {
+		req := intruder.packet(MsgRequest, map[byte][]byte{OptRequestedIP: net.ParseIP(ip).To4()})
+		if nak := server.handle(req); nak == nil || nak.MessageType() != MsgNak {
+			t.Errorf("Expected a NAK for %s, got %+v", ip, nak)
+		}
+		if to := replyAddr(req, &Packet{Options: map[byte][]byte{OptMessageType: {MsgNak}}}, nil); to.String() != "255.255.255.255:68" {
+			t.Errorf("Expected NAKs to be broadcast, sent to %s", to)
+		}
+	}
+	if offer := intruder.send(MsgDiscover, nil); offer == nil || !offer.YIAddr.Equal(net.ParseIP("192.168.1.102")) {
+		t.Errorf("Expected the last pool address, got %+v", offer)
+	}
+	guest := newTestClient(t, addr, "00:11:22:33:44:88")
+	if offer := guest.send(MsgDiscover, nil); offer != nil {
+		t.Errorf("Expected no offer from an exhausted pool, got %+v", offer)
+	}
+
+	// Requests for another server's offer are not answered
+	if reply := guest.send(MsgRequest, map[byte][]byte{
+		OptRequestedIP: net.ParseIP("192.168.1.102").To4(),
+		OptServerID:    net.ParseIP("192.168.1.254").To4(),
+	}); reply != nil {
+		t.Errorf("Expected silence, got %+v", reply)
+	}
+
+	// Released addresses stay with their client
+	release := phone.packet(MsgRelease, nil)
+	release.CIAddr = net.ParseIP("192.168.1.101")
+	server.handle(release)
+	if n := len(server.Leases()); n != 2 {
+		t.Errorf("Expected the released lease to end, got %d leases", n)
+	}
+
+	// Leases survive a restart
+	server.Shutdown(context.Background())
+	restarted, addr := startTestServer(t, config, path)
+	if n := len(restarted.Leases()); n != 2 {
+		t.Errorf("Expected 2 persisted leases, got %d", n)
+	}
+	phone = newTestClient(t, addr, "00:11:22:33:44:66")
+	if ip := phone.lease("phone"); !ip.Equal(net.ParseIP("192.168.1.101")) {
+		t.Errorf("Expected the returning client to get its address back, got %s", ip)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	base := func() Config {
+		return Config{
+			ServerIP:   net.ParseIP("192.168.1.2"),
+			RangeStart: net.ParseIP("192.168.1.100"),
+			RangeEnd:   net.ParseIP("192.168.1.200"),
+		}
+	}
+
+	if _, err := NewServer(base(), ""); err != nil {
+		t.Errorf("Expected a minimal config to be valid: %v", err)
+	}
+
+	for name, mutate := range map[string]func(*Config){
+		"reversed range":   func(c *Config) { c.RangeStart, c.RangeEnd = c.RangeEnd, c.RangeStart },
+		"range off subnet": func(c *Config) { c.RangeEnd = net.ParseIP("192.168.2.10") },
+		"IPv6 server":      func(c *Config) { c.ServerIP = net.ParseIP("fd00::1") },
+		"bad reservation":  func(c *Config) { c.Reservations = []Reservation{{MAC: "nope", IP: "192.168.1.5"}} },
+		"server reserved":  func(c *Config) { c.Reservations = []Reservation{{MAC: "00:11:22:33:44:55", IP: "192.168.1.2"}} },
+		"duplicate address": func(c *Config) {
+			c.Reservations = []Reservation{{MAC: "00:11:22:33:44:55", IP: "192.168.1.5"}, {MAC: "00:11:22:33:44:56", IP: "192.168.1.5"}}
+		},
+	} {
+		config := base()
+		mutate(&config)
+		if _, err := NewServer(config, ""); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// accessList decides which clients may query the resolver. Denied networks
+// win over allowed ones, and an empty allow list admits everyone else.
+type accessList struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+func newAccessList(allowed, denied []string) (*accessList, error) {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil, nil
+	}
+
+	a := &accessList{}
+	var err error
+	if a.allowed, err = parseNetworks(allowed); err != nil {
+		return nil, fmt.Errorf("invalid allowed client %w", err)
+	}
+	if a.denied, err = parseNetworks(denied); err != nil {
+		return nil, fmt.Errorf("invalid denied client %w", err)
+	}
+	return a, nil
+}
+
+// permits reports whether clientIP may query. A nil list permits everyone;
+// addresses that cannot be parsed are only permitted without an allow list.
+func (a *accessList) permits(clientIP string) bool {
+	if a == nil {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return len(a.allowed) == 0
+	}
+	if containsIP(a.denied, ip) {
+		return false
+	}
+	return len(a.allowed) == 0 || containsIP(a.allowed, ip)
+}
+
+// parseNetworks parses addresses and CIDRs, treating a bare address as a
+// network of one
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		cidr := entry
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%q", entry)
+		}
+		networks = append(networks, ipNet)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
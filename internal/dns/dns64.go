@@ -0,0 +1,142 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// wellKnownPrefix is the NAT64 prefix reserved by RFC 6052, which must not
+// be used to reach private IPv4 addresses
+var wellKnownPrefix = net.ParseIP("64:ff9b::")
+
+// dns64 synthesizes AAAA records from A records for clients behind NAT64
+// (RFC 6147), embedding the IPv4 address in the NAT64 prefix as RFC 6052
+// describes
+type dns64 struct {
+	prefix    *net.IPNet
+	bits      int
+	wellKnown bool
+	clients   []*net.IPNet // Clients that get synthesized answers, all when empty
+}
+
+func newDNS64(prefix string, clients []string) (*dns64, error) {
+	if prefix == "" {
+		return nil, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil || ipNet.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid DNS64 prefix %q", prefix)
+	}
+	bits, _ := ipNet.Mask.Size()
+	switch bits {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("DNS64 prefix %q must be a /32, /40, /48, /56, /64 or /96", prefix)
+	}
+	// Bits 64 to 71 are reserved and must be zero
+	if bits > 64 && ipNet.IP[8] != 0 {
+		return nil, fmt.Errorf("DNS64 prefix %q sets the reserved octet", prefix)
+	}
+
+	d := &dns64{prefix: ipNet, bits: bits, wellKnown: bits == 96 && ipNet.IP.Equal(wellKnownPrefix)}
+	if d.clients, err = parseNetworks(clients); err != nil {
+		return nil, fmt.Errorf("invalid DNS64 client %w", err)
+	}
+	return d, nil
+}
+
+// applies reports whether a query needs a synthesized answer: an AAAA query
+// from a NAT64 client without a native AAAA answer. Answers with only
+// IPv4-mapped addresses count as none.
+func (d *dns64) applies(q dns.Question, clientIP string, answer []dns.RR) bool {
+	if d == nil || q.Qtype != dns.TypeAAAA {
+		return false
+	}
+	if len(d.clients) > 0 {
+		ip := net.ParseIP(clientIP)
+		if ip == nil || !containsIP(d.clients, ip) {
+			return false
+		}
+	}
+	for _, rr := range answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok && aaaa.AAAA.To4() == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// synthesize turns the A records of an answer into AAAA records, keeping
+// the CNAMEs leading to them
+func (d *dns64) synthesize(answer []dns.RR) []dns.RR {
+	var synthesized []dns.RR
+	found := false
+	for _, rr := range answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			synthesized = append(synthesized, rr)
+		case *dns.A:
+			v4 := rr.A.To4()
+			if v4 == nil || (d.wellKnown && (v4.IsPrivate() || !v4.IsGlobalUnicast())) {
+				continue
+			}
+			hdr := rr.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			hdr.Rdlength = 0
+			synthesized = append(synthesized, &dns.AAAA{Hdr: hdr, AAAA: d.embed(v4)})
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return synthesized
+}
+
+// embed places an IPv4 address in the prefix, skipping the reserved octet
+func (d *dns64) embed(v4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, d.prefix.IP)
+	pos := d.bits / 8
+	for _, b := range v4 {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// extract returns the IPv4 address embedded in a synthesized address, or ip
+// itself when it is outside the prefix
+func (d *dns64) extract(ip net.IP) net.IP {
+	if d == nil || ip.To4() != nil || !d.prefix.Contains(ip) {
+		return ip
+	}
+	v4 := make(net.IP, 0, net.IPv4len)
+	for pos := d.bits / 8; len(v4) < net.IPv4len; pos++ {
+		if pos != 8 {
+			v4 = append(v4, ip[pos])
+		}
+	}
+	return v4
+}
+
+// resolveDNS64 answers an AAAA query with addresses synthesized from the
+// name's A records. Synthesized answers are cached apart from native ones.
+func (s *Server) resolveDNS64(r *dns.Msg, q dns.Question) []dns.RR {
+	key := getCacheKey(q.Name, q.Qtype) + ":dns64"
+	if answer := s.checkCacheKey(key); answer != nil {
+		s.metrics.incrementCacheHit()
+		return answer
+	}
+
+	a := s.resolveTarget(r, q.Name, dns.Question{Name: q.Name, Qtype: dns.TypeA, Qclass: q.Qclass})
+	answer := s.dns64.synthesize(a)
+	s.updateCacheKey(key, answer)
+	return answer
+}
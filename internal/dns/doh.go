@@ -0,0 +1,94 @@
+package dns
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the content type of DNS messages over HTTPS (RFC 8484)
+const dohMediaType = "application/dns-message"
+
+// dohWriter adapts an HTTP exchange to dns.ResponseWriter so DoH queries go
+// through the same handler as plain DNS
+type dohWriter struct {
+	remote net.Addr
+	token  string
+	msg    *dns.Msg
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigStatus() error   { return nil }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
+
+// ServeDoH answers a DNS-over-HTTPS request as described in RFC 8484, with
+// the query in the "dns" URL parameter for GET or in the body for POST. A
+// non-empty token selects the client group owning it.
+func (s *Server) ServeDoH(w http.ResponseWriter, r *http.Request, token string) {
+	var packed []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		packed, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(packed) == 0 {
+		http.Error(w, "Invalid DNS query", http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil {
+		http.Error(w, "Invalid DNS query", http.StatusBadRequest)
+		return
+	}
+
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		remote = &net.TCPAddr{}
+	}
+	dw := &dohWriter{remote: remote, token: token}
+	s.handleRequest(dw, req)
+	if dw.msg == nil {
+		http.Error(w, "No response", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := dw.msg.Pack()
+	if err != nil {
+		http.Error(w, "Failed to pack response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Write(resp)
+}
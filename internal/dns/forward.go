@@ -0,0 +1,215 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream selection strategies
+const (
+	StrategyRoundRobin = "round_robin" // Rotate through the upstreams, one try per query
+	StrategyFailover   = "failover"    // Try upstreams in order until one answers
+)
+
+// ForwardRule sends queries under a domain suffix to their own upstreams.
+// Suffix may also be a CIDR, which stands for its reverse lookup zones.
+type ForwardRule struct {
+	Suffix       string
+	Upstreams    []string
+	Strategy     string
+	SkipBlocking bool // Answer names under the suffix without consulting the blocker
+}
+
+// upstreamGroup is a set of upstream servers and how to pick among them
+type upstreamGroup struct {
+	addrs        []string
+	strategy     string
+	skipBlocking bool
+	next         uint32
+}
+
+func newUpstreamGroup(addrs []string, strategy string) (*upstreamGroup, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("at least one upstream is required")
+	}
+	if strategy == "" {
+		strategy = StrategyRoundRobin
+	}
+	if strategy != StrategyRoundRobin && strategy != StrategyFailover {
+		return nil, fmt.Errorf("unsupported strategy %q", strategy)
+	}
+
+	g := &upstreamGroup{strategy: strategy}
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		g.addrs = append(g.addrs, addr)
+	}
+	return g, nil
+}
+
+// exchange sends r to the group's upstreams according to its strategy
+func (g *upstreamGroup) exchange(r *dns.Msg) (*dns.Msg, error) {
+	if g.strategy == StrategyFailover {
+		var err error
+		for _, addr := range g.addrs {
+			var resp *dns.Msg
+			if resp, err = dns.Exchange(r, addr); err == nil {
+				return resp, nil
+			}
+		}
+		return nil, err
+	}
+
+	i := atomic.AddUint32(&g.next, 1) % uint32(len(g.addrs))
+	return dns.Exchange(r, g.addrs[i])
+}
+
+// forwarders routes queries to upstream groups by longest matching suffix
+type forwarders struct {
+	defaults *upstreamGroup
+	suffixes map[string]*upstreamGroup // By fully qualified, lowercase suffix
+}
+
+func newForwarders(defaults []string, rules []ForwardRule) (*forwarders, error) {
+	def, err := newUpstreamGroup(defaults, StrategyRoundRobin)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &forwarders{defaults: def, suffixes: make(map[string]*upstreamGroup)}
+	for _, rule := range rules {
+		group, err := newUpstreamGroup(rule.Upstreams, rule.Strategy)
+		if err != nil {
+			return nil, fmt.Errorf("forwarding rule %q: %w", rule.Suffix, err)
+		}
+		group.skipBlocking = rule.SkipBlocking
+
+		zones, err := forwardZones(rule.Suffix)
+		if err != nil {
+			return nil, fmt.Errorf("forwarding rule %q: %w", rule.Suffix, err)
+		}
+		for _, zone := range zones {
+			if _, exists := f.suffixes[zone]; exists {
+				return nil, fmt.Errorf("forwarding rule %q: %s is already forwarded", rule.Suffix, zone)
+			}
+			f.suffixes[zone] = group
+		}
+	}
+	return f, nil
+}
+
+// forwardZones turns a rule suffix into the zones it covers. A CIDR covers
+// the reverse zones of its addresses, rounded out to whole octets for IPv4
+// and whole nibbles for IPv6.
+func forwardZones(suffix string) ([]string, error) {
+	suffix = strings.ToLower(strings.TrimSpace(suffix))
+	if !strings.Contains(suffix, "/") {
+		zone := dns.Fqdn(suffix)
+		if _, ok := dns.IsDomainName(zone); !ok || zone == "." {
+			return nil, fmt.Errorf("invalid suffix %q", suffix)
+		}
+		return []string{zone}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(suffix)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipNet.Mask.Size()
+
+	step := 8
+	if bits == 128 {
+		step = 4
+	}
+	rounded := (ones + step - 1) / step * step
+	if rounded-ones > 8 {
+		return nil, fmt.Errorf("%s expands to too many reverse zones", suffix)
+	}
+
+	var zones []string
+	count := 1 << (rounded - ones)
+	base := ipNet.IP
+	if ip4 := base.To4(); ip4 != nil {
+		base = ip4
+	}
+	for i := 0; i < count; i++ {
+		ip := make(net.IP, len(base))
+		copy(ip, base)
+		addToPrefix(ip, i, rounded)
+		zones = append(zones, reverseZone(ip, rounded))
+	}
+	return zones, nil
+}
+
+// addToPrefix adds n to ip as if the address were prefixLen bits long
+func addToPrefix(ip net.IP, n, prefixLen int) {
+	shift := len(ip)*8 - prefixLen
+	for i := len(ip) - 1; i >= 0 && n > 0; i-- {
+		if shift >= 8 {
+			shift -= 8
+			continue
+		}
+		sum := int(ip[i]) + (n << shift)
+		ip[i] = byte(sum)
+		n = sum >> 8
+		shift = 0
+	}
+}
+
+// reverseZone returns the in-addr.arpa or ip6.arpa zone for the first
+// prefixLen bits of ip
+func reverseZone(ip net.IP, prefixLen int) string {
+	var labels []string
+	if len(ip) == net.IPv4len {
+		for i := 0; i < prefixLen/8; i++ {
+			labels = append(labels, fmt.Sprint(ip[i]))
+		}
+		reverseStrings(labels)
+		return dns.Fqdn(strings.Join(append(labels, "in-addr.arpa"), "."))
+	}
+
+	for i := 0; i < prefixLen/4; i++ {
+		b := ip[i/2]
+		if i%2 == 0 {
+			b >>= 4
+		}
+		labels = append(labels, fmt.Sprintf("%x", b&0xf))
+	}
+	reverseStrings(labels)
+	return dns.Fqdn(strings.Join(append(labels, "ip6.arpa"), "."))
+}
+
+func reverseStrings(s []string) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
+
+// route returns the upstream group for a name, the rule with the longest
+// matching suffix or the default upstreams
+func (f *forwarders) route(name string) *upstreamGroup {
+	name = strings.ToLower(dns.Fqdn(name))
+	for {
+		if group, ok := f.suffixes[name]; ok {
+			return group
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return f.defaults
+		}
+		name = name[i+1:]
+	}
+}
+
+// skipBlocking reports whether a name is forwarded by a rule excluded from
+// blocking
+func (f *forwarders) skipBlocking(name string) bool {
+	return f.route(name).skipBlocking
+}
@@ -0,0 +1,480 @@
+package dns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/vivek-pk/goadblock/internal/atomicfile"
+	"github.com/vivek-pk/goadblock/internal/blocker"
+)
+
+// Blocking modes, i.e. how a blocked query is answered
+const (
+	BlockingZeroIP   = "zero_ip"   // 0.0.0.0 and ::
+	BlockingNXDomain = "nxdomain"  // NXDOMAIN, no answer
+	BlockingRefused  = "refused"   // REFUSED, no answer
+	BlockingCustomIP = "custom_ip" // The configured blocking IP
+)
+
+// ednsMACOption is the EDNS0 option forwarders such as dnsmasq (add-mac)
+// use to pass on the MAC address of the original client
+const ednsMACOption = 65001
+
+var (
+	ErrGroupExists   = errors.New("group already exists")
+	ErrGroupNotFound = errors.New("group not found")
+)
+
+// ValidBlockingMode reports whether mode is one of the supported modes
+func ValidBlockingMode(mode string) bool {
+	switch mode {
+	case BlockingZeroIP, BlockingNXDomain, BlockingRefused, BlockingCustomIP:
+		return true
+	}
+	return false
+}
+
+// ClientGroup is a set of clients sharing a blocking policy. Clients are
+// matched by DoH path token first, then MAC address, then the most specific
+// IP or CIDR.
+type ClientGroup struct {
+	Name    string   `json:"name"`
+	Clients []string `json:"clients"` // IP addresses and CIDRs
+	MACs    []string `json:"macs"`
+	Tokens  []string `json:"tokens"` // DoH path tokens, /dns-query/{token}
+
+	// Lists restricts the blocklists that apply; null keeps every enabled
+	// list, an empty list turns blocklists off for the group
+	Lists     []string `json:"lists"`
+	Allowlist []string `json:"allowlist"`
+	Regexes   []string `json:"regexes"`
+	Services  []string `json:"services"` // Blocked service catalogue IDs
+
+	// SafeSearch forces search engines and YouTube into safe search and
+	// restricted mode
+	SafeSearch bool `json:"safeSearch"`
+
+	// BlockingMode and BlockingIP override the server defaults when set
+	BlockingMode string `json:"blockingMode,omitempty"`
+	BlockingIP   string `json:"blockingIP,omitempty"`
+}
+
+// clientGroup is a validated ClientGroup ready for matching
+type clientGroup struct {
+	ClientGroup
+	nets       []*net.IPNet
+	macs       map[string]struct{}
+	tokens     map[string]struct{}
+	policy     *blocker.Policy
+	blockingIP net.IP
+}
+
+// compile validates a group and prepares it for matching
+func (g ClientGroup) compile() (*clientGroup, error) {
+	if g.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	if g.BlockingMode != "" && !ValidBlockingMode(g.BlockingMode) {
+		return nil, fmt.Errorf("unsupported blocking mode %q", g.BlockingMode)
+	}
+
+	c := &clientGroup{
+		ClientGroup: g,
+		macs:        make(map[string]struct{}),
+		tokens:      make(map[string]struct{}),
+	}
+
+	if g.BlockingIP != "" {
+		if c.blockingIP = net.ParseIP(g.BlockingIP); c.blockingIP == nil {
+			return nil, fmt.Errorf("invalid blocking IP %q", g.BlockingIP)
+		}
+	}
+
+	for _, client := range g.Clients {
+		ipNet, err := parseClient(client)
+		if err != nil {
+			return nil, err
+		}
+		c.nets = append(c.nets, ipNet)
+	}
+
+	for _, mac := range g.MACs {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address %q", mac)
+		}
+		c.macs[hw.String()] = struct{}{}
+	}
+
+	for _, token := range g.Tokens {
+		if token == "" || strings.ContainsAny(token, "/?#") {
+			return nil, fmt.Errorf("invalid token %q", token)
+		}
+		c.tokens[token] = struct{}{}
+	}
+
+	policy, err := blocker.NewPolicy(g.Name, g.Lists, g.Allowlist, g.Regexes, g.Services)
+	if err != nil {
+		return nil, err
+	}
+	c.policy = policy
+	return c, nil
+}
+
+// parseClient parses an IP address or CIDR into a network
+func parseClient(client string) (*net.IPNet, error) {
+	if strings.Contains(client, "/") {
+		_, ipNet, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", client)
+		}
+		return ipNet, nil
+	}
+
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client address %q", client)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// getPolicy returns the group's policy, nil for clients without a group
+func (g *clientGroup) getPolicy() *blocker.Policy {
+	if g == nil {
+		return nil
+	}
+	return g.policy
+}
+
+// ClientInfo identifies the client behind a query
+type ClientInfo struct {
+	IP    string
+	MAC   string // From EDNS, empty when not forwarded
+	Token string // DoH path token, empty for plain DNS
+}
+
+// GroupManager holds the client groups and persists changes to disk
+type GroupManager struct {
+	path   string
+	mu     sync.RWMutex
+	groups map[string]*clientGroup
+}
+
+// NewGroupManager creates a manager persisting to path. An empty path
+// disables persistence.
+func NewGroupManager(path string) *GroupManager {
+	return &GroupManager{
+		path:   path,
+		groups: make(map[string]*clientGroup),
+	}
+}
+
+// Load reads persisted groups, falling back to defaults when nothing has
+// been saved yet
+func (m *GroupManager) Load(defaults []ClientGroup) error {
+	groups := defaults
+	if m.path != "" {
+		data, err := os.ReadFile(m.path)
+		switch {
+		case err == nil:
+			groups = nil
+			if err := json.Unmarshal(data, &groups); err != nil {
+				return fmt.Errorf("failed to parse %s: %w", m.path, err)
+			}
+		case !os.IsNotExist(err):
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, group := range groups {
+		if err := m.putLocked(group, false); err != nil {
+			return fmt.Errorf("group %q: %w", group.Name, err)
+		}
+	}
+	return nil
+}
+
+// List returns all groups sorted by name
+func (m *GroupManager) List() []ClientGroup {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.listLocked()
+}
+
+// Get returns a single group
+func (m *GroupManager) Get(name string) (ClientGroup, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	group, ok := m.groups[name]
+	if !ok {
+		return ClientGroup{}, false
+	}
+	return group.ClientGroup, true
+}
+
+// Add creates a new group
+func (m *GroupManager) Add(group ClientGroup) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.putLocked(group, false); err != nil {
+		return err
+	}
+	return m.saveOrRevertLocked(group.Name, nil)
+}
+
+// Update replaces an existing group. Renaming is not supported.
+func (m *GroupManager) Update(name string, group ClientGroup) error {
+	group.Name = name
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := m.groups[name]
+	if err := m.putLocked(group, true); err != nil {
+		return err
+	}
+	return m.saveOrRevertLocked(name, prev)
+}
+
+// SetServiceBlocked blocks or unblocks a catalogue service for a group
+func (m *GroupManager) SetServiceBlocked(name, service string, blocked bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.groups[name]
+	if !ok {
+		return ErrGroupNotFound
+	}
+
+	group := current.ClientGroup
+	services := make([]string, 0, len(group.Services)+1)
+	for _, id := range group.Services {
+		if id != service {
+			services = append(services, id)
+		}
+	}
+	if blocked {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	group.Services = services
+
+	if err := m.putLocked(group, true); err != nil {
+		return err
+	}
+	return m.saveOrRevertLocked(name, current)
+}
+
+// Remove deletes a group; its clients fall back to the default policy
+func (m *GroupManager) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev, ok := m.groups[name]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	delete(m.groups, name)
+	return m.saveOrRevertLocked(name, prev)
+}
+
+// putLocked validates and stores a group, creating it or replacing an
+// existing one depending on replace. A token, MAC or client address may
+// belong to a single group only.
+func (m *GroupManager) putLocked(group ClientGroup, replace bool) error {
+	compiled, err := group.compile()
+	if err != nil {
+		return err
+	}
+
+	_, exists := m.groups[group.Name]
+	switch {
+	case replace && !exists:
+		return ErrGroupNotFound
+	case !replace && exists:
+		return ErrGroupExists
+	}
+
+	for name, other := range m.groups {
+		if name == group.Name {
+			continue
+		}
+		for token := range compiled.tokens {
+			if _, ok := other.tokens[token]; ok {
+				return fmt.Errorf("token is already used by group %q", name)
+			}
+		}
+		for mac := range compiled.macs {
+			if _, ok := other.macs[mac]; ok {
+				return fmt.Errorf("MAC %s already belongs to group %q", mac, name)
+			}
+		}
+		for _, n := range compiled.nets {
+			for _, o := range other.nets {
+				if n.String() == o.String() {
+					return fmt.Errorf("client %s already belongs to group %q", n, name)
+				}
+			}
+		}
+	}
+
+	m.groups[group.Name] = compiled
+	return nil
+}
+
+// Resolve returns the group a client belongs to, nil when there is none
+func (m *GroupManager) Resolve(client ClientInfo) *ClientGroup {
+	if group := m.resolve(client); group != nil {
+		g := group.ClientGroup
+		return &g
+	}
+	return nil
+}
+
+func (m *GroupManager) resolve(client ClientInfo) *clientGroup {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if client.Token != "" {
+		for _, group := range m.groups {
+			if _, ok := group.tokens[client.Token]; ok {
+				return group
+			}
+		}
+	}
+
+	if client.MAC != "" {
+		for _, group := range m.groups {
+			if _, ok := group.macs[client.MAC]; ok {
+				return group
+			}
+		}
+	}
+
+	ip := net.ParseIP(client.IP)
+	if ip == nil {
+		return nil
+	}
+
+	// Most specific network wins. Client networks are unique across groups,
+	// so there are no ties.
+	var best *clientGroup
+	bestLen := -1
+	for _, group := range m.groups {
+		for _, n := range group.nets {
+			if !n.Contains(ip) {
+				continue
+			}
+			if ones, _ := n.Mask.Size(); ones > bestLen {
+				best, bestLen = group, ones
+			}
+		}
+	}
+	return best
+}
+
+// saveOrRevertLocked persists a change to one group. If that fails the group
+// is put back the way it was, prev being nil when it did not exist, so that
+// a change reported as failed never takes effect.
+func (m *GroupManager) saveOrRevertLocked(name string, prev *clientGroup) error {
+	err := m.saveLocked()
+	if err != nil {
+		if prev == nil {
+			delete(m.groups, name)
+		} else {
+			m.groups[name] = prev
+		}
+	}
+	return err
+}
+
+// saveLocked persists the groups, must be called with m.mu held
+func (m *GroupManager) saveLocked() error {
+	if m.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(m.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		return err
+	}
+
+	return atomicfile.Write(m.path, data)
+}
+
+func (m *GroupManager) listLocked() []ClientGroup {
+	groups := make([]ClientGroup, 0, len(m.groups))
+	for _, group := range m.groups {
+		groups = append(groups, group.ClientGroup)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
+
+// clientMAC returns the client MAC address forwarded in EDNS, if any
+func clientMAC(r *dns.Msg) string {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		local, ok := option.(*dns.EDNS0_LOCAL)
+		if ok && local.Code == ednsMACOption && len(local.Data) == 6 {
+			return net.HardwareAddr(local.Data).String()
+		}
+	}
+	return ""
+}
+
+// blockResponse fills in m to answer a blocked question in the given mode
+func blockResponse(m *dns.Msg, q dns.Question, mode string, ip net.IP) {
+	switch mode {
+	case BlockingNXDomain:
+		m.Rcode = dns.RcodeNameError
+		return
+	case BlockingRefused:
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+
+	v4, v6 := net.IPv4(0, 0, 0, 0), net.IPv6zero
+	if mode == BlockingCustomIP && ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = ip4
+		} else {
+			v6 = ip
+		}
+	}
+
+	if q.Qtype == dns.TypeA {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   v4,
+		})
+	} else {
+		m.Answer = append(m.Answer, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+			AAAA: v6,
+		})
+	}
+}
@@ -0,0 +1,533 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
+)
+
+// Lease file formats
+const (
+	LeaseFormatDnsmasq = "dnsmasq" // dnsmasq.leases, one lease per line
+	LeaseFormatISC     = "isc"     // ISC dhcpd.leases, one block per lease
+)
+
+// DHCP servers rewrite their lease files in several steps; wait for them to
+// settle before reloading
+const leaseReloadDelay = 500 * time.Millisecond
+
+// leaseTTL is the TTL of records served from leases, short because leases
+// come and go
+const leaseTTL = 60
+
+// defaultLeaseDomain is appended to lease hostnames when serving them as
+// records
+const defaultLeaseDomain = "lan"
+
+// Lease is a DHCP lease from a lease file or the built-in DHCP server. A
+// zero Expires means the lease never expires.
+type Lease struct {
+	IP       string    `json:"ip"`
+	MAC      string    `json:"mac,omitempty"`
+	Hostname string    `json:"hostname,omitempty"`
+	Expires  time.Time `json:"expires,omitempty"`
+}
+
+// expired reports whether the lease has run out at now
+func (l Lease) expired(now time.Time) bool {
+	return !l.Expires.IsZero() && now.After(l.Expires)
+}
+
+// ValidLeaseFormat reports whether format names a supported lease file
+// format. An empty format is detected from the file contents.
+func ValidLeaseFormat(format string) bool {
+	switch format {
+	case "", LeaseFormatDnsmasq, LeaseFormatISC:
+		return true
+	}
+	return false
+}
+
+// parseLeases reads a lease file in the given format, detecting it when
+// format is empty. For ISC files, where every renewal appends a block, the
+// last block for an address wins.
+func parseLeases(r io.Reader, format string) ([]Lease, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = detectLeaseFormat(data)
+	}
+
+	switch format {
+	case LeaseFormatDnsmasq:
+		return parseDnsmasqLeases(data)
+	case LeaseFormatISC:
+		return parseISCLeases(data)
+	default:
+		return nil, fmt.Errorf("unsupported lease format %q", format)
+	}
+}
+
+// detectLeaseFormat tells ISC files, which are made of "lease" blocks, from
+// dnsmasq's plain lines
+func detectLeaseFormat(data []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "lease", "server-duid", "authoring-byte-order", "failover", "host":
+			return LeaseFormatISC
+		}
+		return LeaseFormatDnsmasq
+	}
+	return LeaseFormatDnsmasq
+}
+
+// parseDnsmasqLeases parses lines of "expiry mac ip hostname client-id".
+// An expiry of 0 means infinite and a hostname of "*" means none. IPv6
+// leases carry an IAID where the MAC would be.
+func parseDnsmasqLeases(data []byte) ([]Lease, error) {
+	var leases []Lease
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "duid" {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: expected at least 4 fields, got %d", n, len(fields))
+		}
+
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry %q", n, fields[0])
+		}
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			return nil, fmt.Errorf("line %d: invalid address %q", n, fields[2])
+		}
+
+		lease := Lease{IP: ip.String(), Hostname: leaseHostname(fields[3])}
+		if mac, err := net.ParseMAC(fields[1]); err == nil {
+			lease.MAC = mac.String()
+		}
+		if expiry != 0 {
+			lease.Expires = time.Unix(expiry, 0)
+		}
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
+
+// parseISCLeases parses the lease blocks of a dhcpd.leases file. Leases
+// that are no longer bound are skipped.
+func parseISCLeases(data []byte) ([]Lease, error) {
+	byIP := make(map[string]Lease)
+	var order []string
+
+	var current *Lease
+	bound := true
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if current == nil {
+			fields := strings.Fields(line)
+			if fields[0] != "lease" || !strings.HasSuffix(line, "{") {
+				continue
+			}
+			ip := net.ParseIP(fields[1])
+			if len(fields) != 3 || ip == nil {
+				return nil, fmt.Errorf("line %d: invalid lease %q", n, line)
+			}
+			current, bound = &Lease{IP: ip.String()}, true
+			continue
+		}
+
+		if line == "}" {
+			if bound {
+				if _, seen := byIP[current.IP]; !seen {
+					order = append(order, current.IP)
+				}
+				byIP[current.IP] = *current
+			} else {
+				delete(byIP, current.IP)
+			}
+			current = nil
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+		switch {
+		case fields[0] == "ends" && len(fields) >= 2:
+			expires, err := parseISCTime(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			current.Expires = expires
+		case fields[0] == "binding" && len(fields) == 3 && fields[1] == "state":
+			bound = fields[2] == "active" || fields[2] == "static"
+		case fields[0] == "hardware" && len(fields) == 3:
+			if mac, err := net.ParseMAC(fields[2]); err == nil {
+				current.MAC = mac.String()
+			}
+		case fields[0] == "client-hostname" && len(fields) == 2:
+			current.Hostname = leaseHostname(strings.Trim(fields[1], `"`))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current != nil {
+		return nil, fmt.Errorf("unterminated lease for %s", current.IP)
+	}
+
+	leases := make([]Lease, 0, len(byIP))
+	for _, ip := range order {
+		if lease, ok := byIP[ip]; ok {
+			leases = append(leases, lease)
+		}
+	}
+	return leases, nil
+}
+
+// parseISCTime parses the value of an "ends" statement: "never", "epoch
+// <seconds>" or "<weekday> yyyy/mm/dd hh:mm:ss" in UTC
+func parseISCTime(fields []string) (time.Time, error) {
+	switch {
+	case fields[0] == "never":
+		return time.Time{}, nil
+	case fields[0] == "epoch" && len(fields) == 2:
+		secs, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid lease time %q", strings.Join(fields, " "))
+		}
+		return time.Unix(secs, 0), nil
+	case len(fields) == 3:
+		t, err := time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid lease time %q", strings.Join(fields, " "))
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid lease time %q", strings.Join(fields, " "))
+}
+
+// leaseHostname returns a client-supplied hostname if it is usable as a
+// single DNS label, lowercased
+func leaseHostname(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || name == "*" || strings.Contains(name, ".") {
+		return ""
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return ""
+	}
+	return name
+}
+
+// Lease sources feeding the lease table
+const (
+	leaseSourceFile = "file" // The mounted lease file
+	leaseSourceDHCP = "dhcp" // The built-in DHCP server
+)
+
+// leaseTable indexes DHCP leases from every source by address and name.
+// When sources disagree about an address, the lease running longest wins.
+type leaseTable struct {
+	domain string // Fully qualified, e.g. "lan."
+	serve  bool   // Answer A, AAAA and PTR queries from leases
+	clock  func() time.Time
+
+	mu      sync.RWMutex
+	sources map[string][]Lease
+	byIP    map[string]Lease
+	byName  map[string][]Lease // By fully qualified, lowercase name
+}
+
+func newLeaseTable(domain string, serve bool) *leaseTable {
+	if domain == "" {
+		domain = defaultLeaseDomain
+	}
+	return &leaseTable{
+		domain:  dns.Fqdn(strings.ToLower(strings.Trim(domain, "."))),
+		serve:   serve,
+		clock:   time.Now,
+		sources: make(map[string][]Lease),
+		byIP:    make(map[string]Lease),
+		byName:  make(map[string][]Lease),
+	}
+}
+
+// set replaces the leases from one source
+func (t *leaseTable) set(source string, leases []Lease) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sources[source] = leases
+
+	byIP := make(map[string]Lease)
+	for _, leases := range t.sources {
+		for _, lease := range leases {
+			if other, ok := byIP[lease.IP]; ok && !outlasts(lease, other) {
+				continue
+			}
+			byIP[lease.IP] = lease
+		}
+	}
+	byName := make(map[string][]Lease)
+	for _, lease := range byIP {
+		if lease.Hostname != "" {
+			name := lease.Hostname + "." + t.domain
+			byName[name] = append(byName[name], lease)
+		}
+	}
+	t.byIP, t.byName = byIP, byName
+}
+
+// outlasts reports whether lease a expires after lease b
+func outlasts(a, b Lease) bool {
+	if a.Expires.IsZero() || b.Expires.IsZero() {
+		return a.Expires.IsZero() && !b.Expires.IsZero()
+	}
+	return a.Expires.After(b.Expires)
+}
+
+// get returns the current lease for an address
+func (t *leaseTable) get(ip string) (Lease, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	lease, ok := t.byIP[ip]
+	if !ok || lease.expired(t.clock()) {
+		return Lease{}, false
+	}
+	return lease, true
+}
+
+// list returns the current leases sorted by address
+func (t *leaseTable) list() []Lease {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	now := t.clock()
+	leases := make([]Lease, 0, len(t.byIP))
+	for _, lease := range t.byIP {
+		if !lease.expired(now) {
+			leases = append(leases, lease)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		a, b := net.ParseIP(leases[i].IP), net.ParseIP(leases[j].IP)
+		return bytes.Compare(a.To16(), b.To16()) < 0
+	})
+	return leases
+}
+
+// lookup answers A, AAAA and PTR questions for leased hosts when serving
+// is enabled. found reports whether the name belongs to a current lease.
+func (t *leaseTable) lookup(name string, qtype uint16) (answer []dns.RR, found bool) {
+	if !t.serve {
+		return nil, false
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	now := t.clock()
+
+	if strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.") {
+		ip := reverseToIP(name)
+		if ip == nil {
+			return nil, false
+		}
+		lease, ok := t.byIP[ip.String()]
+		if !ok || lease.Hostname == "" || lease.expired(now) {
+			return nil, false
+		}
+		if qtype == dns.TypePTR {
+			answer = append(answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: leaseTTL},
+				Ptr: lease.Hostname + "." + t.domain,
+			})
+		}
+		return answer, true
+	}
+
+	for _, lease := range t.byName[name] {
+		if lease.expired(now) {
+			continue
+		}
+		found = true
+
+		hdr := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: leaseTTL}
+		ip := net.ParseIP(lease.IP)
+		switch {
+		case qtype == dns.TypeA && ip.To4() != nil:
+			answer = append(answer, &dns.A{Hdr: hdr, A: ip.To4()})
+		case qtype == dns.TypeAAAA && ip.To4() == nil:
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return answer, found
+}
+
+// leaseFile is a DHCP server's lease file feeding the lease table, reloaded
+// when it changes
+type leaseFile struct {
+	path   string
+	format string
+	table  *leaseTable
+}
+
+// load re-reads the lease file
+func (f *leaseFile) load() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	leases, err := parseLeases(file, f.format)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", f.path, err)
+	}
+	f.table.set(leaseSourceFile, leases)
+	return nil
+}
+
+// watch reloads the lease file whenever it changes, until ctx is cancelled.
+// The directory is watched since dhcpd replaces the file on rewrite.
+func (f *leaseFile) watch(ctx context.Context) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := fsw.Add(filepath.Dir(f.path)); err != nil {
+		fsw.Close()
+		return err
+	}
+
+	go func() {
+		defer fsw.Close()
+		var pending *time.Timer
+		for {
+			select {
+			case <-ctx.Done():
+				if pending != nil {
+					pending.Stop()
+				}
+				return
+			case event, ok := <-fsw.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(f.path) {
+					continue
+				}
+				if pending != nil {
+					pending.Stop()
+				}
+				pending = time.AfterFunc(leaseReloadDelay, func() {
+					if err := f.load(); err != nil {
+						log.Printf("Failed to reload DHCP leases: %v", err)
+						return
+					}
+					log.Printf("Reloaded DHCP leases from %s", f.path)
+				})
+			case err, ok := <-fsw.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("DHCP lease watcher error: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reverseToIP turns a full in-addr.arpa or ip6.arpa name back into the
+// address it stands for, nil for partial or malformed names
+func reverseToIP(name string) net.IP {
+	labels := dns.SplitDomainName(name)
+	if len(labels) == 6 && labels[4] == "in-addr" {
+		ip := net.ParseIP(fmt.Sprintf("%s.%s.%s.%s", labels[3], labels[2], labels[1], labels[0]))
+		return ip.To4()
+	}
+	if len(labels) != 34 || labels[32] != "ip6" {
+		return nil
+	}
+
+	var hex strings.Builder
+	for i := 31; i >= 0; i-- {
+		if len(labels[i]) != 1 {
+			return nil
+		}
+		hex.WriteString(labels[i])
+		if i%4 == 0 && i > 0 {
+			hex.WriteByte(':')
+		}
+	}
+	return net.ParseIP(hex.String())
+}
+
+// WatchLeases loads the configured DHCP lease file and reloads it on
+// change until ctx is cancelled. It does nothing when no lease file is
+// configured.
+func (s *Server) WatchLeases(ctx context.Context) error {
+	if s.leaseFile == nil {
+		return nil
+	}
+	if err := s.leaseFile.load(); err != nil {
+		log.Printf("DHCP leases unavailable until %s changes: %v", s.leaseFile.path, err)
+	}
+	return s.leaseFile.watch(ctx)
+}
+
+// SetDHCPLeases replaces the leases handed out by the built-in DHCP server
+func (s *Server) SetDHCPLeases(leases []Lease) {
+	s.leases.set(leaseSourceDHCP, leases)
+}
+
+// Leases returns the current DHCP leases from every source
+func (s *Server) Leases() []Lease {
+	return s.leases.list()
+}
+
+// ClientMAC returns the MAC address leased the given address, if known
+func (s *Server) ClientMAC(clientIP string) string {
+	if ip := net.ParseIP(clientIP); ip != nil {
+		if lease, ok := s.leases.get(ip.String()); ok {
+			return lease.MAC
+		}
+	}
+	return ""
+}
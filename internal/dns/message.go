@@ -0,0 +1,61 @@
+package dns
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// headerResponse is the QR bit of the header flags
+const headerResponse = 1 << 15
+
+// acceptMsg hands every request to handleRequest, which answers malformed
+// and unsupported ones itself, and ignores responses. Messages that fail to
+// unpack are still answered with FORMERR by the dns package.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Bits&headerResponse != 0 {
+		return dns.MsgIgnore
+	}
+	return dns.MsgAccept
+}
+
+// checkQuery returns the rcode a query must be answered with instead of
+// being resolved, and why, or nil when it can be resolved
+func checkQuery(r *dns.Msg) (int, error) {
+	if len(r.Question) != 1 {
+		return dns.RcodeFormatError, fmt.Errorf("%d questions", len(r.Question))
+	}
+
+	// EDNS allows a single OPT record, in the additional section (RFC 6891)
+	opts := 0
+	for _, section := range [][]dns.RR{r.Answer, r.Ns} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				return dns.RcodeFormatError, fmt.Errorf("OPT record outside the additional section")
+			}
+		}
+	}
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts++
+		}
+	}
+	if opts > 1 {
+		return dns.RcodeFormatError, fmt.Errorf("%d OPT records", opts)
+	}
+
+	q := r.Question[0]
+	if _, ok := dns.IsDomainName(q.Name); !ok || !dns.IsFqdn(q.Name) {
+		return dns.RcodeFormatError, fmt.Errorf("invalid name %q", q.Name)
+	}
+	switch q.Qtype {
+	case dns.TypeOPT:
+		return dns.RcodeFormatError, fmt.Errorf("OPT in the question")
+	case dns.TypeAXFR, dns.TypeIXFR:
+		return dns.RcodeNotImplemented, fmt.Errorf("zone transfer of %s", q.Name)
+	}
+	if q.Qclass != dns.ClassINET && q.Qclass != dns.ClassANY {
+		return dns.RcodeNotImplemented, fmt.Errorf("class %s", dns.Class(q.Qclass))
+	}
+	return dns.RcodeSuccess, nil
+}
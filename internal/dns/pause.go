@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"sync"
+	"time"
+)
+
+// pauseState tracks when blocking resumes, globally, per client and per
+// client group
+type pauseState struct {
+	mu      sync.RWMutex
+	global  time.Time
+	clients map[string]time.Time
+	groups  map[string]time.Time
+}
+
+// PauseStatus describes active pauses. Times are when blocking resumes.
+type PauseStatus struct {
+	Paused     bool                 `json:"paused"`
+	Until      *time.Time           `json:"until,omitempty"`
+	Remaining  int64                `json:"remaining,omitempty"` // Seconds
+	Clients    map[string]time.Time `json:"clients"`
+	Groups     map[string]time.Time `json:"groups"`
+	ServerTime time.Time            `json:"serverTime"`
+}
+
+func newPauseState() *pauseState {
+	return &pauseState{clients: make(map[string]time.Time), groups: make(map[string]time.Time)}
+}
+
+// PauseBlocking disables blocking for d, for everyone when clientIP is empty
+// or only for that client otherwise. It returns when blocking resumes.
+func (s *Server) PauseBlocking(d time.Duration, clientIP string) time.Time {
+	until := time.Now().Add(d)
+
+	s.pause.mu.Lock()
+	defer s.pause.mu.Unlock()
+
+	if clientIP == "" {
+		s.pause.global = until
+	} else {
+		s.pause.clients[clientIP] = until
+	}
+	return until
+}
+
+// ResumeBlocking ends a pause early, globally when clientIP is empty
+func (s *Server) ResumeBlocking(clientIP string) {
+	s.pause.mu.Lock()
+	defer s.pause.mu.Unlock()
+
+	if clientIP == "" {
+		s.pause.global = time.Time{}
+	} else {
+		delete(s.pause.clients, clientIP)
+	}
+}
+
+// PauseGroup disables blocking for d for the clients of a group
+func (s *Server) PauseGroup(d time.Duration, group string) time.Time {
+	until := time.Now().Add(d)
+
+	s.pause.mu.Lock()
+	defer s.pause.mu.Unlock()
+
+	s.pause.groups[group] = until
+	return until
+}
+
+// ResumeGroup ends a group's pause early
+func (s *Server) ResumeGroup(group string) {
+	s.pause.mu.Lock()
+	defer s.pause.mu.Unlock()
+
+	delete(s.pause.groups, group)
+}
+
+// PauseStatus returns the active pauses, dropping expired ones
+func (s *Server) PauseStatus() PauseStatus {
+	now := time.Now()
+
+	s.pause.mu.Lock()
+	defer s.pause.mu.Unlock()
+
+	status := PauseStatus{
+		Clients:    make(map[string]time.Time),
+		Groups:     make(map[string]time.Time),
+		ServerTime: now,
+	}
+	if now.Before(s.pause.global) {
+		until := s.pause.global
+		status.Paused = true
+		status.Until = &until
+		status.Remaining = int64(until.Sub(now).Seconds())
+	}
+	for client, until := range s.pause.clients {
+		if !now.Before(until) {
+			delete(s.pause.clients, client)
+			continue
+		}
+		status.Clients[client] = until
+	}
+	for group, until := range s.pause.groups {
+		if !now.Before(until) {
+			delete(s.pause.groups, group)
+			continue
+		}
+		status.Groups[group] = until
+	}
+	return status
+}
+
+// blockingPaused reports whether blocking is paused for a client in group,
+// which is nil when the client belongs to none
+func (s *Server) blockingPaused(clientIP string, group *clientGroup) bool {
+	now := time.Now()
+
+	s.pause.mu.RLock()
+	defer s.pause.mu.RUnlock()
+
+	if now.Before(s.pause.global) {
+		return true
+	}
+	if until, ok := s.pause.clients[clientIP]; ok && now.Before(until) {
+		return true
+	}
+	if group == nil {
+		return false
+	}
+	until, ok := s.pause.groups[group.Name]
+	return ok && now.Before(until)
+}
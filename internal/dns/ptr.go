@@ -0,0 +1,192 @@
+package dns
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// privateRanges are the address ranges whose reverse lookups must not leak
+// to public resolvers: RFC 1918, link-local and unique local IPv6
+var privateRanges = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// privateZones lists the reverse zones of privateRanges
+var privateZones = func() map[string]struct{} {
+	zones := make(map[string]struct{})
+	for _, cidr := range privateRanges {
+		expanded, err := forwardZones(cidr)
+		if err != nil {
+			panic(err)
+		}
+		for _, zone := range expanded {
+			zones[zone] = struct{}{}
+		}
+	}
+	return zones
+}()
+
+// isPrivateReverse reports whether a PTR name lies in a private range
+func isPrivateReverse(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	for {
+		if _, ok := privateZones[name]; ok {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// localResolverRules forwards the private reverse zones to resolver, except
+// for zones already covered by an explicit rule
+func localResolverRules(resolver string, rules []ForwardRule) []ForwardRule {
+	taken := make(map[string]struct{})
+	for _, rule := range rules {
+		zones, err := forwardZones(rule.Suffix)
+		if err != nil {
+			continue
+		}
+		for _, zone := range zones {
+			taken[zone] = struct{}{}
+		}
+	}
+
+	var zones []string
+	for zone := range privateZones {
+		if _, ok := taken[zone]; !ok {
+			zones = append(zones, zone)
+		}
+	}
+	if len(zones) == 0 {
+		return nil
+	}
+
+	extra := make([]ForwardRule, 0, len(zones))
+	for _, zone := range zones {
+		extra = append(extra, ForwardRule{Suffix: zone, Upstreams: []string{resolver}})
+	}
+	return extra
+}
+
+// hostsFile is an /etc/hosts style file of static address to name mappings,
+// re-read when it changes
+type hostsFile struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	names   map[string]string // IP to the first name listed for it
+}
+
+// lookup returns the name mapped to ip, if any
+func (h *hostsFile) lookup(ip string) string {
+	if h == nil || h.path == "" {
+		return ""
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if info, err := os.Stat(h.path); err == nil && !info.ModTime().Equal(h.modTime) {
+		if names, err := parseHostsFile(h.path); err == nil {
+			h.names = names
+			h.modTime = info.ModTime()
+		}
+	}
+	return h.names[ip]
+}
+
+func parseHostsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+			continue
+		}
+		if _, exists := names[ip.String()]; !exists {
+			names[ip.String()] = fields[1]
+		}
+	}
+	return names, scanner.Err()
+}
+
+// forwardsPrivate reports whether a private reverse name has somewhere to
+// go other than the public upstreams
+func (s *Server) forwardsPrivate(name string) bool {
+	return s.upstreams.route(name) != s.upstreams.defaults
+}
+
+// ResolveHostname finds a name for a client address from the hosts file,
+// DHCP leases, local records and, for private addresses when a local
+// resolver is set, a PTR query to it. It returns an empty string when
+// nothing is known.
+func (s *Server) ResolveHostname(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return ""
+	}
+
+	if name := s.hosts.lookup(ip.String()); name != "" {
+		return name
+	}
+	if lease, ok := s.leases.get(ip.String()); ok && lease.Hostname != "" {
+		return lease.Hostname
+	}
+
+	reverse, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return ""
+	}
+	if answer, _, ok := s.records.lookup(reverse, dns.TypePTR); ok {
+		return firstPTR(answer)
+	}
+
+	if !isPrivateReverse(reverse) || !s.forwardsPrivate(reverse) {
+		return ""
+	}
+	r := new(dns.Msg)
+	r.SetQuestion(reverse, dns.TypePTR)
+	resp, err := s.queryUpstream(r)
+	if err != nil || resp == nil {
+		return ""
+	}
+	return firstPTR(resp.Answer)
+}
+
+func firstPTR(answer []dns.RR) string {
+	for _, rr := range answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			return strings.TrimSuffix(ptr.Ptr, ".")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// QtypePolicy answers queries of some types with NODATA, e.g. AAAA on
+// networks with broken IPv6 or HTTPS and TXT for devices that abuse them
+type QtypePolicy struct {
+	Name   string
+	Types  []string // Query types such as AAAA, HTTPS, SVCB or TXT
+	Groups []string // Client groups the policy applies to, every client when empty
+}
+
+// qtypePolicy is a validated QtypePolicy
+type qtypePolicy struct {
+	name   string
+	types  map[uint16]struct{}
+	groups map[string]struct{}
+}
+
+// qtypeFilter holds the policies and how many queries each filtered
+type qtypeFilter struct {
+	policies []qtypePolicy
+
+	mu       sync.Mutex
+	filtered map[string]int64
+}
+
+func newQtypeFilter(policies []QtypePolicy) (*qtypeFilter, error) {
+	if len(policies) == 0 {
+		return nil, nil
+	}
+
+	f := &qtypeFilter{filtered: make(map[string]int64, len(policies))}
+	for _, p := range policies {
+		if p.Name == "" {
+			return nil, errors.New("qtype policy name is required")
+		}
+		if _, ok := f.filtered[p.Name]; ok {
+			return nil, fmt.Errorf("duplicate qtype policy %q", p.Name)
+		}
+		if len(p.Types) == 0 {
+			return nil, fmt.Errorf("qtype policy %q has no types", p.Name)
+		}
+
+		compiled := qtypePolicy{
+			name:   p.Name,
+			types:  make(map[uint16]struct{}, len(p.Types)),
+			groups: make(map[string]struct{}, len(p.Groups)),
+		}
+		for _, t := range p.Types {
+			qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(t))]
+			if !ok {
+				return nil, fmt.Errorf("qtype policy %q: unknown query type %q", p.Name, t)
+			}
+			compiled.types[qtype] = struct{}{}
+		}
+		for _, g := range p.Groups {
+			compiled.groups[g] = struct{}{}
+		}
+		f.policies = append(f.policies, compiled)
+		f.filtered[p.Name] = 0
+	}
+	return f, nil
+}
+
+// match returns the first policy filtering qtype for a client in group,
+// counting the query against it. A nil filter matches nothing.
+func (f *qtypeFilter) match(qtype uint16, group *clientGroup) (string, bool) {
+	if f == nil {
+		return "", false
+	}
+	for _, p := range f.policies {
+		if _, ok := p.types[qtype]; !ok {
+			continue
+		}
+		if len(p.groups) > 0 {
+			if group == nil {
+				continue
+			}
+			if _, ok := p.groups[group.Name]; !ok {
+				continue
+			}
+		}
+
+		f.mu.Lock()
+		f.filtered[p.name]++
+		f.mu.Unlock()
+		return p.name, true
+	}
+	return "", false
+}
+
+// counts returns the number of filtered queries by policy name
+func (f *qtypeFilter) counts() map[string]int64 {
+	counts := make(map[string]int64)
+	if f == nil {
+		return counts
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, n := range f.filtered {
+		counts[name] = n
+	}
+	return counts
+}
+
+// QtypeFiltered returns how many queries each qtype policy answered with
+// NODATA
+func (s *Server) QtypeFiltered() map[string]int64 {
+	return s.qtypes.counts()
+}
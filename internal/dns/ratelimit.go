@@ -0,0 +1,208 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// How rate limited queries are answered
+const (
+	RateLimitDrop     = "drop"     // Send nothing; the client times out
+	RateLimitRefused  = "refused"  // Answer REFUSED
+	RateLimitTruncate = "truncate" // Set TC so genuine clients retry over TCP
+)
+
+// Default prefixes clients are grouped by; IPv6 hosts often rotate
+// addresses within their /64
+const (
+	defaultRateLimitV4Prefix = 32
+	defaultRateLimitV6Prefix = 64
+)
+
+// rateLimitSweep is how often idle buckets are forgotten
+const rateLimitSweep = time.Minute
+
+// RateLimit configures per-client token buckets. Clients are grouped into
+// subnets by prefix length, so a /24 limits a whole network as one client.
+type RateLimit struct {
+	QPS        float64  // Sustained queries per second per client, 0 disables limiting
+	Burst      int      // Bucket size, QPS rounded up when zero
+	IPv4Prefix int      // 32 when zero
+	IPv6Prefix int      // 64 when zero
+	Action     string   // drop (default), refused or truncate
+	Exempt     []string // Addresses or CIDRs never limited, e.g. the router
+}
+
+// bucket is a token bucket for one client subnet
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter enforces RateLimit and counts the queries it stops
+type rateLimiter struct {
+	RateLimit
+	v4Mask net.IPMask
+	v6Mask net.IPMask
+	exempt []*net.IPNet
+	clock  func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	limited   map[string]int64 // Limited queries by client address, while its bucket exists
+	lastSweep time.Time
+}
+
+func newRateLimiter(config RateLimit) (*rateLimiter, error) {
+	if config.QPS < 0 || config.Burst < 0 {
+		return nil, fmt.Errorf("rate limit must not be negative")
+	}
+	if config.Burst == 0 {
+		config.Burst = int(config.QPS + 0.999)
+	}
+	if config.IPv4Prefix == 0 {
+		config.IPv4Prefix = defaultRateLimitV4Prefix
+	}
+	if config.IPv6Prefix == 0 {
+		config.IPv6Prefix = defaultRateLimitV6Prefix
+	}
+	if config.IPv4Prefix < 0 || config.IPv4Prefix > 32 || config.IPv6Prefix < 0 || config.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("rate limit prefixes /%d and /%d are out of range", config.IPv4Prefix, config.IPv6Prefix)
+	}
+	switch config.Action {
+	case "":
+		config.Action = RateLimitDrop
+	case RateLimitDrop, RateLimitRefused, RateLimitTruncate:
+	default:
+		return nil, fmt.Errorf("unsupported rate limit action %q", config.Action)
+	}
+
+	l := &rateLimiter{
+		RateLimit: config,
+		v4Mask:    net.CIDRMask(config.IPv4Prefix, 32),
+		v6Mask:    net.CIDRMask(config.IPv6Prefix, 128),
+		clock:     time.Now,
+		buckets:   make(map[string]*bucket),
+		limited:   make(map[string]int64),
+	}
+	exempt, err := parseNetworks(config.Exempt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit exemption %w", err)
+	}
+	l.exempt = exempt
+	return l, nil
+}
+
+// allow takes a token for the client's subnet, reporting whether the query
+// may proceed. A nil limiter allows everything.
+func (l *rateLimiter) allow(clientIP string) bool {
+	if l == nil || l.QPS == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return true
+	}
+	if containsIP(l.exempt, ip) {
+		return true
+	}
+
+	key := l.subnet(ip)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock()
+	l.sweepLocked(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.QPS
+	if b.tokens > float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		l.limited[ip.String()]++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// subnet returns the bucket key of the subnet ip is grouped into
+func (l *rateLimiter) subnet(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(l.v4Mask).String()
+	}
+	return ip.Mask(l.v6Mask).String()
+}
+
+// sweepLocked forgets buckets that have refilled, which are no different
+// from new ones, along with the counts of the clients in them, so spoofed
+// sources cannot grow either map without bound
+func (l *rateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweep {
+		return
+	}
+	l.lastSweep = now
+
+	full := float64(l.Burst) / l.QPS
+	for key, b := range l.buckets {
+		if now.Sub(b.last).Seconds() >= full {
+			delete(l.buckets, key)
+		}
+	}
+	for addr := range l.limited {
+		if _, ok := l.buckets[l.subnet(net.ParseIP(addr))]; !ok {
+			delete(l.limited, addr)
+		}
+	}
+}
+
+// counts returns the number of limited queries by client address
+func (l *rateLimiter) counts() map[string]int64 {
+	counts := make(map[string]int64)
+	if l == nil {
+		return counts
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, n := range l.limited {
+		counts[ip] = n
+	}
+	return counts
+}
+
+// respond answers a query the limiter stopped. It returns false when
+// nothing should be sent.
+func (l *rateLimiter) respond(w dns.ResponseWriter, m *dns.Msg) bool {
+	switch l.Action {
+	case RateLimitRefused:
+		m.Rcode = dns.RcodeRefused
+	case RateLimitTruncate:
+		// Only UDP clients can retry over TCP
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			m.Truncated = true
+		} else {
+			m.Rcode = dns.RcodeRefused
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// RateLimited returns how many queries were rate limited per client address
+func (s *Server) RateLimited() map[string]int64 {
+	return s.limiter.counts()
+}
@@ -0,0 +1,105 @@
+package dns
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// What happens to upstream answers that point into the local network
+const (
+	RebindBlock = "block" // Answer as if the name were blocked
+	RebindDrop  = "drop"  // Strip the offending addresses and return the rest
+)
+
+// reasonRebinding marks queries stopped by rebinding protection in the
+// query log
+const reasonRebinding = "rebinding"
+
+// rebindFilter protects the local network from DNS rebinding: public names
+// whose upstream answers contain private, loopback or link-local addresses
+type rebindFilter struct {
+	mode    string
+	allowed map[string]struct{} // Fully qualified suffixes allowed to answer locally
+}
+
+func newRebindFilter(mode string, allowlist []string) (*rebindFilter, error) {
+	if mode == "" {
+		mode = RebindBlock
+	}
+	if mode != RebindBlock && mode != RebindDrop {
+		return nil, fmt.Errorf("unsupported rebinding mode %q", mode)
+	}
+
+	f := &rebindFilter{mode: mode, allowed: make(map[string]struct{}, len(allowlist))}
+	for _, domain := range allowlist {
+		suffix := dns.Fqdn(strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "*.")))
+		if _, ok := dns.IsDomainName(suffix); !ok || suffix == "." {
+			return nil, fmt.Errorf("invalid rebinding allowlist domain %q", domain)
+		}
+		f.allowed[suffix] = struct{}{}
+	}
+	return f, nil
+}
+
+// allows reports whether name or one of its parents is on the allowlist
+func (f *rebindFilter) allows(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	for {
+		if _, ok := f.allowed[name]; ok {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// localAddress reports whether ip belongs to the local network or host
+func localAddress(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+}
+
+// filter returns answer without records pointing into the local network,
+// and whether there were any. unwrap maps translated addresses, such as
+// DNS64 ones, back to the address they stand for.
+func (f *rebindFilter) filter(answer []dns.RR, unwrap func(net.IP) net.IP) ([]dns.RR, bool) {
+	var kept []dns.RR
+	found := false
+	for _, rr := range answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = unwrap(rr.AAAA)
+		}
+		if ip != nil && localAddress(ip) {
+			found = true
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	return kept, found
+}
+
+// checkRebinding applies rebinding protection to an upstream answer for
+// name. Names on the allowlist or under a conditional forwarding rule,
+// whose upstreams are internal by design, are left alone.
+func (s *Server) checkRebinding(name string, answer []dns.RR) ([]dns.RR, bool) {
+	if s.rebind == nil || s.rebind.allows(name) || s.upstreams.route(name) != s.upstreams.defaults {
+		return answer, false
+	}
+
+	kept, found := s.rebind.filter(answer, s.dns64.extract)
+	if !found {
+		return answer, false
+	}
+	log.Printf("Rebinding protection: %s answered with a local address (%s)", name, s.rebind.mode)
+	return kept, true
+}
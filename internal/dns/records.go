@@ -0,0 +1,452 @@
+package dns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+	"github.com/vivek-pk/goadblock/internal/atomicfile"
+)
+
+// defaultRecordTTL is used for local records that don't set a TTL
+const defaultRecordTTL = 300
+
+// maxCNAMEChain bounds how many local CNAMEs are followed for one query
+const maxCNAMEChain = 8
+
+var (
+	ErrRecordExists   = errors.New("record already exists")
+	ErrRecordNotFound = errors.New("record not found")
+)
+
+// LocalRecord is a DNS record served authoritatively instead of being
+// forwarded. Names may start with "*." to cover every subdomain, and a PTR
+// record's name may be given as the IP address it describes.
+//
+// Values depend on the type: an address for A and AAAA, a host name for
+// CNAME and PTR, free text for TXT and "priority weight port target" for
+// SRV.
+type LocalRecord struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	TTL   uint32 `json:"ttl,omitempty"`
+}
+
+// localRecord is a validated LocalRecord with its resource record template
+type localRecord struct {
+	LocalRecord
+	fqdn  string
+	qtype uint16
+	rr    dns.RR // Owner name is replaced per query for wildcards
+}
+
+// compile validates a record, normalizing its name
+func (r LocalRecord) compile() (*localRecord, error) {
+	qtype, ok := dns.StringToType[strings.ToUpper(r.Type)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported record type %q", r.Type)
+	}
+	r.Type = dns.TypeToString[qtype]
+
+	name := strings.ToLower(strings.TrimSpace(r.Name))
+	if qtype == dns.TypePTR && net.ParseIP(name) != nil {
+		reverse, err := dns.ReverseAddr(name)
+		if err != nil {
+			return nil, err
+		}
+		name = reverse
+	}
+	name = dns.Fqdn(name)
+	if _, ok := dns.IsDomainName(name); !ok || name == "." || strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+		return nil, fmt.Errorf("invalid name %q", r.Name)
+	}
+	r.Name = strings.TrimSuffix(name, ".")
+
+	ttl := r.TTL
+	if ttl == 0 {
+		ttl = defaultRecordTTL
+	}
+	hdr := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
+
+	var rr dns.RR
+	switch qtype {
+	case dns.TypeA:
+		ip := net.ParseIP(r.Value)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", r.Value)
+		}
+		rr = &dns.A{Hdr: hdr, A: ip.To4()}
+	case dns.TypeAAAA:
+		ip := net.ParseIP(r.Value)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", r.Value)
+		}
+		rr = &dns.AAAA{Hdr: hdr, AAAA: ip}
+	case dns.TypeCNAME, dns.TypePTR:
+		target, err := hostName(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		if qtype == dns.TypeCNAME {
+			rr = &dns.CNAME{Hdr: hdr, Target: target}
+		} else {
+			rr = &dns.PTR{Hdr: hdr, Ptr: target}
+		}
+	case dns.TypeTXT:
+		if r.Value == "" {
+			return nil, errors.New("TXT value is required")
+		}
+		rr = &dns.TXT{Hdr: hdr, Txt: splitTXT(r.Value)}
+	case dns.TypeSRV:
+		srv, err := parseSRV(hdr, r.Value)
+		if err != nil {
+			return nil, err
+		}
+		rr = srv
+	default:
+		return nil, fmt.Errorf("unsupported record type %q", r.Type)
+	}
+
+	return &localRecord{LocalRecord: r, fqdn: name, qtype: qtype, rr: rr}, nil
+}
+
+// hostName validates a target host name and makes it fully qualified
+func hostName(value string) (string, error) {
+	name := dns.Fqdn(strings.ToLower(strings.TrimSpace(value)))
+	if _, ok := dns.IsDomainName(name); !ok || name == "." || strings.Contains(name, "*") {
+		return "", fmt.Errorf("invalid host name %q", value)
+	}
+	return name, nil
+}
+
+// splitTXT breaks text into the 255 byte strings a TXT record is made of
+func splitTXT(text string) []string {
+	var parts []string
+	for len(text) > 255 {
+		parts = append(parts, text[:255])
+		text = text[255:]
+	}
+	return append(parts, text)
+}
+
+// parseSRV parses "priority weight port target"
+func parseSRV(hdr dns.RR_Header, value string) (*dns.SRV, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("SRV value %q is not \"priority weight port target\"", value)
+	}
+
+	var nums [3]uint16
+	for i := range nums {
+		n, err := strconv.ParseUint(fields[i], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SRV value %q: %w", value, err)
+		}
+		nums[i] = uint16(n)
+	}
+
+	target, err := hostName(fields[3])
+	if err != nil {
+		return nil, err
+	}
+	return &dns.SRV{Hdr: hdr, Priority: nums[0], Weight: nums[1], Port: nums[2], Target: target}, nil
+}
+
+// RecordManager holds the local records and persists changes to disk
+type RecordManager struct {
+	path    string
+	mu      sync.RWMutex
+	records map[string]*localRecord   // By ID
+	names   map[string][]*localRecord // By owner name, wildcards as "*.domain."
+	ptrs    map[string][]*localRecord // Reverse names of A and AAAA records
+}
+
+// NewRecordManager creates a manager persisting to path. An empty path
+// disables persistence.
+func NewRecordManager(path string) *RecordManager {
+	m := &RecordManager{
+		path:    path,
+		records: make(map[string]*localRecord),
+	}
+	m.reindexLocked()
+	return m
+}
+
+// Load reads persisted records, falling back to defaults when nothing has
+// been saved yet
+func (m *RecordManager) Load(defaults []LocalRecord) error {
+	records := defaults
+	if m.path != "" {
+		data, err := os.ReadFile(m.path)
+		switch {
+		case err == nil:
+			records = nil
+			if err := json.Unmarshal(data, &records); err != nil {
+				return fmt.Errorf("failed to parse %s: %w", m.path, err)
+			}
+		case !os.IsNotExist(err):
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, record := range records {
+		if record.ID == "" {
+			record.ID = uuid.New().String()
+		}
+		if err := m.putLocked(record); err != nil {
+			return fmt.Errorf("record %s %s: %w", record.Name, record.Type, err)
+		}
+	}
+	m.reindexLocked()
+	return nil
+}
+
+// List returns all records sorted by name and type
+func (m *RecordManager) List() []LocalRecord {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.listLocked()
+}
+
+// Add validates and stores a new record, assigning its ID
+func (m *RecordManager) Add(record LocalRecord) (LocalRecord, error) {
+	record.ID = uuid.New().String()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.putLocked(record); err != nil {
+		return LocalRecord{}, err
+	}
+	if err := m.saveOrRevertLocked(record.ID, nil); err != nil {
+		return LocalRecord{}, err
+	}
+	return m.records[record.ID].LocalRecord, nil
+}
+
+// Update replaces an existing record
+func (m *RecordManager) Update(id string, record LocalRecord) (LocalRecord, error) {
+	record.ID = id
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, exists := m.records[id]
+	if !exists {
+		return LocalRecord{}, ErrRecordNotFound
+	}
+	delete(m.records, id)
+	if err := m.putLocked(record); err != nil {
+		m.records[id] = old
+		return LocalRecord{}, err
+	}
+	if err := m.saveOrRevertLocked(id, old); err != nil {
+		return LocalRecord{}, err
+	}
+	return m.records[id].LocalRecord, nil
+}
+
+// Remove deletes a record
+func (m *RecordManager) Remove(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, exists := m.records[id]
+	if !exists {
+		return ErrRecordNotFound
+	}
+	delete(m.records, id)
+	return m.saveOrRevertLocked(id, old)
+}
+
+// putLocked validates a record and stores it. A name with a CNAME may have
+// no other records, as in regular zones.
+func (m *RecordManager) putLocked(record LocalRecord) error {
+	c, err := record.compile()
+	if err != nil {
+		return err
+	}
+
+	for _, other := range m.records {
+		if other.fqdn != c.fqdn {
+			continue
+		}
+		if other.qtype == c.qtype && other.rr.String() == c.rr.String() {
+			return ErrRecordExists
+		}
+		if other.qtype == dns.TypeCNAME || c.qtype == dns.TypeCNAME {
+			return fmt.Errorf("%s cannot have a CNAME and other records", c.Name)
+		}
+	}
+	m.records[c.ID] = c
+	return nil
+}
+
+// reindexLocked rebuilds the lookup indexes
+func (m *RecordManager) reindexLocked() {
+	m.names = make(map[string][]*localRecord)
+	m.ptrs = make(map[string][]*localRecord)
+
+	for _, record := range m.records {
+		m.names[record.fqdn] = append(m.names[record.fqdn], record)
+		if strings.HasPrefix(record.fqdn, "*.") {
+			continue
+		}
+
+		var ip net.IP
+		switch rr := record.rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+		ptr := &localRecord{
+			LocalRecord: LocalRecord{Name: record.Name, Type: "PTR", Value: record.Name},
+			fqdn:        reverse,
+			qtype:       dns.TypePTR,
+			rr: &dns.PTR{
+				Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: record.rr.Header().Ttl},
+				Ptr: record.fqdn,
+			},
+		}
+		m.ptrs[reverse] = append(m.ptrs[reverse], ptr)
+	}
+
+	for _, records := range m.names {
+		sortRecords(records)
+	}
+	for _, records := range m.ptrs {
+		sortRecords(records)
+	}
+}
+
+func sortRecords(records []*localRecord) {
+	sort.Slice(records, func(i, j int) bool { return records[i].rr.String() < records[j].rr.String() })
+}
+
+// recordsLocked returns the records owning name: an exact match, else the
+// closest wildcard, else PTRs derived from address records
+func (m *RecordManager) recordsLocked(name string) []*localRecord {
+	if records, ok := m.names[name]; ok {
+		return records
+	}
+
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		if records, ok := m.names["*."+dns.Fqdn(strings.Join(labels[i:], "."))]; ok {
+			return records
+		}
+	}
+
+	return m.ptrs[name]
+}
+
+// lookup answers a question from local records. found reports whether the
+// name is local; the answer is then authoritative even when empty. When a
+// CNAME chain leaves the local records, target is the name that still
+// needs resolving upstream.
+func (m *RecordManager) lookup(name string, qtype uint16) (answer []dns.RR, target string, found bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	name = strings.ToLower(dns.Fqdn(name))
+	for i := 0; i < maxCNAMEChain; i++ {
+		records := m.recordsLocked(name)
+		if len(records) == 0 {
+			if i == 0 {
+				return nil, "", false
+			}
+			return answer, name, true
+		}
+
+		var cname *dns.CNAME
+		for _, record := range records {
+			if record.qtype != qtype && record.qtype != dns.TypeCNAME {
+				continue
+			}
+			rr := dns.Copy(record.rr)
+			rr.Header().Name = name
+			answer = append(answer, rr)
+			if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+
+		if cname == nil || qtype == dns.TypeCNAME {
+			return answer, "", true
+		}
+		name = cname.Target
+	}
+	return answer, "", true
+}
+
+// saveOrRevertLocked persists a change to one record and reindexes. If that
+// fails the record is put back the way it was, old being nil when it did not
+// exist, so that a change reported as failed never takes effect.
+func (m *RecordManager) saveOrRevertLocked(id string, old *localRecord) error {
+	err := m.saveLocked()
+	if err != nil {
+		if old == nil {
+			delete(m.records, id)
+		} else {
+			m.records[id] = old
+		}
+	}
+	m.reindexLocked()
+	return err
+}
+
+// saveLocked persists the records, must be called with m.mu held
+func (m *RecordManager) saveLocked() error {
+	if m.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(m.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		return err
+	}
+
+	return atomicfile.Write(m.path, data)
+}
+
+func (m *RecordManager) listLocked() []LocalRecord {
+	records := make([]LocalRecord, 0, len(m.records))
+	for _, record := range m.records {
+		records = append(records, record.LocalRecord)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Name != records[j].Name {
+			return records[i].Name < records[j].Name
+		}
+		if records[i].Type != records[j].Type {
+			return records[i].Type < records[j].Type
+		}
+		return records[i].ID < records[j].ID
+	})
+	return records
+}
@@ -0,0 +1,71 @@
+package dns
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Safe search endpoints the providers offer for network-level enforcement
+const (
+	googleSafeSearch  = "forcesafesearch.google.com."
+	bingSafeSearch    = "strict.bing.com."
+	duckSafeSearch    = "safe.duckduckgo.com."
+	youtubeRestricted = "restrict.youtube.com."
+)
+
+// safeSearchHosts maps hostnames to the endpoint that enforces safe search
+// or restricted mode for them
+var safeSearchHosts = map[string]string{
+	"www.bing.com":             bingSafeSearch,
+	"bing.com":                 bingSafeSearch,
+	"duckduckgo.com":           duckSafeSearch,
+	"www.duckduckgo.com":       duckSafeSearch,
+	"start.duckduckgo.com":     duckSafeSearch,
+	"www.youtube.com":          youtubeRestricted,
+	"m.youtube.com":            youtubeRestricted,
+	"youtube.com":              youtubeRestricted,
+	"youtubei.googleapis.com":  youtubeRestricted,
+	"youtube.googleapis.com":   youtubeRestricted,
+	"www.youtube-nocookie.com": youtubeRestricted,
+	"music.youtube.com":        youtubeRestricted,
+	"youtube-ui.l.google.com":  youtubeRestricted,
+}
+
+// googleSearch matches Google's search hosts on every country domain, e.g.
+// www.google.com, google.de or www.google.co.uk
+var googleSearch = regexp.MustCompile(`^(www\.)?google\.([a-z]{2,3}|com?\.[a-z]{2})$`)
+
+// safeSearchTarget returns the safe search endpoint for a query name, if
+// there is one
+func safeSearchTarget(name string) (string, bool) {
+	host := strings.TrimSuffix(strings.ToLower(name), ".")
+	if target, ok := safeSearchHosts[host]; ok {
+		return target, true
+	}
+	if googleSearch.MatchString(host) {
+		return googleSafeSearch, true
+	}
+	return "", false
+}
+
+// rewriteTarget returns the name a query should be answered with a CNAME
+// to, for clients of group
+func (s *Server) rewriteTarget(q dns.Question, group *clientGroup) (string, bool) {
+	if group != nil && group.SafeSearch {
+		return safeSearchTarget(q.Name)
+	}
+	return "", false
+}
+
+// resolveRewrite answers q with a CNAME to target followed by the target's
+// records, resolved through the cache and upstream servers like any other
+// query
+func (s *Server) resolveRewrite(r *dns.Msg, q dns.Question, target string) []dns.RR {
+	answer := []dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+		Target: target,
+	}}
+	return append(answer, s.resolveTarget(r, target, q)...)
+}
@@ -2,6 +2,7 @@ package dns
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
@@ -14,27 +15,116 @@ import (
 
 // Server represents a DNS server
 type Server struct {
-	blocker         *blocker.Blocker
-	notifier        BlockNotifier
-	server          *dns.Server
-	cache           *DNSCache
-	upstreamAddrs   []string
-	currentUpstream int
-	metrics         *Metrics
-	shutdown        chan struct{}
-	apiNotifier     APINotifier
-	Ready           chan struct{}
-	blockingMode    string
-	blockingIP      net.IP
+	blocker      *blocker.Blocker
+	notifier     BlockNotifier
+	servers      []*dns.Server
+	listenMu     sync.Mutex
+	listening    []*dns.Server // The servers that started, and need shutting down
+	tlsAddr      string
+	tlsConfig    *tls.Config // DNS-over-TLS is served when set
+	cache        *DNSCache
+	upstreams    *forwarders
+	metrics      *Metrics
+	shutdown     chan struct{}
+	apiNotifier  APINotifier
+	Ready        chan struct{}
+	blockingMode string
+	blockingIP   net.IP
+	pause        *pauseState
+	groups       *GroupManager
+	records      *RecordManager
+	hosts        *hostsFile
+	leases       *leaseTable
+	leaseFile    *leaseFile
+	rebind       *rebindFilter
+	dns64        *dns64
+	access       *accessList
+	limiter      *rateLimiter
+	qtypes       *qtypeFilter
+	refuseAny    bool
 }
 
 type ServerConfig struct {
 	UpstreamServers []string
+	Forwarders      []ForwardRule // Per-suffix upstreams, longest suffix wins
+	LocalResolver   string        // Answers reverse lookups for private ranges, e.g. the router
+	HostsFile       string        // Static address to name mappings for client hostnames
+	LeaseFile       string        // DHCP lease file naming clients, see WatchLeases
+	LeaseFormat     string        // dnsmasq or isc, detected when empty
+	LeaseDomain     string        // Domain of names served from leases, "lan" by default
+	ServeLeases     bool          // Answer A, AAAA and PTR queries for leased hosts, from any source
+	RebindProtect   bool          // Stop public names from answering with local addresses
+	RebindMode      string        // block (default) or drop
+	RebindAllowlist []string      // Domains allowed to answer with local addresses
+	DNS64Prefix     string        // NAT64 prefix AAAA records are synthesized in, e.g. 64:ff9b::/96
+	DNS64Clients    []string      // Addresses or CIDRs of NAT64 clients, every client when empty
+	TLSAddr         string        // DNS-over-TLS listen address, ":853" by default
+	TLSCertFile     string        // Certificate and key enabling DNS-over-TLS
+	TLSKeyFile      string
+	AllowedClients  []string      // Addresses or CIDRs allowed to query, everyone when empty
+	DeniedClients   []string      // Addresses or CIDRs refused even when allowed
+	RateLimit       RateLimit     // Per-client query limits
+	RefuseAny       bool          // Answer ANY queries with REFUSED
+	QtypePolicies   []QtypePolicy // Query types answered with NODATA, per client group
 	BlockingMode    string
 	BlockingIP      string
 	CacheSize       int
 }
 
+// Validate checks the parts of the config NewServer cannot repair
+func (c ServerConfig) Validate() error {
+	upstreams := c.UpstreamServers
+	if len(upstreams) == 0 {
+		upstreams = []string{"8.8.8.8:53"}
+	}
+	if _, err := newForwarders(upstreams, c.forwardRules()); err != nil {
+		return err
+	}
+	if !ValidLeaseFormat(c.LeaseFormat) {
+		return fmt.Errorf("unsupported lease format %q", c.LeaseFormat)
+	}
+	if c.RebindProtect {
+		if _, err := newRebindFilter(c.RebindMode, c.RebindAllowlist); err != nil {
+			return err
+		}
+	}
+	if _, err := c.tlsConfig(); err != nil {
+		return err
+	}
+	if _, err := newAccessList(c.AllowedClients, c.DeniedClients); err != nil {
+		return err
+	}
+	if _, err := newDNS64(c.DNS64Prefix, c.DNS64Clients); err != nil {
+		return err
+	}
+	if _, err := newQtypeFilter(c.QtypePolicies); err != nil {
+		return err
+	}
+	_, err := newRateLimiter(c.RateLimit)
+	return err
+}
+
+// tlsConfig loads the DNS-over-TLS certificate, nil when none is configured
+func (c ServerConfig) tlsConfig() (*tls.Config, error) {
+	if c.TLSCertFile == "" && c.TLSKeyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load DNS-over-TLS certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// forwardRules returns the configured rules plus those sending private
+// reverse lookups to the local resolver
+func (c ServerConfig) forwardRules() []ForwardRule {
+	if c.LocalResolver == "" {
+		return c.Forwarders
+	}
+	return append(append([]ForwardRule(nil), c.Forwarders...), localResolverRules(c.LocalResolver, c.Forwarders)...)
+}
+
 type DNSCache struct {
 	entries map[string]*CacheEntry
 	mu      sync.RWMutex
@@ -46,15 +136,17 @@ type CacheEntry struct {
 }
 
 type Metrics struct {
-	TotalQueries   int64
-	BlockedQueries int64
-	CacheHits      int64
-	CacheMisses    int64
-	mu             sync.RWMutex
+	TotalQueries       int64
+	BlockedQueries     int64
+	CacheHits          int64
+	CacheMisses        int64
+	RateLimitedQueries int64
+	RefusedQueries     int64 // Queries from clients outside the access lists
+	mu                 sync.RWMutex
 }
 
 type APINotifier interface {
-	AddQuery(domain string, clientIP string, blocked bool)
+	AddQuery(domain string, clientIP string, blocked bool, reason string)
 }
 
 // BlockNotifier is an interface for components that need to be notified of blocked domains
@@ -81,18 +173,83 @@ func NewServer(blocker *blocker.Blocker, apiNotifier APINotifier, config ServerC
 		config.CacheSize = 10000
 	}
 
+	upstreams, err := newForwarders(config.UpstreamServers, config.forwardRules())
+	if err != nil {
+		log.Printf("Ignoring forwarding rules: %v", err)
+		upstreams, _ = newForwarders(config.UpstreamServers, nil)
+	}
+
+	var rebind *rebindFilter
+	if config.RebindProtect {
+		if rebind, err = newRebindFilter(config.RebindMode, config.RebindAllowlist); err != nil {
+			log.Printf("Rebinding protection falls back to defaults: %v", err)
+			rebind, _ = newRebindFilter(RebindBlock, nil)
+		}
+	}
+
+	// Failing open would expose the resolver, so refuse everyone instead
+	access, err := newAccessList(config.AllowedClients, config.DeniedClients)
+	if err != nil {
+		log.Printf("Refusing all clients: %v", err)
+		everyone, _ := parseNetworks([]string{"0.0.0.0/0", "::/0"})
+		access = &accessList{denied: everyone}
+	}
+
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		log.Printf("DNS-over-TLS disabled: %v", err)
+	}
+	if config.TLSAddr == "" {
+		config.TLSAddr = ":853"
+	}
+
+	limiter, err := newRateLimiter(config.RateLimit)
+	if err != nil {
+		log.Printf("Rate limiting disabled: %v", err)
+	}
+
+	nat64, err := newDNS64(config.DNS64Prefix, config.DNS64Clients)
+	if err != nil {
+		log.Printf("DNS64 disabled: %v", err)
+	}
+
+	qtypes, err := newQtypeFilter(config.QtypePolicies)
+	if err != nil {
+		log.Printf("Ignoring qtype policies: %v", err)
+	}
+
+	leases := newLeaseTable(config.LeaseDomain, config.ServeLeases)
+	var leaseSource *leaseFile
+	if config.LeaseFile != "" {
+		leaseSource = &leaseFile{path: config.LeaseFile, format: config.LeaseFormat, table: leases}
+	}
+
 	return &Server{
 		blocker:     blocker,
 		apiNotifier: apiNotifier,
 		cache: &DNSCache{
 			entries: make(map[string]*CacheEntry, config.CacheSize),
 		},
-		upstreamAddrs: config.UpstreamServers,
-		metrics:       &Metrics{},
-		shutdown:      make(chan struct{}),
-		Ready:         make(chan struct{}),
-		blockingMode:  config.BlockingMode,
-		blockingIP:    net.ParseIP(config.BlockingIP),
+		upstreams:    upstreams,
+		metrics:      &Metrics{},
+		shutdown:     make(chan struct{}),
+		Ready:        make(chan struct{}),
+		blockingMode: config.BlockingMode,
+		blockingIP:   net.ParseIP(config.BlockingIP),
+		pause:        newPauseState(),
+		groups:       NewGroupManager(""),
+		records:      NewRecordManager(""),
+		hosts:        &hostsFile{path: config.HostsFile},
+		leases:       leases,
+		leaseFile:    leaseSource,
+		rebind:       rebind,
+		dns64:        nat64,
+		tlsAddr:      config.TLSAddr,
+		tlsConfig:    tlsConfig,
+		access:       access,
+		limiter:      limiter,
+		qtypes:       qtypes,
+		refuseAny:    config.RefuseAny,
 	}
 }
 
@@ -110,24 +267,112 @@ func NewServerSimple(blocker *blocker.Blocker, apiNotifier APINotifier) *Server
 }
 
 func (s *Server) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	// Answering responses could loop between two servers
+	if r.Response {
+		return
+	}
 	s.metrics.incrementTotal()
 
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Compress = false
 
+	clientIP, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	if !s.access.permits(clientIP) {
+		s.metrics.incrementRefused()
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+	if !s.limiter.allow(clientIP) {
+		s.metrics.incrementRateLimited()
+		if s.limiter.respond(w, m) {
+			w.WriteMsg(m)
+		}
+		return
+	}
+
 	switch r.Opcode {
 	case dns.OpcodeQuery:
+		if rcode, err := checkQuery(r); err != nil {
+			log.Printf("Answering query from %s with %s: %v", clientIP, dns.RcodeToString[rcode], err)
+			m.Rcode = rcode
+			break
+		}
+		group := s.resolveGroup(w, r, clientIP)
+
 		for _, q := range m.Question {
+			// ANY is a favourite of amplification attacks and has no
+			// legitimate use against a resolver (RFC 8482)
+			if q.Qtype == dns.TypeANY && s.refuseAny {
+				m.Rcode = dns.RcodeRefused
+				break
+			}
+
+			// Filtered types get NODATA: the name exists, just not with
+			// records of this type, so clients fall back instead of failing
+			if policy, ok := s.qtypes.match(q.Qtype, group); ok {
+				reason := "qtype:" + policy
+				log.Printf("DNS query: %s %s, blocked: true, reason: %s", q.Name, dns.TypeToString[q.Qtype], reason)
+				if s.apiNotifier != nil {
+					s.apiNotifier.AddQuery(q.Name, clientIP, true, reason)
+				}
+				if s.notifier != nil {
+					s.notifier.OnDomainBlocked(q.Name, clientIP, reason)
+				}
+				s.metrics.incrementBlocked()
+				continue
+			}
+
+			// Local records are answered authoritatively and never blocked
+			if answer, target, ok := s.records.lookup(q.Name, q.Qtype); ok {
+				m.Authoritative = true
+				if target != "" {
+					answer = append(answer, s.resolveTarget(r, target, q)...)
+				}
+				m.Answer = append(m.Answer, answer...)
+				if s.apiNotifier != nil {
+					s.apiNotifier.AddQuery(q.Name, clientIP, false, "")
+				}
+				continue
+			}
+			if answer, ok := s.leases.lookup(q.Name, q.Qtype); ok {
+				m.Authoritative = true
+				m.Answer = append(m.Answer, answer...)
+				if s.apiNotifier != nil {
+					s.apiNotifier.AddQuery(q.Name, clientIP, false, "")
+				}
+				continue
+			}
+
 			switch q.Qtype {
 			case dns.TypeA, dns.TypeAAAA:
-				clientIP, _, _ := net.SplitHostPort(w.RemoteAddr().String())
-				isBlocked, reason := s.blocker.IsBlocked(q.Name)
+				isBlocked, reason := false, ""
+				if !s.blockingPaused(clientIP, group) && !s.upstreams.skipBlocking(q.Name) {
+					isBlocked, reason = s.blocker.IsBlockedFor(q.Name, group.getPolicy())
+				}
+
+				var answer []dns.RR
+				dropped := false // Rebinding addresses stripped, the rest is answered
+				if !isBlocked {
+					if target, ok := s.rewriteTarget(q, group); ok {
+						answer = s.resolveRewrite(r, q, target)
+					} else {
+						answer = s.resolve(r, q)
+						if s.dns64.applies(q, clientIP, answer) {
+							answer = s.resolveDNS64(r, q)
+						}
+						if kept, rebinding := s.checkRebinding(q.Name, answer); rebinding {
+							isBlocked, reason = true, reasonRebinding
+							answer, dropped = kept, s.rebind.mode == RebindDrop
+						}
+					}
+				}
 				log.Printf("DNS query: %s, blocked: %v, reason: %s", q.Name, isBlocked, reason)
 
 				// Notify API server of query
 				if s.apiNotifier != nil {
-					s.apiNotifier.AddQuery(q.Name, clientIP, isBlocked)
+					s.apiNotifier.AddQuery(q.Name, clientIP, isBlocked, reason)
 				}
 
 				if isBlocked {
@@ -135,53 +380,133 @@ func (s *Server) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 					if s.notifier != nil {
 						s.notifier.OnDomainBlocked(q.Name, clientIP, reason)
 					}
-
 					s.metrics.incrementBlocked()
-					if q.Qtype == dns.TypeA {
-						m.Answer = append(m.Answer, &dns.A{
-							Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-							A:   net.IPv4(0, 0, 0, 0), // Block by returning 0.0.0.0
-						})
-					} else {
-						m.Answer = append(m.Answer, &dns.AAAA{
-							Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
-							AAAA: net.IPv6zero, // Block IPv6 too
-						})
-					}
+				}
 
-					log.Printf("Blocked domain %s, returning null IP", q.Name)
+				if isBlocked && !dropped {
+					mode, ip := s.blockingFor(group)
+					blockResponse(m, q, mode, ip)
+
+					log.Printf("Blocked domain %s, answering with %s", q.Name, mode)
 				} else {
-					// Check cache first
-					if answer := s.checkCache(q.Name, q.Qtype); answer != nil {
-						m.Answer = answer
-						s.metrics.incrementCacheHit()
-					} else {
-						s.metrics.incrementCacheMiss()
-						resp, err := s.queryUpstream(r)
-						if err == nil && resp != nil {
-							m.Answer = resp.Answer
-							s.updateCache(q.Name, q.Qtype, resp.Answer)
-						}
+					m.Answer = append(m.Answer, answer...)
+				}
+			case dns.TypePTR:
+				if isPrivateReverse(q.Name) && !s.forwardsPrivate(q.Name) {
+					// Public resolvers know nothing about private addresses
+					m.Rcode = dns.RcodeNameError
+				} else if resp, err := s.queryUpstream(r); err == nil && resp != nil {
+					m.Answer = append(m.Answer, resp.Answer...)
+					m.Rcode = resp.Rcode
+				}
+			default:
+				// Other types go to the upstream for the name, except for
+				// blocked names, which get NODATA
+				if !s.blockingPaused(clientIP, group) && !s.upstreams.skipBlocking(q.Name) {
+					if isBlocked, _ := s.blocker.IsBlockedFor(q.Name, group.getPolicy()); isBlocked {
+						continue
 					}
 				}
+				if resp, err := s.queryUpstream(r); err == nil && resp != nil {
+					m.Answer = append(m.Answer, resp.Answer...)
+					m.Rcode = resp.Rcode
+				}
 			}
 		}
+	case dns.OpcodeNotify:
+		// No secondary zones are served, so there is nothing to refresh
+		m.Rcode = dns.RcodeRefused
+	case dns.OpcodeUpdate:
+		// Local records change through the API, never dynamic updates
+		m.Rcode = dns.RcodeNotAuth
+	default:
+		m.Rcode = dns.RcodeNotImplemented
 	}
 
 	w.WriteMsg(m)
 }
 
+// resolveGroup finds the client group for a query, nil when the client
+// belongs to none
+func (s *Server) resolveGroup(w dns.ResponseWriter, r *dns.Msg, clientIP string) *clientGroup {
+	client := ClientInfo{IP: clientIP, MAC: clientMAC(r)}
+	if client.MAC == "" {
+		// Without EDNS the DHCP lease can still tell who is asking
+		client.MAC = s.ClientMAC(clientIP)
+	}
+	if dw, ok := w.(*dohWriter); ok {
+		client.Token = dw.token
+	}
+	return s.groups.resolve(client)
+}
+
+// blockingFor returns how blocked queries are answered for a group, falling
+// back to the server defaults
+func (s *Server) blockingFor(group *clientGroup) (string, net.IP) {
+	mode, ip := s.blockingMode, s.blockingIP
+	if group != nil {
+		if group.BlockingMode != "" {
+			mode = group.BlockingMode
+		}
+		if group.blockingIP != nil {
+			ip = group.blockingIP
+		}
+	}
+	return mode, ip
+}
+
+// resolve answers q through the cache and upstream servers
+func (s *Server) resolve(r *dns.Msg, q dns.Question) []dns.RR {
+	if answer := s.checkCache(q.Name, q.Qtype); answer != nil {
+		s.metrics.incrementCacheHit()
+		return answer
+	}
+	s.metrics.incrementCacheMiss()
+
+	resp, err := s.queryUpstream(r)
+	if err != nil || resp == nil {
+		return nil
+	}
+	s.updateCache(q.Name, q.Qtype, resp.Answer)
+	return resp.Answer
+}
+
+// resolveTarget resolves the records of a CNAME target for q through the
+// cache and upstream servers
+func (s *Server) resolveTarget(r *dns.Msg, target string, q dns.Question) []dns.RR {
+	if cached := s.checkCache(target, q.Qtype); cached != nil {
+		s.metrics.incrementCacheHit()
+		return cached
+	}
+	s.metrics.incrementCacheMiss()
+
+	req := r.Copy()
+	req.Question = []dns.Question{{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}}
+	resp, err := s.queryUpstream(req)
+	if err != nil || resp == nil {
+		return nil
+	}
+	s.updateCache(target, q.Qtype, resp.Answer)
+	return resp.Answer
+}
+
+// queryUpstream forwards r to the upstreams responsible for its name
 func (s *Server) queryUpstream(r *dns.Msg) (*dns.Msg, error) {
-	// Round-robin through upstream servers
-	s.currentUpstream = (s.currentUpstream + 1) % len(s.upstreamAddrs)
-	return dns.Exchange(r, s.upstreamAddrs[s.currentUpstream])
+	name := "."
+	if len(r.Question) > 0 {
+		name = r.Question[0].Name
+	}
+	return s.upstreams.route(name).exchange(r)
 }
 
 func (s *Server) checkCache(name string, qtype uint16) []dns.RR {
+	return s.checkCacheKey(getCacheKey(name, qtype))
+}
+
+func (s *Server) checkCacheKey(key string) []dns.RR {
 	s.cache.mu.RLock()
 	defer s.cache.mu.RUnlock()
 
-	key := getCacheKey(name, qtype)
 	if entry, exists := s.cache.entries[key]; exists && time.Now().Before(entry.ExpiresAt) {
 		return entry.Answer
 	}
@@ -189,6 +514,10 @@ func (s *Server) checkCache(name string, qtype uint16) []dns.RR {
 }
 
 func (s *Server) updateCache(name string, qtype uint16, answer []dns.RR) {
+	s.updateCacheKey(getCacheKey(name, qtype), answer)
+}
+
+func (s *Server) updateCacheKey(key string, answer []dns.RR) {
 	if len(answer) == 0 {
 		return
 	}
@@ -197,7 +526,7 @@ func (s *Server) updateCache(name string, qtype uint16, answer []dns.RR) {
 	defer s.cache.mu.Unlock()
 
 	// Cache for 5 minutes
-	s.cache.entries[getCacheKey(name, qtype)] = &CacheEntry{
+	s.cache.entries[key] = &CacheEntry{
 		Answer:    answer,
 		ExpiresAt: time.Now().Add(5 * time.Minute),
 	}
@@ -222,6 +551,18 @@ func (m *Metrics) incrementBlocked() {
 	log.Printf("Blocked queries: %d", m.BlockedQueries) // Debug log
 }
 
+func (m *Metrics) incrementRateLimited() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.RateLimitedQueries++
+}
+
+func (m *Metrics) incrementRefused() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.RefusedQueries++
+}
+
 func (m *Metrics) incrementCacheHit() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -240,16 +581,45 @@ func (s *Server) GetMetrics() *Metrics {
 	return s.metrics
 }
 
+// Start serves DNS over UDP and TCP on addr, and over TLS when a certificate
+// is configured. Every transport goes through the same handler.
 func (s *Server) Start(addr string) error {
-	s.server = &dns.Server{Addr: addr, Net: "udp"}
-	dns.HandleFunc(".", s.handleRequest)
+	handler := dns.HandlerFunc(s.handleRequest)
+	s.servers = []*dns.Server{
+		{Addr: addr, Net: "udp", Handler: handler, MsgAcceptFunc: acceptMsg},
+		{Addr: addr, Net: "tcp", Handler: handler, MsgAcceptFunc: acceptMsg},
+	}
+	if s.tlsConfig != nil {
+		s.servers = append(s.servers, &dns.Server{
+			Addr: s.tlsAddr, Net: "tcp-tls", TLSConfig: s.tlsConfig, Handler: handler, MsgAcceptFunc: acceptMsg,
+		})
+	}
 
-	errChan := make(chan error, 1)
-	go func() {
-		errChan <- s.server.ListenAndServe()
-	}()
+	errChan := make(chan error, len(s.servers))
+	started := make(chan struct{}, len(s.servers))
+	for _, server := range s.servers {
+		server.NotifyStartedFunc = func() {
+			s.listenMu.Lock()
+			s.listening = append(s.listening, server)
+			s.listenMu.Unlock()
+			started <- struct{}{}
+		}
+		go func(server *dns.Server) {
+			if err := server.ListenAndServe(); err != nil {
+				errChan <- fmt.Errorf("%s: %w", server.Net, err)
+			}
+		}(server)
+	}
 
-	// Signal ready after successful bind
+	// Signal ready after every listener is bound
+	for range s.servers {
+		select {
+		case <-started:
+		case err := <-errChan:
+			s.shutdownListeners(context.Background())
+			return err
+		}
+	}
 	close(s.Ready)
 
 	// Wait for either shutdown signal or error
@@ -265,11 +635,24 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	// Signal shutdown
 	close(s.shutdown)
 
-	// Shutdown the DNS server
-	if s.server != nil {
-		return s.server.Shutdown()
+	return s.shutdownListeners(ctx)
+}
+
+// shutdownListeners stops the listeners that started, reporting the first
+// failure. Shutting down one that never started would fail.
+func (s *Server) shutdownListeners(ctx context.Context) error {
+	s.listenMu.Lock()
+	listening := s.listening
+	s.listening = nil
+	s.listenMu.Unlock()
+
+	var firstErr error
+	for _, server := range listening {
+		if err := server.ShutdownContext(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	return nil
+	return firstErr
 }
 
 func logQuery(domain string, isBlocked bool, clientIP net.IP) {
@@ -284,3 +667,52 @@ func logQuery(domain string, isBlocked bool, clientIP net.IP) {
 func (s *Server) GetBlocker() *blocker.Blocker {
 	return s.blocker
 }
+
+// SetGroups replaces the client group manager
+func (s *Server) SetGroups(groups *GroupManager) {
+	s.groups = groups
+}
+
+// SetRecords replaces the local record manager
+func (s *Server) SetRecords(records *RecordManager) {
+	s.records = records
+}
+
+// Records returns the local record manager
+func (s *Server) Records() *RecordManager {
+	return s.records
+}
+
+// Groups returns the client group manager
+func (s *Server) Groups() *GroupManager {
+	return s.groups
+}
+
+// QueryExplanation is the blocker's explanation of a domain together with
+// the decision the server makes for a particular client
+type QueryExplanation struct {
+	blocker.Explanation
+	Client   string `json:"client,omitempty"`
+	Group    string `json:"group,omitempty"`
+	Paused   bool   `json:"paused"`
+	Decision string `json:"decision"`
+}
+
+// Explain reports why a query for domain from clientIP would be blocked or
+// allowed. The client's group is resolved from its address only.
+func (s *Server) Explain(domain, clientIP string) QueryExplanation {
+	group := s.groups.resolve(ClientInfo{IP: clientIP})
+	exp := QueryExplanation{
+		Explanation: s.blocker.ExplainFor(domain, group.getPolicy()),
+		Client:      clientIP,
+		Paused:      s.blockingPaused(clientIP, group),
+		Decision:    "allowed",
+	}
+	if group != nil {
+		exp.Group = group.Name
+	}
+	if exp.Blocked && !exp.Paused {
+		exp.Decision = "blocked"
+	}
+	return exp
+}
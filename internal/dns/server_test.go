@@ -1,9 +1,22 @@
 package dns
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,15 +30,17 @@ type mockNotifier struct {
 		domain   string
 		clientIP string
 		blocked  bool
+		reason   string
 	}
 }
 
-func (m *mockNotifier) AddQuery(domain string, clientIP string, blocked bool) {
+func (m *mockNotifier) AddQuery(domain string, clientIP string, blocked bool, reason string) {
 	m.queries = append(m.queries, struct {
 		domain   string
 		clientIP string
 		blocked  bool
-	}{domain, clientIP, blocked})
+		reason   string
+	}{domain, clientIP, blocked, reason})
 }
 
 // findAvailablePort finds an available UDP port
@@ -283,3 +298,1294 @@ func TestQueryNotifications(t *testing.T) {
 		}
 	}
 }
+
+func TestPauseBlocking(t *testing.T) {
+	adblocker := blocker.New()
+	adblocker.AddDomainToBlocklist("ads.example.com", "custom")
+	server := NewServer(adblocker, nil, ServerConfig{})
+
+	if exp := server.Explain("ads.example.com.", "10.0.0.2"); exp.Decision != "blocked" {
+		t.Fatalf("Expected blocked before pausing, got %s", exp.Decision)
+	}
+
+	server.PauseBlocking(time.Minute, "10.0.0.2")
+	if exp := server.Explain("ads.example.com.", "10.0.0.2"); exp.Decision != "allowed" || !exp.Paused {
+		t.Errorf("Expected paused client to be allowed, got %s", exp.Decision)
+	}
+	if exp := server.Explain("ads.example.com.", "10.0.0.3"); exp.Decision != "blocked" {
+		t.Errorf("Expected other clients to stay blocked, got %s", exp.Decision)
+	}
+
+	server.PauseBlocking(time.Minute, "")
+	status := server.PauseStatus()
+	if !status.Paused || status.Remaining <= 0 || len(status.Clients) != 1 {
+		t.Errorf("Unexpected pause status: %+v", status)
+	}
+
+	server.ResumeBlocking("")
+	server.ResumeBlocking("10.0.0.2")
+	if exp := server.Explain("ads.example.com.", "10.0.0.2"); exp.Decision != "blocked" {
+		t.Errorf("Expected blocking to resume, got %s", exp.Decision)
+	}
+
+	server.PauseBlocking(-time.Second, "")
+	if server.PauseStatus().Paused {
+		t.Error("Expected an elapsed pause to be inactive")
+	}
+}
+
+func TestPauseBlockingForGroup(t *testing.T) {
+	adblocker := blocker.New()
+	adblocker.AddDomainToBlocklist("ads.example.com", "custom")
+	server := NewServer(adblocker, nil, ServerConfig{})
+	if err := server.Groups().Load([]ClientGroup{{Name: "kids", Clients: []string{"10.0.0.0/24"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	server.PauseGroup(time.Minute, "kids")
+	if exp := server.Explain("ads.example.com.", "10.0.0.2"); exp.Decision != "allowed" || !exp.Paused {
+		t.Errorf("Expected a client of the paused group to be allowed, got %s", exp.Decision)
+	}
+	if exp := server.Explain("ads.example.com.", "10.0.1.2"); exp.Decision != "blocked" {
+		t.Errorf("Expected clients outside the group to stay blocked, got %s", exp.Decision)
+	}
+	if status := server.PauseStatus(); status.Paused || len(status.Groups) != 1 {
+		t.Errorf("Unexpected pause status: %+v", status)
+	}
+
+	server.ResumeGroup("kids")
+	if exp := server.Explain("ads.example.com.", "10.0.0.2"); exp.Decision != "blocked" {
+		t.Errorf("Expected blocking to resume for the group, got %s", exp.Decision)
+	}
+}
+
+func TestClientGroups(t *testing.T) {
+	adblocker := blocker.New()
+	adblocker.AddDomainToBlocklist("ads.example.com", "ads")
+	adblocker.AddDomainToBlocklist("games.example.com", "gaming")
+	server := NewServer(adblocker, nil, ServerConfig{})
+
+	groups := server.Groups()
+	err := groups.Load([]ClientGroup{
+		{
+			Name:         "kids",
+			Clients:      []string{"10.0.0.0/24"},
+			Tokens:       []string{"tablet"},
+			Regexes:      []string{`(^|\.)video\.example\.com$`},
+			BlockingMode: BlockingNXDomain,
+		},
+		{
+			Name:      "work",
+			Clients:   []string{"10.0.0.7"},
+			MACs:      []string{"aa:bb:cc:dd:ee:ff"},
+			Lists:     []string{"ads"},
+			Allowlist: []string{"||ads.example.com^"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to load groups: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		domain   string
+		client   string
+		group    string
+		decision string
+	}{
+		{"group regex", "cdn.video.example.com.", "10.0.0.2", "kids", "blocked"},
+		{"regex not applied outside group", "cdn.video.example.com.", "10.0.1.2", "", "allowed"},
+		{"most specific client wins", "ads.example.com.", "10.0.0.7", "work", "allowed"},
+		{"list outside group policy", "games.example.com.", "10.0.0.7", "work", "allowed"},
+		{"default policy", "games.example.com.", "192.168.1.2", "", "blocked"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exp := server.Explain(tt.domain, tt.client)
+			if exp.Group != tt.group || exp.Decision != tt.decision {
+				t.Errorf("Expected group %q and %s, got group %q and %s", tt.group, tt.decision, exp.Group, exp.Decision)
+			}
+		})
+	}
+
+	// The work laptop behind a forwarder that adds its MAC
+	r := new(dns.Msg)
+	r.SetQuestion("games.example.com.", dns.TypeA)
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: ednsMACOption,
+		Data: []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+	})
+	r.Extra = append(r.Extra, opt)
+	if group := groups.Resolve(ClientInfo{IP: "192.168.1.2", MAC: clientMAC(r)}); group == nil || group.Name != "work" {
+		t.Errorf("Expected the MAC to resolve to work, got %+v", group)
+	}
+
+	// The kids' tablet over DoH gets NXDOMAIN from its group's blocking mode
+	query := new(dns.Msg)
+	query.SetQuestion("ads.example.com.", dns.TypeA)
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/dns-query/tablet", bytes.NewReader(packed))
+	req.Header.Set("Content-Type", dohMediaType)
+	rec := httptest.NewRecorder()
+	server.ServeDoH(rec, req, "tablet")
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rec.Body.Bytes()); err != nil {
+		t.Fatalf("Invalid DoH response: %v", err)
+	}
+	if resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+		t.Errorf("Expected NXDOMAIN for the kids group, got %s with %d answers",
+			dns.RcodeToString[resp.Rcode], len(resp.Answer))
+	}
+
+	if err := groups.Add(ClientGroup{Name: "iot", Clients: []string{"10.0.0.7"}}); err == nil {
+		t.Error("Expected a client already in another group to be rejected")
+	}
+	if err := groups.Add(ClientGroup{Name: "iot", BlockingMode: "sinkhole"}); err == nil {
+		t.Error("Expected an unknown blocking mode to be rejected")
+	}
+}
+
+// startFakeUpstream serves A records, or PTR records for PTR queries, for
+// the given names on a loopback port and returns its address
+func startFakeUpstream(t testing.TB, addrs map[string]string) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		name := r.Question[0].Name
+		if value, ok := addrs[name]; ok && r.Question[0].Qtype == dns.TypePTR {
+			m.Answer = append(m.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
+				Ptr: value,
+			})
+		} else if ok && r.Question[0].Qtype == dns.TypeTXT {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{value},
+			})
+		} else if ok {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(value),
+			})
+		}
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	t.Cleanup(func() { upstream.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestSafeSearchRewrite(t *testing.T) {
+	// A loopback upstream that knows the safe search endpoints only
+	upstream := startFakeUpstream(t, map[string]string{googleSafeSearch: "216.239.38.120"})
+
+	server := NewServer(blocker.New(), nil, ServerConfig{UpstreamServers: []string{upstream}})
+	if err := server.Groups().Load([]ClientGroup{{Name: "kids", Clients: []string{"10.0.0.2"}, SafeSearch: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"www.google.com.", "google.co.uk.", "WWW.GOOGLE.DE."} {
+		if target, ok := safeSearchTarget(name); !ok || target != googleSafeSearch {
+			t.Errorf("Expected %s to be rewritten to %s, got %q", name, googleSafeSearch, target)
+		}
+	}
+	if _, ok := safeSearchTarget("mail.google.com."); ok {
+		t.Error("Expected mail.google.com not to be rewritten")
+	}
+
+	query := func(client string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("www.google.com.", dns.TypeA)
+		w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}}
+		server.handleRequest(w, r)
+		return w.msg
+	}
+
+	resp := query("10.0.0.2")
+	if len(resp.Answer) != 2 {
+		t.Fatalf("Expected a CNAME and an A record, got %v", resp.Answer)
+	}
+	if cname, ok := resp.Answer[0].(*dns.CNAME); !ok || cname.Target != googleSafeSearch {
+		t.Errorf("Expected a CNAME to %s, got %v", googleSafeSearch, resp.Answer[0])
+	}
+	if a, ok := resp.Answer[1].(*dns.A); !ok || !a.A.Equal(net.ParseIP("216.239.38.120")) {
+		t.Errorf("Expected the target's address, got %v", resp.Answer[1])
+	}
+
+	// Clients outside the group are forwarded as usual
+	if resp := query("10.0.0.3"); len(resp.Answer) != 0 {
+		t.Errorf("Expected no rewrite outside the group, got %v", resp.Answer)
+	}
+}
+
+func TestLocalRecords(t *testing.T) {
+	adblocker := blocker.New()
+	adblocker.AddDomainToBlocklist("nas.home", "custom")
+	server := NewServer(adblocker, nil, ServerConfig{})
+
+	err := server.Records().Load([]LocalRecord{
+		{Name: "nas.home", Type: "A", Value: "192.168.1.10"},
+		{Name: "nas.home", Type: "TXT", Value: "model=ds920"},
+		{Name: "*.dev.lan", Type: "A", Value: "10.0.0.5"},
+		{Name: "printer", Type: "cname", Value: "nas.home"},
+		{Name: "_sip._udp.home", Type: "SRV", Value: "10 5 5060 nas.home"},
+		{Name: "10.0.0.5", Type: "PTR", Value: "dev.lan"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to load records: %v", err)
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}}
+		server.handleRequest(w, r)
+		return w.msg
+	}
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		answer []string
+	}{
+		{"nas.home.", dns.TypeA, []string{"nas.home.\t300\tIN\tA\t192.168.1.10"}},
+		{"NAS.home.", dns.TypeTXT, []string{"nas.home.\t300\tIN\tTXT\t\"model=ds920\""}},
+		{"nas.home.", dns.TypeAAAA, nil},
+		{"api.dev.lan.", dns.TypeA, []string{"api.dev.lan.\t300\tIN\tA\t10.0.0.5"}},
+		{"a.b.dev.lan.", dns.TypeA, []string{"a.b.dev.lan.\t300\tIN\tA\t10.0.0.5"}},
+		{"printer.", dns.TypeA, []string{
+			"printer.\t300\tIN\tCNAME\tnas.home.",
+			"nas.home.\t300\tIN\tA\t192.168.1.10",
+		}},
+		{"_sip._udp.home.", dns.TypeSRV, []string{"_sip._udp.home.\t300\tIN\tSRV\t10 5 5060 nas.home."}},
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, []string{"10.1.168.192.in-addr.arpa.\t300\tIN\tPTR\tnas.home."}},
+		{"5.0.0.10.in-addr.arpa.", dns.TypePTR, []string{"5.0.0.10.in-addr.arpa.\t300\tIN\tPTR\tdev.lan."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			resp := query(tt.name, tt.qtype)
+			if !resp.Authoritative || resp.Rcode != dns.RcodeSuccess {
+				t.Errorf("Expected an authoritative answer, got %v", resp)
+			}
+			if len(resp.Answer) != len(tt.answer) {
+				t.Fatalf("Expected %d answers, got %v", len(tt.answer), resp.Answer)
+			}
+			for i, rr := range resp.Answer {
+				if rr.String() != tt.answer[i] {
+					t.Errorf("Expected %q, got %q", tt.answer[i], rr.String())
+				}
+			}
+		})
+	}
+
+	records := server.Records()
+	if _, err := records.Add(LocalRecord{Name: "printer", Type: "A", Value: "192.168.1.20"}); err == nil {
+		t.Error("Expected a CNAME name to reject other records")
+	}
+	if _, err := records.Add(LocalRecord{Name: "nas.home", Type: "A", Value: "192.168.1.10"}); err != ErrRecordExists {
+		t.Errorf("Expected a duplicate to be rejected, got %v", err)
+	}
+	for _, bad := range []LocalRecord{
+		{Name: "x.home", Type: "A", Value: "::1"},
+		{Name: "x.home", Type: "MX", Value: "mail.home"},
+		{Name: "x.*.home", Type: "A", Value: "10.0.0.1"},
+		{Name: "_x._tcp.home", Type: "SRV", Value: "10 5 nas.home"},
+	} {
+		if _, err := records.Add(bad); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestConditionalForwarding(t *testing.T) {
+	zones, err := forwardZones("172.16.0.0/12")
+	if err != nil || len(zones) != 16 || zones[0] != "16.172.in-addr.arpa." || zones[15] != "31.172.in-addr.arpa." {
+		t.Errorf("Unexpected reverse zones for 172.16.0.0/12: %v, %v", zones, err)
+	}
+	zones, err = forwardZones("fd00::/7")
+	if err != nil || len(zones) != 2 || zones[0] != "c.f.ip6.arpa." || zones[1] != "d.f.ip6.arpa." {
+		t.Errorf("Unexpected reverse zones for fd00::/7: %v, %v", zones, err)
+	}
+
+	public := startFakeUpstream(t, map[string]string{"ads.corp.example.com.": "203.0.113.1"})
+	office := startFakeUpstream(t, map[string]string{"ads.corp.example.com.": "10.8.0.10"})
+	dev := startFakeUpstream(t, map[string]string{"ads.dev.corp.example.com.": "10.9.0.10"})
+
+	adblocker := blocker.New()
+	adblocker.AddDomainToBlocklist("ads.corp.example.com", "custom")
+	adblocker.AddDomainToBlocklist("ads.dev.corp.example.com", "custom")
+
+	config := ServerConfig{
+		UpstreamServers: []string{public},
+		Forwarders: []ForwardRule{
+			{Suffix: "corp.example.com", Upstreams: []string{"127.0.0.1:1", office}, Strategy: StrategyFailover, SkipBlocking: true},
+			{Suffix: "dev.corp.example.com", Upstreams: []string{dev}},
+			{Suffix: "192.168.0.0/16", Upstreams: []string{office}},
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected a valid config, got %v", err)
+	}
+	server := NewServer(adblocker, nil, config)
+
+	if got := server.upstreams.route("1.10.168.192.in-addr.arpa."); got.addrs[0] != office {
+		t.Errorf("Expected reverse lookups for 192.168.0.0/16 to go to the office resolver, got %v", got.addrs)
+	}
+
+	query := func(name string) string {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}}
+		server.handleRequest(w, r)
+		if len(w.msg.Answer) != 1 {
+			return ""
+		}
+		return w.msg.Answer[0].(*dns.A).A.String()
+	}
+
+	if got := query("ads.corp.example.com."); got != "10.8.0.10" {
+		t.Errorf("Expected the office resolver's answer, unblocked, got %q", got)
+	}
+	if got := query("ads.dev.corp.example.com."); got != "0.0.0.0" {
+		t.Errorf("Expected the longer suffix, which blocks, to win, got %q", got)
+	}
+
+	// Other types are forwarded the same way, or answered with NODATA
+	// when blocked
+	txt := func(name string) []dns.RR {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeTXT)
+		w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}}
+		server.handleRequest(w, r)
+		return w.msg.Answer
+	}
+	if answer := txt("ads.corp.example.com."); len(answer) != 1 || answer[0].(*dns.TXT).Txt[0] != "10.8.0.10" {
+		t.Errorf("Expected the office resolver's TXT record, got %v", answer)
+	}
+	if answer := txt("ads.dev.corp.example.com."); len(answer) != 0 {
+		t.Errorf("Expected NODATA for a blocked name, got %v", answer)
+	}
+
+	bad := ServerConfig{Forwarders: []ForwardRule{{Suffix: "corp.example.com", Strategy: "fastest", Upstreams: []string{office}}}}
+	if err := bad.Validate(); err == nil {
+		t.Error("Expected an unknown strategy to be rejected")
+	}
+}
+
+func TestReverseLookups(t *testing.T) {
+	router := startFakeUpstream(t, map[string]string{"20.1.168.192.in-addr.arpa.": "laptop.home."})
+
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(hosts, []byte("127.0.0.1 localhost\n192.168.1.30 tv tv.home # living room\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer(blocker.New(), nil, ServerConfig{
+		UpstreamServers: []string{"127.0.0.1:1"},
+		LocalResolver:   router,
+		HostsFile:       hosts,
+	})
+	if err := server.Records().Load([]LocalRecord{{Name: "nas.home", Type: "A", Value: "192.168.1.10"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, want := range map[string]string{
+		"192.168.1.30": "tv",
+		"192.168.1.10": "nas.home",
+		"192.168.1.20": "laptop.home",
+		"192.168.1.99": "",
+		"8.8.8.8":      "",
+	} {
+		if got := server.ResolveHostname(ip); got != want {
+			t.Errorf("Expected %s to resolve to %q, got %q", ip, want, got)
+		}
+	}
+
+	// Without a local resolver private reverse lookups stay local
+	isolated := NewServer(blocker.New(), nil, ServerConfig{UpstreamServers: []string{router}})
+	r := new(dns.Msg)
+	r.SetQuestion("20.1.168.192.in-addr.arpa.", dns.TypePTR)
+	w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5353}}
+	isolated.handleRequest(w, r)
+	if w.msg.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN for a private PTR query, got %s", dns.RcodeToString[w.msg.Rcode])
+	}
+
+	w = &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5353}}
+	server.handleRequest(w, r)
+	if len(w.msg.Answer) != 1 {
+		t.Errorf("Expected the local resolver to answer, got %v", w.msg)
+	}
+}
+
+func TestDHCPLeases(t *testing.T) {
+	now := time.Now()
+	dnsmasq := fmt.Sprintf("%d 00:11:22:33:44:55 192.168.1.40 Laptop 01:00:11:22:33:44:55\n"+
+		"0 66:77:88:99:aa:bb 192.168.1.41 * *\n"+
+		"%d aa:aa:aa:aa:aa:aa 192.168.1.42 old *\n"+
+		"duid 00:01:00:01:2c:00:00:00:00:11:22:33:44:55\n",
+		now.Add(time.Hour).Unix(), now.Add(-time.Hour).Unix())
+
+	isc := `# The format of this file is documented in the dhcpd.leases(5) manual page.
+lease 192.168.1.50 {
+  starts 4 2026/10/15 10:00:00;
+  ends never;
+  binding state active;
+  hardware ethernet 00:aa:bb:cc:dd:ee;
+  client-hostname "phone";
+}
+lease 192.168.1.51 {
+  ends epoch 1;
+  binding state active;
+  hardware ethernet 00:aa:bb:cc:dd:ff;
+}
+lease 192.168.1.50 {
+  ends never;
+  binding state active;
+  hardware ethernet 00:aa:bb:cc:dd:ee;
+  client-hostname "tablet";
+}
+lease 192.168.1.52 {
+  binding state free;
+  hardware ethernet 00:aa:bb:cc:dd:00;
+}
+`
+	for format, data := range map[string]string{LeaseFormatDnsmasq: dnsmasq, LeaseFormatISC: isc} {
+		leases, err := parseLeases(strings.NewReader(data), "")
+		if err != nil {
+			t.Fatalf("Failed to parse %s leases: %v", format, err)
+		}
+		if len(leases) != 3 && format == LeaseFormatDnsmasq || len(leases) != 2 && format == LeaseFormatISC {
+			t.Errorf("Unexpected %s leases: %+v", format, leases)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	if err := os.WriteFile(path, []byte(dnsmasq), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer(blocker.New(), nil, ServerConfig{
+		UpstreamServers: []string{"127.0.0.1:1"},
+		LeaseFile:       path,
+		ServeLeases:     true,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := server.WatchLeases(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, want := range map[string]string{"192.168.1.40": "laptop", "192.168.1.41": "", "192.168.1.42": ""} {
+		if got := server.ResolveHostname(ip); got != want {
+			t.Errorf("Expected %s to resolve to %q, got %q", ip, want, got)
+		}
+	}
+	if mac := server.ClientMAC("192.168.1.41"); mac != "66:77:88:99:aa:bb" {
+		t.Errorf("Expected the leased MAC, got %q", mac)
+	}
+	if n := len(server.Leases()); n != 2 {
+		t.Errorf("Expected expired leases to be hidden, got %d leases", n)
+	}
+
+	ask := func(name string, qtype uint16) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.168.1.40"), Port: 5353}}
+		server.handleRequest(w, r)
+		return w.msg
+	}
+	if resp := ask("laptop.lan.", dns.TypeA); len(resp.Answer) != 1 || !resp.Authoritative ||
+		resp.Answer[0].(*dns.A).A.String() != "192.168.1.40" {
+		t.Errorf("Expected laptop.lan to be answered from its lease, got %v", resp)
+	}
+	if resp := ask("40.1.168.192.in-addr.arpa.", dns.TypePTR); len(resp.Answer) != 1 ||
+		resp.Answer[0].(*dns.PTR).Ptr != "laptop.lan." {
+		t.Errorf("Expected a PTR answer from the lease, got %v", resp)
+	}
+	if resp := ask("old.lan.", dns.TypeA); resp.Authoritative {
+		t.Errorf("Expected an expired lease not to be served, got %v", resp)
+	}
+
+	// Groups can match on the leased MAC when queries carry none
+	if err := server.Groups().Add(ClientGroup{Name: "guests", MACs: []string{"00:11:22:33:44:55"}}); err != nil {
+		t.Fatal(err)
+	}
+	if group := server.resolveGroup(&dohWriter{}, new(dns.Msg), "192.168.1.40"); group == nil || group.Name != "guests" {
+		t.Errorf("Expected the leased MAC to select the guests group, got %v", group)
+	}
+
+	// Leases from the built-in DHCP server name clients too, and the
+	// longer lease wins when sources overlap
+	server.SetDHCPLeases([]Lease{
+		{IP: "192.168.1.60", MAC: "00:11:22:33:44:60", Hostname: "printer", Expires: now.Add(time.Hour)},
+		{IP: "192.168.1.40", MAC: "00:11:22:33:44:55", Hostname: "stale", Expires: now.Add(time.Minute)},
+	})
+	if got := server.ResolveHostname("192.168.1.60"); got != "printer" {
+		t.Errorf("Expected the DHCP server lease to name the client, got %q", got)
+	}
+	if got := server.ResolveHostname("192.168.1.40"); got != "laptop" {
+		t.Errorf("Expected the longer lease to win, got %q", got)
+	}
+
+	// Rewrites of the lease file are picked up
+	updated := fmt.Sprintf("%d 00:11:22:33:44:55 192.168.1.40 desktop *\n", now.Add(time.Hour).Unix())
+	if err := os.WriteFile(path, []byte(updated), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.ResolveHostname("192.168.1.40") != "desktop" {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the lease file to be reloaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRebindingProtection(t *testing.T) {
+	upstream := startFakeUpstream(t, map[string]string{
+		"evil.example.com.":      "192.168.1.1",
+		"loop.example.com.":      "127.0.0.1",
+		"good.example.com.":      "93.184.216.34",
+		"abc.plex.direct.":       "10.0.0.5",
+		"intranet.corp.example.": "10.1.2.3",
+		"linklocal.example.com.": "169.254.1.1",
+	})
+
+	notifier := &mockNotifier{}
+	server := NewServer(blocker.New(), notifier, ServerConfig{
+		UpstreamServers: []string{upstream},
+		Forwarders:      []ForwardRule{{Suffix: "corp.example", Upstreams: []string{upstream}}},
+		RebindProtect:   true,
+		RebindAllowlist: []string{"plex.direct"},
+	})
+
+	ask := func(s *Server, name string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5353}}
+		s.handleRequest(w, r)
+		return w.msg
+	}
+
+	for _, name := range []string{"evil.example.com.", "loop.example.com.", "linklocal.example.com."} {
+		resp := ask(server, name)
+		if len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.IPv4zero) {
+			t.Errorf("Expected %s to be blocked, got %v", name, resp.Answer)
+		}
+		last := notifier.queries[len(notifier.queries)-1]
+		if !last.blocked || last.reason != reasonRebinding {
+			t.Errorf("Expected %s to be logged as rebinding, got %+v", name, last)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"good.example.com.":      "93.184.216.34",
+		"abc.plex.direct.":       "10.0.0.5",
+		"intranet.corp.example.": "10.1.2.3",
+	} {
+		resp := ask(server, name)
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != want {
+			t.Errorf("Expected %s to resolve to %s, got %v", name, want, resp.Answer)
+		}
+	}
+
+	dropping := NewServer(blocker.New(), nil, ServerConfig{
+		UpstreamServers: []string{upstream},
+		RebindProtect:   true,
+		RebindMode:      RebindDrop,
+	})
+	if resp := ask(dropping, "evil.example.com."); len(resp.Answer) != 0 || resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected the private address to be dropped, got %v", resp)
+	}
+
+	unprotected := NewServer(blocker.New(), nil, ServerConfig{UpstreamServers: []string{upstream}})
+	if resp := ask(unprotected, "evil.example.com."); len(resp.Answer) != 1 {
+		t.Errorf("Expected no filtering without protection, got %v", resp.Answer)
+	}
+
+	bad := ServerConfig{RebindProtect: true, RebindMode: "sometimes"}
+	if err := bad.Validate(); err == nil {
+		t.Error("Expected an unknown rebinding mode to be rejected")
+	}
+}
+
+func TestRateLimiting(t *testing.T) {
+	upstream := startFakeUpstream(t, map[string]string{"example.com.": "93.184.216.34"})
+
+	newServer := func(limit RateLimit) *Server {
+		server := NewServer(blocker.New(), nil, ServerConfig{
+			UpstreamServers: []string{upstream},
+			RateLimit:       limit,
+			RefuseAny:       true,
+		})
+		now := time.Unix(1700000000, 0)
+		server.limiter.clock = func() time.Time { return now }
+		return server
+	}
+	ask := func(s *Server, ip string, qtype uint16, remote net.Addr) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", qtype)
+		if remote == nil {
+			remote = &net.UDPAddr{IP: net.ParseIP(ip), Port: 5353}
+		}
+		w := &dohWriter{remote: remote}
+		s.handleRequest(w, r)
+		return w.msg
+	}
+
+	server := newServer(RateLimit{QPS: 1, Burst: 2, Exempt: []string{"192.168.1.1"}})
+	for i := 0; i < 2; i++ {
+		if resp := ask(server, "192.168.1.20", dns.TypeA, nil); resp == nil || len(resp.Answer) != 1 {
+			t.Fatalf("Expected query %d within the burst to be answered, got %v", i, resp)
+		}
+	}
+	if resp := ask(server, "192.168.1.20", dns.TypeA, nil); resp != nil {
+		t.Errorf("Expected the query over the limit to be dropped, got %v", resp)
+	}
+	if resp := ask(server, "192.168.1.21", dns.TypeA, nil); resp == nil {
+		t.Error("Expected other clients to have their own bucket")
+	}
+	for i := 0; i < 5; i++ {
+		if resp := ask(server, "192.168.1.1", dns.TypeA, nil); resp == nil {
+			t.Fatal("Expected exempt clients not to be limited")
+		}
+	}
+	if got := server.RateLimited()["192.168.1.20"]; got != 1 {
+		t.Errorf("Expected 1 limited query for the client, got %d", got)
+	}
+	if got := server.GetMetrics().RateLimitedQueries; got != 1 {
+		t.Errorf("Expected 1 limited query in the metrics, got %d", got)
+	}
+
+	// Tokens come back at the configured rate
+	server.limiter.clock = func() time.Time { return time.Unix(1700000001, 0) }
+	if resp := ask(server, "192.168.1.20", dns.TypeA, nil); resp == nil {
+		t.Error("Expected the bucket to refill")
+	}
+
+	// Idle clients are forgotten along with their counts
+	server.limiter.clock = func() time.Time { return time.Unix(1700000000, 0).Add(2 * rateLimitSweep) }
+	ask(server, "192.168.1.21", dns.TypeA, nil)
+	if limited := server.RateLimited(); len(limited) != 0 {
+		t.Errorf("Expected idle clients to be pruned, got %v", limited)
+	}
+	if len(server.limiter.buckets) != 1 {
+		t.Errorf("Expected only the active bucket to remain, got %d", len(server.limiter.buckets))
+	}
+
+	// Subnets share a bucket and other actions answer
+	server = newServer(RateLimit{QPS: 1, Burst: 1, IPv4Prefix: 24, Action: RateLimitTruncate})
+	ask(server, "10.0.0.1", dns.TypeA, nil)
+	if resp := ask(server, "10.0.0.2", dns.TypeA, nil); resp == nil || !resp.Truncated {
+		t.Errorf("Expected a truncated answer for the same /24, got %v", resp)
+	}
+	if resp := ask(server, "10.0.0.3", dns.TypeA, &net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 5353}); resp == nil || resp.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected TCP clients to be refused instead, got %v", resp)
+	}
+
+	server = newServer(RateLimit{})
+	if resp := ask(server, "10.0.0.1", dns.TypeANY, nil); resp.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected ANY to be refused, got %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	for _, bad := range []RateLimit{{QPS: -1}, {QPS: 1, Action: "tarpit"}, {QPS: 1, IPv4Prefix: 33}, {QPS: 1, Exempt: []string{"nope"}}} {
+		if err := (ServerConfig{RateLimit: bad}).Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestAccessLists(t *testing.T) {
+	upstream := startFakeUpstream(t, map[string]string{"example.com.": "93.184.216.34"})
+	server := NewServer(blocker.New(), nil, ServerConfig{
+		UpstreamServers: []string{upstream},
+		AllowedClients:  []string{"192.168.1.0/24", "fd00::/8", "127.0.0.1"},
+		DeniedClients:   []string{"192.168.1.66"},
+	})
+
+	ask := func(remote net.Addr) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		w := &dohWriter{remote: remote}
+		server.handleRequest(w, r)
+		return w.msg
+	}
+
+	tests := []struct {
+		remote  net.Addr
+		refused bool
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5353}, false},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}, false},
+		{&net.UDPAddr{IP: net.ParseIP("fd00::20"), Port: 5353}, false},
+		{&net.UDPAddr{IP: net.ParseIP("192.168.1.66"), Port: 5353}, true},
+		{&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5353}, true},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}, true},
+	}
+	for _, tt := range tests {
+		resp := ask(tt.remote)
+		if resp == nil {
+			t.Fatalf("Expected a response for %s", tt.remote)
+		}
+		if refused := resp.Rcode == dns.RcodeRefused; refused != tt.refused {
+			t.Errorf("%s: expected refused=%v, got %s", tt.remote, tt.refused, dns.RcodeToString[resp.Rcode])
+		}
+		if tt.refused && len(resp.Answer) != 0 {
+			t.Errorf("%s: expected no answer, got %v", tt.remote, resp.Answer)
+		}
+	}
+	if got := server.GetMetrics().RefusedQueries; got != 3 {
+		t.Errorf("Expected 3 refused queries, got %d", got)
+	}
+
+	// Without an allow list only denied clients are refused
+	server = NewServer(blocker.New(), nil, ServerConfig{UpstreamServers: []string{upstream}, DeniedClients: []string{"10.0.0.0/8"}})
+	if resp := ask(&net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5353}); resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected other clients to be answered, got %s", dns.RcodeToString[resp.Rcode])
+	}
+	if resp := ask(&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5353}); resp.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected denied clients to be refused, got %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	// An invalid list refuses everyone rather than opening the resolver
+	config := ServerConfig{UpstreamServers: []string{upstream}, AllowedClients: []string{"192.168.1.0/33"}}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an invalid allow list to be rejected")
+	}
+	server = NewServer(blocker.New(), nil, config)
+	if resp := ask(&net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5353}); resp.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected everyone to be refused, got %s", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestQtypePolicies(t *testing.T) {
+	upstream := startFakeUpstream(t, map[string]string{"example.com.": "93.184.216.34"})
+	notifier := &mockNotifier{}
+	server := NewServer(blocker.New(), notifier, ServerConfig{
+		UpstreamServers: []string{upstream},
+		QtypePolicies: []QtypePolicy{
+			{Name: "no-ipv6", Types: []string{"aaaa"}},
+			{Name: "iot", Types: []string{"HTTPS", "TXT"}, Groups: []string{"iot"}},
+		},
+	})
+	if err := server.Groups().Load([]ClientGroup{{Name: "iot", Clients: []string{"10.0.5.0/24"}}}); err != nil {
+		t.Fatalf("Failed to load groups: %v", err)
+	}
+
+	ask := func(client string, qtype uint16) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", qtype)
+		w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}}
+		server.handleRequest(w, r)
+		return w.msg
+	}
+
+	tests := []struct {
+		name     string
+		client   string
+		qtype    uint16
+		filtered bool
+	}{
+		{"global policy", "192.168.1.20", dns.TypeAAAA, true},
+		{"global policy in a group", "10.0.5.3", dns.TypeAAAA, true},
+		{"group policy", "10.0.5.3", dns.TypeHTTPS, true},
+		{"group policy on another type", "10.0.5.3", dns.TypeTXT, true},
+		{"group policy outside the group", "192.168.1.20", dns.TypeTXT, false},
+		{"other types", "10.0.5.3", dns.TypeA, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier.queries = nil
+			resp := ask(tt.client, tt.qtype)
+			if resp == nil {
+				t.Fatal("Expected a response")
+			}
+			if tt.filtered {
+				if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+					t.Errorf("Expected NODATA, got %s with %v", dns.RcodeToString[resp.Rcode], resp.Answer)
+				}
+				if len(notifier.queries) != 1 || !notifier.queries[0].blocked || !strings.HasPrefix(notifier.queries[0].reason, "qtype:") {
+					t.Errorf("Expected a filtered query in the log, got %+v", notifier.queries)
+				}
+			} else if len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != tt.qtype {
+				t.Errorf("Expected the upstream answer, got %v", resp.Answer)
+			}
+		})
+	}
+
+	counts := server.QtypeFiltered()
+	if counts["no-ipv6"] != 2 || counts["iot"] != 2 {
+		t.Errorf("Unexpected per-policy counts %v", counts)
+	}
+
+	for _, bad := range [][]QtypePolicy{
+		{{Types: []string{"AAAA"}}},
+		{{Name: "empty"}},
+		{{Name: "typo", Types: []string{"AAAAA"}}},
+		{{Name: "twice", Types: []string{"A"}}, {Name: "twice", Types: []string{"TXT"}}},
+	} {
+		if err := (ServerConfig{QtypePolicies: bad}).Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestDNS64(t *testing.T) {
+	// RFC 6052 section 2.4 examples for 192.0.2.33
+	embeddings := map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::192.0.2.33",
+	}
+	v4 := net.ParseIP("192.0.2.33").To4()
+	for prefix, want := range embeddings {
+		d, err := newDNS64(prefix, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", prefix, err)
+		}
+		got := d.embed(v4)
+		if !got.Equal(net.ParseIP(want)) {
+			t.Errorf("%s: expected %s, got %s", prefix, want, got)
+		}
+		if back := d.extract(got); !back.Equal(v4) {
+			t.Errorf("%s: expected %s back, got %s", prefix, v4, back)
+		}
+	}
+
+	upstream := startFakeUpstream(t, map[string]string{
+		"example.com.":          "93.184.216.34",
+		"ads.example.net.":      "93.184.216.35",
+		"internal.example.com.": "10.0.0.5",
+	})
+	adblocker := blocker.New()
+	adblocker.AddDomainToBlocklist("ads.example.net", "ads")
+	server := NewServer(adblocker, nil, ServerConfig{
+		UpstreamServers: []string{upstream},
+		DNS64Prefix:     "64:ff9b::/96",
+		DNS64Clients:    []string{"2001:db8:64::/64"},
+	})
+
+	ask := func(name, client string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeAAAA)
+		w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}}
+		server.handleRequest(w, r)
+		return w.msg
+	}
+
+	// The fake upstream knows no AAAA records, so every answer is synthesized
+	resp := ask("example.com.", "2001:db8:64::10")
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Expected a synthesized answer, got %v", resp.Answer)
+	}
+	if aaaa, ok := resp.Answer[0].(*dns.AAAA); !ok || !aaaa.AAAA.Equal(net.ParseIP("64:ff9b::5db8:d822")) {
+		t.Errorf("Expected 64:ff9b::5db8:d822, got %v", resp.Answer[0])
+	}
+	if server.checkCacheKey(getCacheKey("example.com.", dns.TypeAAAA)+":dns64") == nil {
+		t.Error("Expected the synthesized answer to be cached")
+	}
+	if hasAAAA(server.checkCache("example.com.", dns.TypeAAAA)) {
+		t.Error("Expected the native cache entry to hold no synthesized records")
+	}
+
+	if resp := ask("example.com.", "192.168.1.20"); hasAAAA(resp.Answer) {
+		t.Errorf("Expected no synthesis outside the NAT64 clients, got %v", resp.Answer)
+	}
+	if resp := ask("ads.example.net.", "2001:db8:64::10"); len(resp.Answer) != 1 || !resp.Answer[0].(*dns.AAAA).AAAA.Equal(net.IPv6zero) {
+		t.Errorf("Expected the blocked name to get the blocking answer, got %v", resp.Answer)
+	}
+	if resp := ask("internal.example.com.", "2001:db8:64::10"); hasAAAA(resp.Answer) {
+		t.Errorf("Expected no private address in the well-known prefix, got %v", resp.Answer)
+	}
+
+	// Rebinding protection sees through network-specific prefixes
+	server = NewServer(blocker.New(), nil, ServerConfig{
+		UpstreamServers: []string{upstream},
+		DNS64Prefix:     "2001:db8:122:344::/96",
+		RebindProtect:   true,
+	})
+	if resp := ask("internal.example.com.", "2001:db8:64::10"); len(resp.Answer) != 1 || !resp.Answer[0].(*dns.AAAA).AAAA.Equal(net.IPv6zero) {
+		t.Errorf("Expected the synthesized local address to be blocked, got %v", resp.Answer)
+	}
+
+	native := []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP("2606:2800::1")}}
+	if server.dns64.applies(dns.Question{Name: "example.com.", Qtype: dns.TypeAAAA}, "2001:db8:64::10", native) {
+		t.Error("Expected native AAAA answers to be kept")
+	}
+
+	for _, bad := range []string{"64:ff9b::/80", "10.0.0.0/8", "2001:db8:0:0:ff00::/96", "nope"} {
+		if err := (ServerConfig{DNS64Prefix: bad}).Validate(); err == nil {
+			t.Errorf("Expected %s to be rejected", bad)
+		}
+	}
+}
+
+func hasAAAA(answer []dns.RR) bool {
+	for _, rr := range answer {
+		if _, ok := rr.(*dns.AAAA); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMalformedQueries(t *testing.T) {
+	upstream := startFakeUpstream(t, map[string]string{"example.com.": "93.184.216.34"})
+	server := NewServer(blocker.New(), nil, ServerConfig{UpstreamServers: []string{upstream}})
+
+	query := func() *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		return r
+	}
+	tests := []struct {
+		name   string
+		msg    func() *dns.Msg
+		rcode  int
+		silent bool
+	}{
+		{"valid query", query, dns.RcodeSuccess, false},
+		{"no question", func() *dns.Msg { r := query(); r.Question = nil; return r }, dns.RcodeFormatError, false},
+		{"two questions", func() *dns.Msg {
+			r := query()
+			r.Question = append(r.Question, dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+			return r
+		}, dns.RcodeFormatError, false},
+		{"two OPT records", func() *dns.Msg {
+			r := query()
+			r.SetEdns0(1232, false)
+			r.Extra = append(r.Extra, r.Extra[0])
+			return r
+		}, dns.RcodeFormatError, false},
+		{"OPT question", func() *dns.Msg { r := query(); r.Question[0].Qtype = dns.TypeOPT; return r }, dns.RcodeFormatError, false},
+		{"zone transfer", func() *dns.Msg { r := query(); r.Question[0].Qtype = dns.TypeAXFR; return r }, dns.RcodeNotImplemented, false},
+		{"chaos class", func() *dns.Msg { r := query(); r.Question[0].Qclass = dns.ClassCHAOS; return r }, dns.RcodeNotImplemented, false},
+		{"notify", func() *dns.Msg { r := query(); r.Opcode = dns.OpcodeNotify; return r }, dns.RcodeRefused, false},
+		{"update", func() *dns.Msg { r := query(); r.Opcode = dns.OpcodeUpdate; return r }, dns.RcodeNotAuth, false},
+		{"status", func() *dns.Msg { r := query(); r.Opcode = dns.OpcodeStatus; return r }, dns.RcodeNotImplemented, false},
+		{"response", func() *dns.Msg { r := query(); r.Response = true; return r }, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.msg()
+			w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5353}}
+			server.handleRequest(w, r)
+			if tt.silent {
+				if w.msg != nil {
+					t.Errorf("Expected no reply, got %v", w.msg)
+				}
+				return
+			}
+			if w.msg == nil {
+				t.Fatal("Expected a reply")
+			}
+			if w.msg.Rcode != tt.rcode {
+				t.Errorf("Expected %s, got %s", dns.RcodeToString[tt.rcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			if w.msg.Id != r.Id || w.msg.Opcode != r.Opcode || !w.msg.Response {
+				t.Errorf("Expected a reply matching the request header, got %v", w.msg.MsgHdr)
+			}
+			if tt.rcode != dns.RcodeSuccess && len(w.msg.Answer) != 0 {
+				t.Errorf("Expected no answer, got %v", w.msg.Answer)
+			}
+		})
+	}
+
+	if acceptMsg(dns.Header{Bits: headerResponse, Qdcount: 1}) != dns.MsgIgnore {
+		t.Error("Expected responses to be ignored")
+	}
+	if acceptMsg(dns.Header{Qdcount: 2}) != dns.MsgAccept {
+		t.Error("Expected multi-question queries to reach the handler")
+	}
+}
+
+// FuzzHandleRequest feeds wire-format packets to the handler, directly and
+// over DoH, and checks that it never panics and always replies in kind
+func FuzzHandleRequest(f *testing.F) {
+	for _, seed := range []func(*dns.Msg){
+		func(r *dns.Msg) {},
+		func(r *dns.Msg) { r.Question[0].Qtype = dns.TypeAAAA },
+		func(r *dns.Msg) { r.Question[0].Qtype = dns.TypePTR; r.Question[0].Name = "5.1.168.192.in-addr.arpa." },
+		func(r *dns.Msg) { r.Question[0].Qtype = dns.TypeANY },
+		func(r *dns.Msg) { r.SetEdns0(1232, true) },
+		func(r *dns.Msg) { r.Question = append(r.Question, r.Question[0]) },
+		func(r *dns.Msg) { r.Opcode = dns.OpcodeUpdate },
+	} {
+		r := new(dns.Msg)
+		r.SetQuestion("ads.example.com.", dns.TypeA)
+		seed(r)
+		packed, err := r.Pack()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(packed)
+	}
+
+	upstream := startFakeUpstream(f, map[string]string{"example.com.": "93.184.216.34"})
+	adblocker := blocker.New()
+	adblocker.AddDomainToBlocklist("ads.example.com", "ads")
+	server := NewServer(adblocker, nil, ServerConfig{
+		UpstreamServers: []string{upstream},
+		RefuseAny:       true,
+		RebindProtect:   true,
+		DNS64Prefix:     "64:ff9b::/96",
+		QtypePolicies:   []QtypePolicy{{Name: "no-txt", Types: []string{"TXT"}}},
+	})
+
+	f.Fuzz(func(t *testing.T, packed []byte) {
+		req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packed))
+		req.Header.Set("Content-Type", dohMediaType)
+		server.ServeDoH(httptest.NewRecorder(), req, "")
+
+		r := new(dns.Msg)
+		if err := r.Unpack(packed); err != nil {
+			return
+		}
+		w := &dohWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5353}}
+		server.handleRequest(w, r)
+		if r.Response {
+			if w.msg != nil {
+				t.Errorf("Expected responses to go unanswered, got %v", w.msg)
+			}
+			return
+		}
+		if w.msg == nil {
+			t.Fatal("Expected a reply")
+		}
+		if w.msg.Id != r.Id || !w.msg.Response {
+			t.Errorf("Reply %v does not match request %v", w.msg.MsgHdr, r.MsgHdr)
+		}
+		if _, err := w.msg.Pack(); err != nil {
+			t.Errorf("Reply does not pack: %v", err)
+		}
+	})
+}
+
+func TestFailedSavesLeaveManagersUnchanged(t *testing.T) {
+	// Saves fail because the data directory is a regular file
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	groups := NewGroupManager("")
+	if err := groups.Load([]ClientGroup{{Name: "kids", Clients: []string{"10.0.0.0/24"}}}); err != nil {
+		t.Fatal(err)
+	}
+	groups.path = filepath.Join(notDir, "groups.json")
+	if err := groups.Add(ClientGroup{Name: "work", Clients: []string{"10.0.1.0/24"}}); err == nil {
+		t.Error("Expected adding a group to fail")
+	}
+	if err := groups.Update("kids", ClientGroup{Clients: []string{"10.0.2.0/24"}}); err == nil {
+		t.Error("Expected updating a group to fail")
+	}
+	if err := groups.SetServiceBlocked("kids", "tiktok", true); err == nil {
+		t.Error("Expected blocking a service to fail")
+	}
+	if err := groups.Remove("kids"); err == nil {
+		t.Error("Expected removing a group to fail")
+	}
+	if _, ok := groups.Get("work"); ok {
+		t.Error("Expected the failed add not to take effect")
+	}
+	kids, ok := groups.Get("kids")
+	if !ok || kids.Clients[0] != "10.0.0.0/24" || len(kids.Services) != 0 {
+		t.Errorf("Expected the group to be unchanged, got %+v", kids)
+	}
+	if group := groups.Resolve(ClientInfo{IP: "10.0.2.5"}); group != nil {
+		t.Errorf("Expected the failed update not to take effect, got %s", group.Name)
+	}
+
+	records := NewRecordManager("")
+	if err := records.Load([]LocalRecord{{Name: "nas.lan", Type: "A", Value: "10.0.0.5"}}); err != nil {
+		t.Fatal(err)
+	}
+	records.path = filepath.Join(notDir, "rewrites.json")
+	existing := records.List()[0]
+	if _, err := records.Add(LocalRecord{Name: "printer.lan", Type: "A", Value: "10.0.0.6"}); err == nil {
+		t.Error("Expected adding a record to fail")
+	}
+	if _, err := records.Update(existing.ID, LocalRecord{Name: "nas.lan", Type: "A", Value: "10.0.0.7"}); err == nil {
+		t.Error("Expected updating a record to fail")
+	}
+	if err := records.Remove(existing.ID); err == nil {
+		t.Error("Expected removing a record to fail")
+	}
+	if _, _, ok := records.lookup("printer.lan.", dns.TypeA); ok {
+		t.Error("Expected the failed add not to take effect")
+	}
+	answer, _, ok := records.lookup("nas.lan.", dns.TypeA)
+	if !ok || len(answer) != 1 || !answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("Expected the record to be unchanged, got %v", answer)
+	}
+
+	// Schedules are saved once, then their directory is replaced by a file.
+	// A window starting in two hours keeps its list out of force now.
+	adblocker := blocker.New()
+	adblocker.AddDomainToBlocklist("ads.example", "ads")
+	adblocker.AddDomainToBlocklist("social.example", "social")
+	clock := func(offset time.Duration) string { return time.Now().Add(offset).Format("15:04") }
+	dataDir := filepath.Join(t.TempDir(), "data")
+	schedules := blocker.NewScheduleManager(adblocker, filepath.Join(dataDir, "schedules.json"))
+	later, err := schedules.Add(blocker.Schedule{Lists: []string{"ads"}, Start: clock(2 * time.Hour), End: clock(3 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(dataDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dataDir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := schedules.Add(blocker.Schedule{Lists: []string{"social"}, Start: clock(2 * time.Hour), End: clock(3 * time.Hour)}); err == nil {
+		t.Error("Expected adding a schedule to fail")
+	}
+	if _, err := schedules.Update(later.ID, blocker.Schedule{Lists: []string{"ads"}, Start: clock(-time.Hour), End: clock(time.Hour)}); err == nil {
+		t.Error("Expected updating a schedule to fail")
+	}
+	if err := schedules.Remove(later.ID); err == nil {
+		t.Error("Expected removing a schedule to fail")
+	}
+	if list := schedules.List(); len(list) != 1 || list[0].ID != later.ID || list[0].End != later.End {
+		t.Errorf("Expected the schedules to be unchanged, got %+v", list)
+	}
+	if blocked, _ := adblocker.IsBlocked("social.example"); !blocked {
+		t.Error("Expected the failed add not to take effect")
+	}
+	if blocked, _ := adblocker.IsBlocked("ads.example"); blocked {
+		t.Error("Expected the failed update and removal not to take effect")
+	}
+}
+
+func TestAccessListsOnEveryTransport(t *testing.T) {
+	upstream := startFakeUpstream(t, map[string]string{"example.com.": "93.184.216.34"})
+	certFile, keyFile := writeTestCertificate(t)
+
+	start := func(allowed []string) *Server {
+		server := NewServer(blocker.New(), nil, ServerConfig{
+			UpstreamServers: []string{upstream},
+			AllowedClients:  allowed,
+			TLSAddr:         "127.0.0.1:0",
+			TLSCertFile:     certFile,
+			TLSKeyFile:      keyFile,
+		})
+		errChan := make(chan error, 1)
+		go func() { errChan <- server.Start("127.0.0.1:0") }()
+		select {
+		case <-server.Ready:
+		case err := <-errChan:
+			t.Fatalf("Failed to start: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Server did not start")
+		}
+		t.Cleanup(func() { server.Shutdown(context.Background()) })
+		return server
+	}
+	addrs := func(server *Server) map[string]string {
+		return map[string]string{
+			"udp":     server.servers[0].PacketConn.LocalAddr().String(),
+			"tcp":     server.servers[1].Listener.Addr().String(),
+			"tcp-tls": server.servers[2].Listener.Addr().String(),
+		}
+	}
+	ask := func(network, addr string) *dns.Msg {
+		client := &dns.Client{Net: network, Timeout: 2 * time.Second, TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		resp, _, err := client.Exchange(r, addr)
+		if err != nil {
+			t.Fatalf("%s query failed: %v", network, err)
+		}
+		return resp
+	}
+
+	// Loopback is not on the allow list
+	refusing := start([]string{"10.0.0.0/8"})
+	for network, addr := range addrs(refusing) {
+		if resp := ask(network, addr); resp.Rcode != dns.RcodeRefused || len(resp.Answer) != 0 {
+			t.Errorf("%s: expected REFUSED, got %s with %v", network, dns.RcodeToString[resp.Rcode], resp.Answer)
+		}
+	}
+	refusing.metrics.mu.Lock()
+	refused := refusing.metrics.RefusedQueries
+	refusing.metrics.mu.Unlock()
+	if refused != 3 {
+		t.Errorf("Expected 3 refused queries, got %d", refused)
+	}
+
+	answering := start([]string{"127.0.0.1"})
+	for network, addr := range addrs(answering) {
+		if resp := ask(network, addr); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+			t.Errorf("%s: expected an answer, got %s with %v", network, dns.RcodeToString[resp.Rcode], resp.Answer)
+		}
+	}
+}
+
+func TestShutdownAfterFailedListener(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	server := NewServer(blocker.New(), nil, ServerConfig{
+		UpstreamServers: []string{"127.0.0.1:1"},
+		TLSAddr:         taken.Addr().String(),
+		TLSCertFile:     certFile,
+		TLSKeyFile:      keyFile,
+	})
+	if err := server.Start("127.0.0.1:0"); err == nil {
+		t.Fatal("Expected the DoT listener to fail on a port in use")
+	}
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Errorf("Expected listeners that never started to be skipped, got %v", err)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// its key, returning their paths
+func writeTestCertificate(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "dns.crt")
+	keyFile = filepath.Join(dir, "dns.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}